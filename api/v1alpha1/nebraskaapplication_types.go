@@ -0,0 +1,363 @@
+package v1alpha1
+
+import (
+	"github.com/fluxcd/pkg/apis/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ReadyCondition indicates that the last check with the Nebraska server
+	// and the last update, if any, succeeded.
+	ReadyCondition = "Ready"
+
+	// ReconciliationSucceededReason is used when the last reconciliation
+	// succeeded.
+	ReconciliationSucceededReason = "ReconciliationSucceeded"
+
+	// ReconciliationFailedReason is used when the last reconciliation failed.
+	ReconciliationFailedReason = "ReconciliationFailed"
+)
+
+// NebraskaApplicationSpec defines the Nebraska application the agent keeps up
+// to date.
+type NebraskaApplicationSpec struct {
+	// AppID is the Nebraska assigned application ID.
+	// +kubebuilder:validation:MinLength=1
+	AppID string `json:"appID"`
+
+	// Channel to subscribe to for this application.
+	// +kubebuilder:default=stable
+	// +optional
+	Channel string `json:"channel,omitempty"`
+
+	// Server is the Nebraska server URL. Defaults to the agent's
+	// --nebraska-server flag.
+	// +optional
+	Server string `json:"server,omitempty"`
+
+	// Interval at which the Nebraska server is polled for updates. Defaults
+	// to the agent's --interval flag.
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+
+	// TargetNamespace is the namespace the Flux objects of this application
+	// are created in. Overrides the namespace given in the update payload.
+	// +optional
+	TargetNamespace string `json:"targetNamespace,omitempty"`
+
+	// VersionPolicy restricts the versions updates are applied for. Updates
+	// to any version are applied when unset.
+	// +optional
+	VersionPolicy *VersionPolicy `json:"versionPolicy,omitempty"`
+
+	// Paused stops applying updates. The agent keeps checking in with
+	// Nebraska and reporting the installed version.
+	// +optional
+	Paused bool `json:"paused,omitempty"`
+
+	// PauseReason is shown in the logs, events and metrics while paused.
+	// +optional
+	PauseReason string `json:"pauseReason,omitempty"`
+
+	// DryRun only plans updates: the changes to the Flux objects are logged
+	// and recorded as events instead of being applied.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// RequireApproval holds updates until an operator approves them by
+	// setting the nebraska.kinvolk.io/approved-version annotation of the
+	// NebraskaApplication to the version of the update.
+	// +optional
+	RequireApproval bool `json:"requireApproval,omitempty"`
+
+	// Verification configures the signature verification of updates.
+	// +optional
+	Verification *Verification `json:"verification,omitempty"`
+
+	// MaintenanceWindows restrict when updates are applied. Updates found
+	// outside of all windows are deferred until one opens. Updates are
+	// applied at any time when empty.
+	// +optional
+	MaintenanceWindows []MaintenanceWindow `json:"maintenanceWindows,omitempty"`
+
+	// OverrunPolicy decides what happens to an update that would not finish
+	// before its maintenance window ends.
+	// +kubebuilder:default=Continue
+	// +optional
+	OverrunPolicy OverrunPolicy `json:"overrunPolicy,omitempty"`
+
+	// ReadinessTimeout is how long to wait for an update to become ready
+	// before it is rolled back. Defaults to the spec.timeout of the
+	// Kustomization, or 10m.
+	// +optional
+	ReadinessTimeout *metav1.Duration `json:"readinessTimeout,omitempty"`
+}
+
+// Verification requires the update manifest to be signed by one of the
+// public keys in the referenced Secret.
+type Verification struct {
+	// SecretRef is the Secret in the namespace of the NebraskaApplication
+	// holding PEM encoded ed25519 or ECDSA public keys, one per data key.
+	SecretRef meta.LocalObjectReference `json:"secretRef"`
+}
+
+// VersionPolicy restricts the versions updates are applied for. Updates
+// outside of the policy are skipped and reported to Nebraska as failed.
+type VersionPolicy struct {
+	// Constraint is a semver range the version must be in, e.g.
+	// ">=2.3.0 <3.0.0".
+	// +optional
+	Constraint string `json:"constraint,omitempty"`
+
+	// AllowDowngrade allows updates to versions lower than the installed
+	// one.
+	// +optional
+	AllowDowngrade bool `json:"allowDowngrade,omitempty"`
+
+	// AllowPrerelease allows updates to pre-release versions, e.g.
+	// 1.2.0-rc.1.
+	// +optional
+	AllowPrerelease bool `json:"allowPrerelease,omitempty"`
+}
+
+// MaintenanceWindow is a recurring time range in which updates are applied.
+// It is either given by Days, Start and End, or by a cron Schedule and a
+// Duration.
+type MaintenanceWindow struct {
+	// Days of the week the window opens on. Defaults to every day.
+	// +optional
+	Days []Weekday `json:"days,omitempty"`
+
+	// Start is the time of day the window opens at, as HH:MM.
+	// +kubebuilder:validation:Pattern=`^([01][0-9]|2[0-3]):[0-5][0-9]$`
+	// +optional
+	Start string `json:"start,omitempty"`
+
+	// End is the time of day the window closes at, as HH:MM. An End before
+	// Start closes the window on the next day.
+	// +kubebuilder:validation:Pattern=`^([01][0-9]|2[0-3]):[0-5][0-9]$`
+	// +optional
+	End string `json:"end,omitempty"`
+
+	// Schedule is a cron expression of the times the window opens at, e.g.
+	// "0 2 * * 6" for Saturdays at 02:00.
+	// +optional
+	Schedule string `json:"schedule,omitempty"`
+
+	// Duration the window stays open for after each time of the Schedule.
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+
+	// TimeZone is the IANA time zone of the window, e.g. Europe/Berlin.
+	// Defaults to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// Weekday is a day of the week.
+// +kubebuilder:validation:Enum=Sunday;Monday;Tuesday;Wednesday;Thursday;Friday;Saturday
+type Weekday string
+
+// OverrunPolicy decides what happens to an update that would not finish before
+// its maintenance window ends.
+// +kubebuilder:validation:Enum=Continue;Defer;Rollback
+type OverrunPolicy string
+
+const (
+	// OverrunPolicyContinue lets the update finish after the window ended.
+	OverrunPolicyContinue OverrunPolicy = "Continue"
+
+	// OverrunPolicyDefer only starts the update when the window is open for
+	// long enough for the update to become ready, otherwise it is deferred
+	// to the next window.
+	OverrunPolicyDefer OverrunPolicy = "Defer"
+
+	// OverrunPolicyRollback rolls the update back when it is not ready by the
+	// end of the window.
+	OverrunPolicyRollback OverrunPolicy = "Rollback"
+)
+
+// NebraskaApplicationStatus defines the observed state of a NebraskaApplication.
+type NebraskaApplicationStatus struct {
+	// ObservedGeneration is the last reconciled generation.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// InstalledVersion is the version of the application installed by the agent.
+	// +optional
+	InstalledVersion string `json:"installedVersion,omitempty"`
+
+	// LastCheckTime is the last time the agent checked Nebraska for updates.
+	// +optional
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+
+	// LastError is the error of the last reconciliation, if any.
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+
+	// PendingVersion is the version of an update that was found but not
+	// applied yet, e.g. because no maintenance window is open.
+	// +optional
+	PendingVersion string `json:"pendingVersion,omitempty"`
+
+	// PendingApproval is the update waiting for approval, if any.
+	// +optional
+	PendingApproval *PendingApproval `json:"pendingApproval,omitempty"`
+
+	// Update is the progress of the last update. It is persisted on every
+	// transition, so that an update interrupted by a restart of the agent is
+	// resumed or aborted. The outcome is kept until the next update starts,
+	// update checks are recorded in LastCheckTime.
+	// +optional
+	Update *UpdateProgress `json:"update,omitempty"`
+
+	// FailedVersion is the version of the last update that failed or was
+	// rolled back after its Flux objects were applied. Updates to it are
+	// skipped until Nebraska offers another version, or the field is cleared
+	// to retry it.
+	// +optional
+	FailedVersion string `json:"failedVersion,omitempty"`
+
+	// PendingEvents are the Omaha events that could not be delivered to
+	// Nebraska yet, oldest first. They are retried in order.
+	// +optional
+	PendingEvents []OmahaEvent `json:"pendingEvents,omitempty"`
+
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// PendingApproval is an update waiting for approval.
+type PendingApproval struct {
+	// Version of the update. Approve it by setting the
+	// nebraska.kinvolk.io/approved-version annotation to this version.
+	Version string `json:"version"`
+
+	// Summary of the changes the update makes to the Flux objects.
+	// +optional
+	Summary string `json:"summary,omitempty"`
+
+	// Since is the time the update was found.
+	Since metav1.Time `json:"since"`
+}
+
+// UpdatePhase is a step of an update.
+// +kubebuilder:validation:Enum=Fetching;Applying;Verifying;RollingBack;Complete;Failed;RolledBack
+type UpdatePhase string
+
+const (
+	// UpdatePhaseFetching means that the update manifest is downloaded and
+	// verified.
+	UpdatePhaseFetching UpdatePhase = "Fetching"
+
+	// UpdatePhaseApplying means that the Flux objects are written.
+	UpdatePhaseApplying UpdatePhase = "Applying"
+
+	// UpdatePhaseVerifying means that the agent waits for the release to
+	// become ready.
+	UpdatePhaseVerifying UpdatePhase = "Verifying"
+
+	// UpdatePhaseRollingBack means that the agent waits for the restored
+	// release to become ready after the update failed.
+	UpdatePhaseRollingBack UpdatePhase = "RollingBack"
+
+	// UpdatePhaseComplete means that the update is installed.
+	UpdatePhaseComplete UpdatePhase = "Complete"
+
+	// UpdatePhaseFailed means that the update failed and could not be
+	// rolled back.
+	UpdatePhaseFailed UpdatePhase = "Failed"
+
+	// UpdatePhaseRolledBack means that the update failed and the previous
+	// version was restored.
+	UpdatePhaseRolledBack UpdatePhase = "RolledBack"
+)
+
+// UpdateProgress is the progress of an update.
+type UpdateProgress struct {
+	// Phase is the current step of the update.
+	Phase UpdatePhase `json:"phase"`
+
+	// Version of the update.
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// Release is the Kustomization or HelmRelease being verified.
+	// +optional
+	Release *ReleaseReference `json:"release,omitempty"`
+
+	// Deadline is the time by which the release has to be ready.
+	// +optional
+	Deadline *metav1.Time `json:"deadline,omitempty"`
+
+	// Message explains the phase, e.g. why the update failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// LastTransitionTime is the time the phase was entered.
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+}
+
+// OmahaEvent is an event reporting the progress of an update to Nebraska.
+type OmahaEvent struct {
+	// Type is the Omaha event type, e.g. 3 for a completed update.
+	Type int `json:"type"`
+
+	// Result is the Omaha event result, e.g. 0 for an error.
+	Result int `json:"result"`
+
+	// ErrorCode of an error event.
+	// +optional
+	ErrorCode int `json:"errorCode,omitempty"`
+
+	// Version is the installed version of the application when the event
+	// happened.
+	Version string `json:"version"`
+
+	// Time the event happened.
+	Time metav1.Time `json:"time"`
+}
+
+// ReleaseReference identifies the generation of a Kustomization or
+// HelmRelease written by the agent.
+type ReleaseReference struct {
+	// +kubebuilder:validation:Enum=Kustomization;HelmRelease
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=nbsapp
+// +kubebuilder:printcolumn:name="App ID",type=string,JSONPath=`.spec.appID`
+// +kubebuilder:printcolumn:name="Channel",type=string,JSONPath=`.spec.channel`
+// +kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.status.installedVersion`
+// +kubebuilder:printcolumn:name="Pending",type=string,JSONPath=`.status.pendingVersion`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.update.phase`
+// +kubebuilder:printcolumn:name="Paused",type=boolean,JSONPath=`.spec.paused`,priority=1
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// NebraskaApplication is the Schema for the nebraskaapplications API.
+type NebraskaApplication struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NebraskaApplicationSpec   `json:"spec,omitempty"`
+	Status NebraskaApplicationStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// NebraskaApplicationList contains a list of NebraskaApplication.
+type NebraskaApplicationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NebraskaApplication `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NebraskaApplication{}, &NebraskaApplicationList{})
+}
@@ -0,0 +1,108 @@
+package v1alpha1
+
+import (
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// UpdateManifestKind is the kind of the update manifest.
+const UpdateManifestKind = "UpdateManifest"
+
+// UpdateManifest describes what the agent deploys for a version of an
+// application. It is published with the Nebraska package of the version.
+type UpdateManifest struct {
+	APIVersion string                 `json:"apiVersion"`
+	Kind       string                 `json:"kind"`
+	Metadata   UpdateManifestMetadata `json:"metadata"`
+	Spec       UpdateManifestSpec     `json:"spec"`
+}
+
+// UpdateManifestMetadata holds the name and namespace of the generated Flux
+// objects.
+type UpdateManifestMetadata struct {
+	Name string `json:"name"`
+
+	// Namespace is overridden by the target namespace of the
+	// NebraskaApplication.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// UpdateManifestSpec holds the Flux source of the application and how it is
+// deployed. Exactly one of Kustomization and HelmRelease must be set.
+type UpdateManifestSpec struct {
+	// Source the application is deployed from.
+	Source UpdateSource `json:"source"`
+
+	// Kustomization deploys a Git, OCI or Bucket source. The source
+	// reference is set by the agent.
+	// +optional
+	Kustomization *kustomizeapi.KustomizationSpec `json:"kustomization,omitempty"`
+
+	// HelmRelease deploys a chart from a Helm repository source. The chart
+	// source reference is set by the agent.
+	// +optional
+	HelmRelease *helmapi.HelmReleaseSpec `json:"helmRelease,omitempty"`
+}
+
+// UpdateSource is the Flux source of an update. Exactly one of the fields
+// must be set.
+type UpdateSource struct {
+	// +optional
+	Git *GitSource `json:"git,omitempty"`
+
+	// +optional
+	OCI *OCISource `json:"oci,omitempty"`
+
+	// +optional
+	Bucket *BucketSource `json:"bucket,omitempty"`
+
+	// +optional
+	HelmRepository *HelmRepositorySource `json:"helmRepository,omitempty"`
+}
+
+// GitSource is deployed as a GitRepository with the given spec. The URL is
+// used as is, including the port and user. The SecretRef is required for SSH
+// repositories and must be in the namespace of the Flux objects. The Interval
+// defaults to 5m.
+type GitSource struct {
+	sourceapi.GitRepositorySpec `json:",inline"`
+}
+
+// OCISource is deployed as an OCIRepository. Exactly one of Digest and Tag
+// must be set.
+type OCISource struct {
+	// URL of the OCI repository, starting with oci://.
+	URL string `json:"url"`
+
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// +optional
+	Tag string `json:"tag,omitempty"`
+
+	// Insecure allows connecting to the registry over plain HTTP.
+	// +optional
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// BucketSource is deployed as a Bucket of an S3 compatible endpoint.
+type BucketSource struct {
+	Endpoint   string `json:"endpoint"`
+	BucketName string `json:"bucketName"`
+
+	// Prefix limits the objects used to the ones below it.
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// Insecure allows connecting to the endpoint over plain HTTP.
+	// +optional
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// HelmRepositorySource is deployed as a HelmRepository.
+type HelmRepositorySource struct {
+	// URL of the Helm chart repository.
+	URL string `json:"url"`
+}
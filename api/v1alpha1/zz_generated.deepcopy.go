@@ -0,0 +1,438 @@
+//go:build !ignore_autogenerated
+
+// Code generated by controller-gen. DO NOT EDIT.
+
+package v1alpha1
+
+import (
+	"github.com/fluxcd/helm-controller/api/v2beta1"
+	"github.com/fluxcd/kustomize-controller/api/v1beta2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BucketSource) DeepCopyInto(out *BucketSource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BucketSource.
+func (in *BucketSource) DeepCopy() *BucketSource {
+	if in == nil {
+		return nil
+	}
+	out := new(BucketSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitSource) DeepCopyInto(out *GitSource) {
+	*out = *in
+	in.GitRepositorySpec.DeepCopyInto(&out.GitRepositorySpec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitSource.
+func (in *GitSource) DeepCopy() *GitSource {
+	if in == nil {
+		return nil
+	}
+	out := new(GitSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HelmRepositorySource) DeepCopyInto(out *HelmRepositorySource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HelmRepositorySource.
+func (in *HelmRepositorySource) DeepCopy() *HelmRepositorySource {
+	if in == nil {
+		return nil
+	}
+	out := new(HelmRepositorySource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MaintenanceWindow) DeepCopyInto(out *MaintenanceWindow) {
+	*out = *in
+	if in.Days != nil {
+		in, out := &in.Days, &out.Days
+		*out = make([]Weekday, len(*in))
+		copy(*out, *in)
+	}
+	if in.Duration != nil {
+		in, out := &in.Duration, &out.Duration
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MaintenanceWindow.
+func (in *MaintenanceWindow) DeepCopy() *MaintenanceWindow {
+	if in == nil {
+		return nil
+	}
+	out := new(MaintenanceWindow)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NebraskaApplication) DeepCopyInto(out *NebraskaApplication) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NebraskaApplication.
+func (in *NebraskaApplication) DeepCopy() *NebraskaApplication {
+	if in == nil {
+		return nil
+	}
+	out := new(NebraskaApplication)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *NebraskaApplication) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NebraskaApplicationList) DeepCopyInto(out *NebraskaApplicationList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]NebraskaApplication, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NebraskaApplicationList.
+func (in *NebraskaApplicationList) DeepCopy() *NebraskaApplicationList {
+	if in == nil {
+		return nil
+	}
+	out := new(NebraskaApplicationList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *NebraskaApplicationList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NebraskaApplicationSpec) DeepCopyInto(out *NebraskaApplicationSpec) {
+	*out = *in
+	if in.Interval != nil {
+		in, out := &in.Interval, &out.Interval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.VersionPolicy != nil {
+		in, out := &in.VersionPolicy, &out.VersionPolicy
+		*out = new(VersionPolicy)
+		**out = **in
+	}
+	if in.Verification != nil {
+		in, out := &in.Verification, &out.Verification
+		*out = new(Verification)
+		**out = **in
+	}
+	if in.MaintenanceWindows != nil {
+		in, out := &in.MaintenanceWindows, &out.MaintenanceWindows
+		*out = make([]MaintenanceWindow, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ReadinessTimeout != nil {
+		in, out := &in.ReadinessTimeout, &out.ReadinessTimeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NebraskaApplicationSpec.
+func (in *NebraskaApplicationSpec) DeepCopy() *NebraskaApplicationSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NebraskaApplicationSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NebraskaApplicationStatus) DeepCopyInto(out *NebraskaApplicationStatus) {
+	*out = *in
+	if in.LastCheckTime != nil {
+		in, out := &in.LastCheckTime, &out.LastCheckTime
+		*out = (*in).DeepCopy()
+	}
+	if in.PendingApproval != nil {
+		in, out := &in.PendingApproval, &out.PendingApproval
+		*out = new(PendingApproval)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Update != nil {
+		in, out := &in.Update, &out.Update
+		*out = new(UpdateProgress)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PendingEvents != nil {
+		in, out := &in.PendingEvents, &out.PendingEvents
+		*out = make([]OmahaEvent, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NebraskaApplicationStatus.
+func (in *NebraskaApplicationStatus) DeepCopy() *NebraskaApplicationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NebraskaApplicationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OCISource) DeepCopyInto(out *OCISource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OCISource.
+func (in *OCISource) DeepCopy() *OCISource {
+	if in == nil {
+		return nil
+	}
+	out := new(OCISource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OmahaEvent) DeepCopyInto(out *OmahaEvent) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OmahaEvent.
+func (in *OmahaEvent) DeepCopy() *OmahaEvent {
+	if in == nil {
+		return nil
+	}
+	out := new(OmahaEvent)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PendingApproval) DeepCopyInto(out *PendingApproval) {
+	*out = *in
+	in.Since.DeepCopyInto(&out.Since)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PendingApproval.
+func (in *PendingApproval) DeepCopy() *PendingApproval {
+	if in == nil {
+		return nil
+	}
+	out := new(PendingApproval)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReleaseReference) DeepCopyInto(out *ReleaseReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReleaseReference.
+func (in *ReleaseReference) DeepCopy() *ReleaseReference {
+	if in == nil {
+		return nil
+	}
+	out := new(ReleaseReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpdateManifest) DeepCopyInto(out *UpdateManifest) {
+	*out = *in
+	out.Metadata = in.Metadata
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpdateManifest.
+func (in *UpdateManifest) DeepCopy() *UpdateManifest {
+	if in == nil {
+		return nil
+	}
+	out := new(UpdateManifest)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpdateManifestMetadata) DeepCopyInto(out *UpdateManifestMetadata) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpdateManifestMetadata.
+func (in *UpdateManifestMetadata) DeepCopy() *UpdateManifestMetadata {
+	if in == nil {
+		return nil
+	}
+	out := new(UpdateManifestMetadata)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpdateManifestSpec) DeepCopyInto(out *UpdateManifestSpec) {
+	*out = *in
+	in.Source.DeepCopyInto(&out.Source)
+	if in.Kustomization != nil {
+		in, out := &in.Kustomization, &out.Kustomization
+		*out = new(v1beta2.KustomizationSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.HelmRelease != nil {
+		in, out := &in.HelmRelease, &out.HelmRelease
+		*out = new(v2beta1.HelmReleaseSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpdateManifestSpec.
+func (in *UpdateManifestSpec) DeepCopy() *UpdateManifestSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(UpdateManifestSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpdateProgress) DeepCopyInto(out *UpdateProgress) {
+	*out = *in
+	if in.Release != nil {
+		in, out := &in.Release, &out.Release
+		*out = new(ReleaseReference)
+		**out = **in
+	}
+	if in.Deadline != nil {
+		in, out := &in.Deadline, &out.Deadline
+		*out = (*in).DeepCopy()
+	}
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpdateProgress.
+func (in *UpdateProgress) DeepCopy() *UpdateProgress {
+	if in == nil {
+		return nil
+	}
+	out := new(UpdateProgress)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpdateSource) DeepCopyInto(out *UpdateSource) {
+	*out = *in
+	if in.Git != nil {
+		in, out := &in.Git, &out.Git
+		*out = new(GitSource)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.OCI != nil {
+		in, out := &in.OCI, &out.OCI
+		*out = new(OCISource)
+		**out = **in
+	}
+	if in.Bucket != nil {
+		in, out := &in.Bucket, &out.Bucket
+		*out = new(BucketSource)
+		**out = **in
+	}
+	if in.HelmRepository != nil {
+		in, out := &in.HelmRepository, &out.HelmRepository
+		*out = new(HelmRepositorySource)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpdateSource.
+func (in *UpdateSource) DeepCopy() *UpdateSource {
+	if in == nil {
+		return nil
+	}
+	out := new(UpdateSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Verification) DeepCopyInto(out *Verification) {
+	*out = *in
+	out.SecretRef = in.SecretRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Verification.
+func (in *Verification) DeepCopy() *Verification {
+	if in == nil {
+		return nil
+	}
+	out := new(Verification)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VersionPolicy) DeepCopyInto(out *VersionPolicy) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VersionPolicy.
+func (in *VersionPolicy) DeepCopy() *VersionPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(VersionPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
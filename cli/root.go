@@ -2,10 +2,13 @@ package cli
 
 import (
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"k8s.io/apimachinery/pkg/types"
+
 	"github.com/kinvolk/nebraska-update-agent/pkg/updater"
 )
 
@@ -23,40 +26,60 @@ func Execute() {
 
 var (
 	kubeconfig     string
-	appId          string
 	interval       int64
 	verbose        bool
 	dev            bool
 	nebraskaServer string
-	channel        string
+	watchNamespace string
+	dryRun         bool
+
+	pauseConfigMap          string
+	pauseConfigMapNamespace string
+
+	leaderElect             bool
+	leaderElectionNamespace string
+	leaderElectionID        string
+
+	metricsAddr               string
+	readinessFailureThreshold int
+	reconcileDeadline         time.Duration
 )
 
 func init() {
 	RootCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", "$HOME/.kube/config", "Path to Kubeconfig file.")
-	RootCmd.PersistentFlags().StringVar(&appId, "app-id", "", "Nebraska assigned application ID.")
-	RootCmd.PersistentFlags().StringVar(&nebraskaServer, "nebraska-server", "", "Nebraska server URL.")
-	RootCmd.PersistentFlags().StringVar(&channel, "channel", "stable", "Channel to subscribe to for this application [stable | beta | alpha].")
-	RootCmd.PersistentFlags().Int64Var(&interval, "interval", 1, "Polling interval for Nebraska server.")
+	RootCmd.PersistentFlags().StringVar(&nebraskaServer, "nebraska-server", "", "Default Nebraska server URL for NebraskaApplications without spec.server.")
+	RootCmd.PersistentFlags().StringVar(&watchNamespace, "watch-namespace", "", "Namespace to watch for NebraskaApplications. Defaults to all namespaces.")
+	RootCmd.PersistentFlags().Int64Var(&interval, "interval", 1, "Default polling interval in seconds for NebraskaApplications without spec.interval.")
 	RootCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "Output verbose logs.")
 	RootCmd.PersistentFlags().BoolVar(&dev, "dev", false, "God mode.")
+	RootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Only log and record the changes updates would make, without applying them.")
+	RootCmd.PersistentFlags().StringVar(&pauseConfigMap, "pause-configmap", "nua-pause", "Name of the ConfigMap that pauses the updates of all applications while it exists. Empty disables it.")
+	RootCmd.PersistentFlags().StringVar(&pauseConfigMapNamespace, "pause-configmap-namespace", "nua", "Namespace of the pause ConfigMap.")
+	RootCmd.PersistentFlags().BoolVar(&leaderElect, "leader-elect", false, "Enable leader election, so that only one of multiple replicas checks for updates.")
+	RootCmd.PersistentFlags().StringVar(&leaderElectionNamespace, "leader-election-namespace", "nua", "Namespace of the leader election Lease.")
+	RootCmd.PersistentFlags().StringVar(&leaderElectionID, "leader-election-id", "nebraska-update-agent", "Name of the leader election Lease.")
+	RootCmd.PersistentFlags().StringVar(&metricsAddr, "metrics-addr", ":8080", "Address to serve Prometheus metrics and the /healthz and /readyz probes on. Empty disables them.")
+	RootCmd.PersistentFlags().IntVar(&readinessFailureThreshold, "readiness-failure-threshold", 3, "Number of consecutive failed update checks of an application after which the agent is not ready. 0 disables the check.")
+	RootCmd.PersistentFlags().DurationVar(&reconcileDeadline, "reconcile-deadline", 30*time.Minute, "Time after which a running update check or update step is considered stuck and the agent not alive. 0 disables the check.")
 }
 
 func runController(cmd *cobra.Command, args []string) {
-	if nebraskaServer == "" {
-		log.Fatalf("--nebraska-server not provided")
-	}
-
-	if appId == "" {
-		log.Fatal("--app-id not provided")
-	}
-
 	cfg := updater.Config{
 		Kubeconfig:     kubeconfig,
-		ApplicationID:  appId,
 		Interval:       interval,
 		Dev:            dev,
 		NebraskaServer: nebraskaServer,
-		Channel:        channel,
+		WatchNamespace: watchNamespace,
+		DryRun:         dryRun,
+		PauseConfigMap: types.NamespacedName{Namespace: pauseConfigMapNamespace, Name: pauseConfigMap},
+
+		LeaderElection:          leaderElect,
+		LeaderElectionNamespace: leaderElectionNamespace,
+		LeaderElectionID:        leaderElectionID,
+
+		MetricsAddr:               metricsAddr,
+		ReadinessFailureThreshold: readinessFailureThreshold,
+		ReconcileDeadline:         reconcileDeadline,
 	}
 
 	if verbose {
@@ -3,14 +3,21 @@ module github.com/kinvolk/nebraska-update-agent
 go 1.16
 
 require (
+	github.com/blang/semver/v4 v4.0.0
+	github.com/fluxcd/helm-controller/api v0.20.1
 	github.com/fluxcd/kustomize-controller/api v0.25.0
 	github.com/fluxcd/pkg/apis/meta v0.13.0
 	github.com/fluxcd/source-controller/api v0.22.3
-	github.com/kinvolk/flux-libs v0.0.0-20220506103121-9ca81861812f
+	github.com/google/go-cmp v0.5.7
+	github.com/kinvolk/go-omaha v0.0.2-0.20210913111157-799c84c6ec9e
 	github.com/kinvolk/nebraska/updater v0.0.0-20220324162709-c5f72decb5ad
+	github.com/prometheus/client_golang v1.11.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.2.1
 	k8s.io/api v0.23.5
 	k8s.io/apimachinery v0.23.5
+	k8s.io/client-go v0.23.5
+	sigs.k8s.io/controller-runtime v0.11.2
 	sigs.k8s.io/yaml v1.3.0
 )
@@ -0,0 +1,6 @@
+#!/bin/bash
+
+# Regenerates the deepcopy functions and the CRD manifests of the API types.
+# Requires controller-gen to be available in $PATH.
+controller-gen object:headerFile=hack/boilerplate.go.txt paths=./api/...
+controller-gen crd:crdVersions=v1 paths=./api/... output:stdout > configs/0-crd.yaml
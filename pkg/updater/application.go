@@ -0,0 +1,840 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kinvolk/nebraska/updater"
+
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+	log "github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+// application holds the update state of a single NebraskaApplication. Each
+// application has its own Omaha client and is reconciled independently of the
+// others.
+type application struct {
+	key        types.NamespacedName
+	generation int64
+	spec       v1alpha1.NebraskaApplicationSpec
+
+	// object is the NebraskaApplication the events are recorded on.
+	object *v1alpha1.NebraskaApplication
+
+	cfg            *Config
+	log            *log.Entry
+	nbsClient      updater.Updater
+	currentVersion string
+
+	// pendingVersion is the version of an update that is found but not
+	// applied yet.
+	pendingVersion string
+
+	// pendingApproval is the update waiting for approval, if any.
+	pendingApproval *v1alpha1.PendingApproval
+
+	// deferredVersion is the version of an update that is deferred until a
+	// maintenance window opens.
+	deferredVersion string
+
+	// source and release are the Flux objects generated from the update
+	// payload: a GitRepository with a Kustomization or a HelmRepository with a
+	// HelmRelease.
+	source  client.Object
+	release releaseObject
+
+	// paused is the current pause of the application, if any.
+	paused *pause
+
+	// pausedVersion is the version of the last update skipped while paused.
+	pausedVersion string
+
+	// rejectedVersion is the version of the last update skipped by the
+	// version policy.
+	rejectedVersion string
+
+	// failedVersion is the version of the last update that failed or was
+	// rolled back after its Flux objects were applied, see
+	// status.failedVersion.
+	failedVersion string
+
+	// versionMetric is the version reported in the installed version metric.
+	versionMetric string
+
+	// pauseMetric is the pause reported in the paused metric.
+	pauseMetric *pause
+
+	// progress is the progress of the last update, persisted in the status.
+	progress *v1alpha1.UpdateProgress
+
+	// running is the update being verified or rolled back, if any.
+	running *updateRun
+
+	// lastCheckTime is the last time the application checked for updates.
+	lastCheckTime *metav1.Time
+
+	// events are the Omaha events not delivered to Nebraska yet. While
+	// eventRetry is set, delivery is retried once it fires, after
+	// eventRetryDelay.
+	events          []v1alpha1.OmahaEvent
+	eventRetry      <-chan time.Time
+	eventRetryDelay time.Duration
+
+	// identity holds the fields of the spec that can't change while the
+	// application is running.
+	identity applicationIdentity
+
+	// syncedGeneration is the generation of the last spec passed to the
+	// application. It is only used by the controller.
+	syncedGeneration int64
+
+	// specs passes changed NebraskaApplications to the running application.
+	specs chan *v1alpha1.NebraskaApplication
+
+	cancel context.CancelFunc
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// applicationIdentity holds the fields of the spec that identify the
+// application in Nebraska and the cluster. The application is restarted when
+// any of them changes.
+type applicationIdentity struct {
+	appID           string
+	server          string
+	targetNamespace string
+}
+
+// applicationSpec returns the spec of the object with the defaults applied.
+func applicationSpec(cfg *Config, obj *v1alpha1.NebraskaApplication) v1alpha1.NebraskaApplicationSpec {
+	spec := *obj.Spec.DeepCopy()
+
+	if spec.Channel == "" {
+		spec.Channel = defaultChannel
+	}
+
+	if spec.Server == "" {
+		spec.Server = cfg.NebraskaServer
+	}
+
+	return spec
+}
+
+func identityOf(spec v1alpha1.NebraskaApplicationSpec) applicationIdentity {
+	return applicationIdentity{
+		appID:           spec.AppID,
+		server:          spec.Server,
+		targetNamespace: spec.TargetNamespace,
+	}
+}
+
+func newApplication(cfg *Config, obj *v1alpha1.NebraskaApplication) *application {
+	key := client.ObjectKeyFromObject(obj)
+
+	spec := applicationSpec(cfg, obj)
+
+	return &application{
+		key:              key,
+		generation:       obj.Generation,
+		spec:             spec,
+		object:           obj.DeepCopy(),
+		cfg:              cfg,
+		log:              log.WithFields(log.Fields{"app": obj.Spec.AppID, "object": key.String()}),
+		currentVersion:   defaultVersion,
+		identity:         identityOf(spec),
+		syncedGeneration: obj.Generation,
+		specs:            make(chan *v1alpha1.NebraskaApplication, 1),
+	}
+}
+
+// needsRestart returns true when the object changed the identity of the
+// application, which requires starting it anew.
+func (app *application) needsRestart(obj *v1alpha1.NebraskaApplication) bool {
+	return identityOf(applicationSpec(app.cfg, obj)) != app.identity
+}
+
+// sync passes the changed object to the running application. Only the latest
+// object is kept when the application is busy.
+func (app *application) sync(obj *v1alpha1.NebraskaApplication) {
+	app.syncedGeneration = obj.Generation
+
+	select {
+	case <-app.specs:
+	default:
+	}
+
+	app.specs <- obj.DeepCopy()
+}
+
+// updateSpec applies the changed spec between two steps. The running update,
+// and the updates waiting for approval or a maintenance window are kept.
+func (app *application) updateSpec(obj *v1alpha1.NebraskaApplication) {
+	spec := applicationSpec(app.cfg, obj)
+	channel := app.spec.Channel
+
+	app.generation = obj.Generation
+	app.spec = spec
+	app.object = obj
+
+	app.log.Infof("applying generation %d of the spec", obj.Generation)
+
+	// The channel is fixed in the Nebraska client, so it is replaced.
+	if app.nbsClient != nil && spec.Channel != channel {
+		if err := app.setupNebraskaClient(); err != nil {
+			app.log.Errorf("switching to channel %s: %v", spec.Channel, err)
+		}
+	}
+}
+
+// interval returns how often the application checks for updates.
+func (app *application) interval() time.Duration {
+	if app.spec.Interval != nil {
+		return app.spec.Interval.Duration
+	}
+
+	return time.Duration(app.cfg.Interval) * time.Second
+}
+
+// start runs the application in the background until stop is called.
+func (app *application) start(ctx context.Context) {
+	ctx, app.cancel = context.WithCancel(ctx)
+	app.quit = make(chan struct{})
+	app.done = make(chan struct{})
+
+	go func() {
+		defer close(app.done)
+
+		app.run(ctx)
+	}()
+}
+
+// stop stops the application and waits for it to finish.
+func (app *application) stop() {
+	if app.cancel == nil {
+		return
+	}
+
+	app.cancel()
+	<-app.done
+}
+
+// finish stops the application once the current step is done, so that an
+// update is never interrupted while fetching or applying it.
+func (app *application) finish() {
+	if app.quit == nil {
+		return
+	}
+
+	close(app.quit)
+	<-app.done
+}
+
+// run checks for updates every interval until the context is cancelled. While
+// an update is running, it is verified again whenever a watched object changes,
+// so checking in with Nebraska is never blocked by an update.
+func (app *application) run(ctx context.Context) {
+	ticker := time.NewTicker(app.interval())
+	defer ticker.Stop()
+
+	app.step(ctx, true)
+
+	for {
+		var (
+			changed  <-chan struct{}
+			recheck  <-chan time.Time
+			deadline *time.Timer
+			expired  <-chan time.Time
+		)
+
+		if run := app.running; run != nil {
+			changed, recheck = run.changed, run.recheck
+			deadline = time.NewTimer(time.Until(run.deadline))
+			expired = deadline.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-app.quit:
+			return
+		case <-ticker.C:
+			app.step(ctx, true)
+		case <-changed:
+			app.step(ctx, false)
+		case <-recheck:
+			app.step(ctx, false)
+		case <-expired:
+			app.step(ctx, false)
+		case <-app.eventRetry:
+			app.retryEvents(ctx)
+		case obj := <-app.specs:
+			app.updateSpec(obj)
+			ticker.Reset(app.interval())
+			app.step(ctx, true)
+		}
+
+		if deadline != nil {
+			deadline.Stop()
+		}
+	}
+}
+
+// step checks for updates, or verifies the running update, and records the
+// outcome in the status.
+func (app *application) step(ctx context.Context, check bool) {
+	app.log.Debug("reconciling")
+
+	progress := app.progress
+
+	app.cfg.health.reconcileStarted(app.key)
+
+	var reconcileErr error
+	if check {
+		reconcileErr = app.reconcile(ctx)
+	} else {
+		reconcileErr = app.verify(ctx)
+	}
+
+	if reconcileErr != nil {
+		app.log.Error(reconcileErr)
+	}
+
+	app.cfg.health.reconcileFinished(app.key, app.nbsClient != nil, reconcileErr)
+
+	// Verification is triggered by every change of a watched object, so the
+	// status is only updated when the update progressed.
+	if !check && reconcileErr == nil && app.progress == progress {
+		return
+	}
+
+	if check {
+		now := metav1.Now()
+		app.lastCheckTime = &now
+	}
+
+	if err := app.updateStatus(ctx, reconcileErr); err != nil {
+		app.log.Errorf("updating status: %v", err)
+	}
+}
+
+// updateStatus records the outcome of the last reconciliation in the
+// NebraskaApplication status.
+func (app *application) updateStatus(ctx context.Context, reconcileErr error) error {
+	var obj v1alpha1.NebraskaApplication
+	if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+		return fmt.Errorf("getting NebraskaApplication: %w", err)
+	}
+
+	patch := client.MergeFrom(obj.DeepCopy())
+
+	obj.Status.ObservedGeneration = app.generation
+	obj.Status.LastCheckTime = app.lastCheckTime
+	obj.Status.LastError = ""
+	obj.Status.PendingVersion = app.pendingVersion
+	obj.Status.PendingApproval = app.pendingApproval
+	obj.Status.Update = app.progress
+	obj.Status.PendingEvents = app.events
+
+	condition := metav1.Condition{
+		Type:               v1alpha1.ReadyCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: app.generation,
+		Reason:             v1alpha1.ReconciliationSucceededReason,
+		Message:            fmt.Sprintf("Application is at version %s", app.currentVersion),
+	}
+
+	// The installed version is only known once the application is set up.
+	if app.nbsClient != nil {
+		obj.Status.InstalledVersion = app.currentVersion
+	}
+
+	if reconcileErr != nil {
+		obj.Status.LastError = reconcileErr.Error()
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = v1alpha1.ReconciliationFailedReason
+		condition.Message = reconcileErr.Error()
+	}
+
+	apimeta.SetStatusCondition(&obj.Status.Conditions, condition)
+
+	if err := app.cfg.client.Status().Patch(ctx, &obj, patch); err != nil {
+		return fmt.Errorf("patching NebraskaApplication status: %w", err)
+	}
+
+	return nil
+}
+
+// getUpdateConfig generates the Flux objects of the update from its manifest,
+// which is fetched unless it was already.
+func (app *application) getUpdateConfig(ctx context.Context, info *updater.UpdateInfo, m *v1alpha1.UpdateManifest) error {
+	if m == nil {
+		var err error
+
+		if m, err = app.getUpdateManifest(ctx, info); err != nil {
+			return err
+		}
+	}
+
+	app.log.Debugf("update manifest %s decoded successfully", m.Metadata.Name)
+
+	if err := app.generateConfigs(m); err != nil {
+		return withErrorCode(errorCodeManifestInvalid, fmt.Errorf("generating Flux configs: %w", err))
+	}
+
+	if err := app.checkSourceServed(); err != nil {
+		return withErrorCode(errorCodeApplyFailed, fmt.Errorf("checking source: %w", err))
+	}
+
+	if err := app.validateSourceSecret(ctx); err != nil {
+		return withErrorCode(errorCodeApplyFailed, fmt.Errorf("validating source: %w", err))
+	}
+
+	return nil
+}
+
+func (app *application) createOrUpdateNamespace(ctx context.Context) error {
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: app.source.GetNamespace(),
+		},
+	}
+
+	got, err := app.cfg.getCached(ctx, namespace)
+	if err != nil {
+		return fmt.Errorf("getting namespace %s: %w", namespace.Name, err)
+	}
+
+	// This means the namespace already exists.
+	if got != nil {
+		return nil
+	}
+
+	// Create the namespace since it does not exists. The cache may not have
+	// seen a namespace that was just created.
+	if err := app.cfg.client.Create(ctx, namespace); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating namespace %s: %w", namespace.Name, err)
+	}
+
+	return nil
+}
+
+func (app *application) updateFluxCRs(ctx context.Context) error {
+	// Check if the namespace exists, if not then create one.
+	if err := app.createOrUpdateNamespace(ctx); err != nil {
+		return withErrorCode(errorCodeNamespaceFailed, fmt.Errorf("creating/updating namespace: %w", err))
+	}
+
+	if err := app.cfg.createOrUpdate(ctx, app.source); err != nil {
+		return withErrorCode(errorCodeApplyFailed, fmt.Errorf("creating/updating %s: %w", kindOf(app.source), err))
+	}
+
+	if err := app.cfg.createOrUpdate(ctx, app.release); err != nil {
+		return withErrorCode(errorCodeApplyFailed, fmt.Errorf("creating/updating %s: %w", kindOf(app.release), err))
+	}
+
+	app.log.Info("updated all the Flux configs")
+
+	return nil
+}
+
+// checkReadiness returns whether the release and its workloads are ready, and
+// the source or workloads that are not ready yet. The release has to apply the
+// artifact of the current spec of its source first. The source may be nil when
+// it is not known, it is looked up from the release then.
+func (app *application) checkReadiness(ctx context.Context, release releaseObject, source client.Object) (bool, []string, error) {
+	kind := kindOf(release)
+	name := release.GetName()
+
+	got, err := app.cfg.getCached(ctx, release)
+	if err != nil {
+		return false, nil, fmt.Errorf("getting the %s %s: %w", kind, name, err)
+	}
+
+	if got == nil {
+		return false, nil, fmt.Errorf("%s %s not found", kind, name)
+	}
+
+	// The cache has not seen the update of the release yet.
+	if got.GetGeneration() < release.GetGeneration() {
+		return false, nil, nil
+	}
+
+	if source == nil {
+		if source, err = sourceOf(got.(releaseObject)); err != nil {
+			return false, nil, fmt.Errorf("getting the source of the %s %s: %w", kind, name, err)
+		}
+	}
+
+	gotSource, err := app.cfg.getCached(ctx, source)
+	if err != nil {
+		return false, nil, fmt.Errorf("getting the %s %s: %w", kindOf(source), source.GetName(), err)
+	}
+
+	// The source has not fetched the artifact of its current spec yet, the
+	// release still applies the previous one.
+	sourceDesc := fmt.Sprintf("%s %s", kindOf(source), client.ObjectKeyFromObject(source))
+
+	if gotSource == nil {
+		return false, []string{sourceDesc + ": not found"}, nil
+	}
+
+	revision := ""
+	if gotSource.GetGeneration() >= source.GetGeneration() {
+		revision = fetchedRevision(gotSource)
+	}
+
+	if revision == "" {
+		return false, []string{sourceDesc + ": artifact of the current spec not fetched yet"}, nil
+	}
+
+	state, cond := revisionState(got.(releaseObject), expectedRevision(got.(releaseObject), revision))
+
+	switch state {
+	case releaseProgressing:
+		return false, nil, nil
+	case releaseFailed:
+		// Stop waiting, Flux won't recover without another update.
+		return false, nil, &releaseFailedError{kind: kind, name: name, reason: cond.Reason, message: cond.Message}
+	}
+
+	k, ok := got.(*kustomizeapi.Kustomization)
+	if !ok {
+		// The HelmRelease is ready.
+		return true, nil, nil
+	}
+
+	unhealthy, err := app.cfg.unhealthyWorkloads(ctx, k)
+	if err != nil {
+		return false, nil, fmt.Errorf("checking the workloads of the %s %s: %w", kind, name, err)
+	}
+
+	return len(unhealthy) == 0, unhealthy, nil
+}
+
+// readinessTimeout returns how long to wait for the release to become ready:
+// the timeout of the application, else the timeout of the Kustomization, else
+// the default. The release may be nil when it is not known yet.
+func (app *application) readinessTimeout(release releaseObject) time.Duration {
+	if app.spec.ReadinessTimeout != nil {
+		return app.spec.ReadinessTimeout.Duration
+	}
+
+	if k, ok := release.(*kustomizeapi.Kustomization); ok && k.Spec.Timeout != nil {
+		return k.Spec.Timeout.Duration
+	}
+
+	return defaultReadinessTimeout
+}
+
+func (app *application) setupNebraskaClient() error {
+	var err error
+
+	if app.spec.Server == "" {
+		return fmt.Errorf("no Nebraska server configured, set spec.server or --nebraska-server")
+	}
+
+	nbsConfig := updater.Config{
+		OmahaURL:        app.spec.Server,
+		AppID:           app.spec.AppID,
+		Channel:         app.spec.Channel,
+		InstanceID:      app.cfg.clusterID,
+		InstanceVersion: removeVFromVersion(app.currentVersion),
+		// Debug:           true,
+	}
+
+	app.nbsClient, err = updater.New(nbsConfig)
+	if err != nil {
+		return fmt.Errorf("initializing nebraska client: %w", err)
+	}
+
+	return nil
+}
+
+// setup discovers the installed version of the application and creates its
+// Nebraska client.
+func (app *application) setup(ctx context.Context) error {
+	var obj v1alpha1.NebraskaApplication
+	if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+		return fmt.Errorf("getting NebraskaApplication: %w", err)
+	}
+
+	version, err := app.discoverInstalledVersion(ctx, obj.Status.Update)
+	if err != nil {
+		return fmt.Errorf("discovering installed version: %w", err)
+	}
+
+	app.currentVersion = version
+
+	if err := app.setupNebraskaClient(); err != nil {
+		return fmt.Errorf("setting up nebraska client: %w", err)
+	}
+
+	app.setVersionMetric(app.currentVersion)
+
+	app.log.Infof("installed version is %s", app.currentVersion)
+
+	app.failedVersion = obj.Status.FailedVersion
+
+	// Deliver the events that were not delivered before the restart first.
+	app.events = obj.Status.PendingEvents
+	app.setPendingEventsMetric()
+
+	if len(app.events) > 0 {
+		app.log.Infof("delivering %d Omaha events from before the restart", len(app.events))
+
+		app.retryEvents(ctx)
+	}
+
+	if err := app.resume(ctx, obj.Status.Update); err != nil {
+		return fmt.Errorf("resuming update: %w", err)
+	}
+
+	return nil
+}
+
+func (app *application) reconcile(ctx context.Context) error {
+	checkStart := time.Now()
+
+	if app.nbsClient == nil {
+		if err := app.setup(ctx); err != nil {
+			app.observeCheck(checkResultError, checkStart)
+
+			return err
+		}
+	}
+
+	// Let us check if there is an update.
+	info, err := app.nbsClient.CheckForUpdates(ctx)
+	if err != nil {
+		app.observeCheck(checkResultError, checkStart)
+
+		return fmt.Errorf("checking for updates: %w", err)
+	}
+
+	// Paused applications keep checking in with Nebraska, so the pause is
+	// tracked on every check.
+	p, pauseErr := app.getPause(ctx)
+	app.updatePause(p)
+
+	// Keep checking in while an update is running, but only start the next
+	// one once it finished.
+	if app.running != nil {
+		if info.HasUpdate {
+			app.observeCheck(checkResultUpdate, checkStart)
+		} else {
+			app.observeCheck(checkResultNoUpdate, checkStart)
+		}
+
+		app.log.Infof("update to %s is %s", app.running.version, strings.ToLower(string(app.progress.Phase)))
+
+		return app.verify(ctx)
+	}
+
+	// There is no update hence return.
+	if !info.HasUpdate {
+		app.observeCheck(checkResultNoUpdate, checkStart)
+
+		app.pendingVersion = ""
+		app.pendingApproval = nil
+		app.deferredVersion = ""
+		app.pausedVersion = ""
+		app.rejectedVersion = ""
+
+		if err := app.setFailedVersion(ctx, ""); err != nil {
+			return err
+		}
+
+		app.log.Info("no update available")
+
+		// Print the response just in case.
+		app.log.Debugf("got this response: %#v", info.OmahaResponse().Apps[0])
+
+		return nil
+	}
+
+	app.observeCheck(checkResultUpdate, checkStart)
+
+	// There is a new update.
+	version := info.Version
+
+	app.log.Debugf("update available: %s", version)
+
+	skip, err := app.skipFailedVersion(ctx, version)
+	if err != nil {
+		return err
+	}
+
+	if skip {
+		return nil
+	}
+
+	if err := app.checkVersionPolicy(version); err != nil {
+		return app.rejectUpdate(ctx, version, err)
+	}
+
+	if app.dryRun() {
+		return app.planUpdate(ctx, info)
+	}
+
+	if p != nil {
+		return app.skipPausedUpdate(version, p, pauseErr)
+	}
+
+	if app.spec.RequireApproval {
+		approved, err := app.isApproved(ctx, version)
+		if err != nil {
+			return fmt.Errorf("checking approval: %w", err)
+		}
+
+		if !approved {
+			return app.requestApproval(ctx, info)
+		}
+
+		app.pendingApproval = nil
+	}
+
+	now := time.Now()
+
+	// The manifest fetched to fit the update into the maintenance window is
+	// used to start it.
+	release, m := app.windowRelease(ctx, info, now)
+
+	win, err := app.updateWindow(now, release)
+	if err != nil {
+		return fmt.Errorf("checking maintenance windows: %w", err)
+	}
+
+	if win == nil {
+		return app.deferUpdate(version)
+	}
+
+	app.pendingVersion = ""
+	app.deferredVersion = ""
+	app.pausedVersion = ""
+
+	return app.startUpdate(ctx, info, m, win)
+}
+
+// generateConfigs converts the update manifest into the Flux source and the
+// Kustomization or HelmRelease that deploys it.
+func (app *application) generateConfigs(m *v1alpha1.UpdateManifest) error {
+	name := m.Metadata.Name
+
+	// The namespace set in the NebraskaApplication takes precedence over the
+	// one given in the update.
+	namespace := app.spec.TargetNamespace
+	if namespace == "" {
+		namespace = m.Metadata.Namespace
+	}
+
+	if namespace == "" {
+		return fmt.Errorf("no namespace given, set metadata.namespace in the update or spec.targetNamespace")
+	}
+
+	source, err := app.generateSource(&m.Spec.Source, name, namespace)
+	if err != nil {
+		return fmt.Errorf("generating source: %w", err)
+	}
+
+	objectMeta := metav1.ObjectMeta{
+		Name:      name,
+		Namespace: namespace,
+		Labels:    app.managedLabels(),
+		// The version is only bumped once the Kustomization or HelmRelease is
+		// ready.
+		Annotations: map[string]string{
+			versionAnnotation: app.currentVersion,
+		},
+	}
+
+	if m.Spec.HelmRelease != nil {
+		/*
+		   apiVersion: helm.toolkit.fluxcd.io/v2beta1
+		   kind: HelmRelease
+		   metadata:
+		     name: my-app
+		     namespace: default
+		   spec:
+		     interval: 15m
+		     chart:
+		       spec:
+		         chart: my-app
+		         version: 1.2.3
+		         sourceRef:
+		           kind: HelmRepository
+		           name: my-app
+		     values:
+		       replicaCount: 2
+		*/
+		release := &helmapi.HelmRelease{
+			ObjectMeta: objectMeta,
+			Spec:       *m.Spec.HelmRelease.DeepCopy(),
+		}
+
+		sourceRef := &release.Spec.Chart.Spec.SourceRef
+		if sourceRef.Kind != "" && sourceRef.Kind != sourceapi.HelmRepositoryKind {
+			return fmt.Errorf("unsupported chart source kind %q, expected %s", sourceRef.Kind, sourceapi.HelmRepositoryKind)
+		}
+
+		// The HelmRepository is created next to the HelmRelease, so a namespace
+		// given in the update would point to another one.
+		*sourceRef = helmapi.CrossNamespaceObjectReference{
+			Kind: sourceapi.HelmRepositoryKind,
+			Name: name,
+		}
+
+		app.source = source
+		app.release = release
+
+		return nil
+	}
+
+	/*
+	   apiVersion: kustomize.toolkit.fluxcd.io/v1beta2
+	   kind: Kustomization
+	   metadata:
+	     name: my-app
+	     namespace: default
+	   spec:
+	     interval: 15m
+	     path: "./k8s"
+	     prune: true
+	     sourceRef:
+	       kind: GitRepository
+	       name: my-app
+	*/
+	kustomization := &kustomizeapi.Kustomization{
+		ObjectMeta: objectMeta,
+		Spec:       *m.Spec.Kustomization.DeepCopy(),
+	}
+
+	// The Kustomization applies whichever source the update manifest points
+	// to.
+	sourceKind := kindOf(source)
+	kustomization.Spec.SourceRef = kustomizeapi.CrossNamespaceSourceReference{
+		Kind: sourceKind,
+		Name: name,
+	}
+
+	if sourceKind == ociRepositoryKind {
+		kustomization.Spec.SourceRef.APIVersion = ociRepositoryGroupVersion.String()
+	}
+
+	app.source = source
+	app.release = kustomization
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kinvolk/nebraska/updater"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+// approvedVersionAnnotation is set on a NebraskaApplication by an operator to
+// approve the update to a version.
+var approvedVersionAnnotation = v1alpha1.GroupVersion.Group + "/approved-version"
+
+// isApproved returns true when the update to the given version is approved.
+// Approvals of other versions, e.g. of updates that were superseded since, are
+// ignored.
+func (app *application) isApproved(ctx context.Context, version string) (bool, error) {
+	var obj v1alpha1.NebraskaApplication
+	if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+		return false, fmt.Errorf("getting NebraskaApplication: %w", err)
+	}
+
+	approved, ok := obj.Annotations[approvedVersionAnnotation]
+	if !ok {
+		return false, nil
+	}
+
+	return removeVFromVersion(approved) == removeVFromVersion(version), nil
+}
+
+// requestApproval records the update as pending approval, together with a
+// summary of the changes it makes.
+func (app *application) requestApproval(ctx context.Context, info *updater.UpdateInfo) error {
+	version := info.Version
+
+	if app.pendingApproval != nil && app.pendingApproval.Version == version {
+		return nil
+	}
+
+	if err := app.getUpdateConfig(ctx, info, nil); err != nil {
+		return fmt.Errorf("getting the update config provided in Nebraska update: %w", err)
+	}
+
+	diffs, err := app.diffFluxCRs(ctx)
+	if err != nil {
+		return fmt.Errorf("comparing flux CRs: %w", err)
+	}
+
+	app.pendingVersion = version
+	app.pendingApproval = &v1alpha1.PendingApproval{
+		Version: version,
+		Summary: summarizeDiffs(diffs),
+		Since:   metav1.Now(),
+	}
+
+	app.log.Infof("update to %s is waiting for approval, it would change the Flux objects:\n%s", version, formatDiffs(diffs))
+
+	app.recordEvent(corev1.EventTypeNormal, eventReasonApprovalRequired, version,
+		"approve with the annotation %s=%s: %s", approvedVersionAnnotation, version, app.pendingApproval.Summary)
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package updater
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+// approve sets the approved version annotation of the NebraskaApplication.
+func approve(t *testing.T, app *application, version string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	var obj v1alpha1.NebraskaApplication
+	if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := client.MergeFrom(obj.DeepCopy())
+
+	obj.Annotations = map[string]string{approvedVersionAnnotation: version}
+
+	if err := app.cfg.client.Patch(ctx, &obj, patch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApproval(t *testing.T) {
+	ctx := context.Background()
+
+	server := &fakeOmaha{version: "2.0.0", url: testLegacyURL}
+
+	app := newTestApplication(t, server)
+	app.spec.RequireApproval = true
+	withFluxCluster(app)
+
+	events := app.cfg.recorder.(*record.FakeRecorder).Events
+
+	check := func(wantPending string) {
+		t.Helper()
+
+		if err := app.reconcile(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if wantPending == "" {
+			if app.pendingApproval != nil {
+				t.Errorf("got pending approval %+v, want none", app.pendingApproval)
+			}
+
+			return
+		}
+
+		if p := app.pendingApproval; p == nil || p.Version != wantPending || p.Since.IsZero() {
+			t.Fatalf("got pending approval %+v, want %s", p, wantPending)
+		}
+
+		if app.progress != nil {
+			t.Errorf("got update %+v before the approval", app.progress)
+		}
+
+		if repositories, kustomizations := fluxObjects(t, app); len(repositories) != 0 || len(kustomizations) != 0 {
+			t.Errorf("got %d GitRepositories and %d Kustomizations before the approval", len(repositories), len(kustomizations))
+		}
+	}
+
+	// The update waits for an approval, which is requested once.
+	check("2.0.0")
+	check("2.0.0")
+
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+
+	event := <-events
+	for _, want := range []string{eventReasonApprovalRequired, approvedVersionAnnotation + "=2.0.0", "create GitRepository my-app/my-app, create Kustomization my-app/my-app"} {
+		if !strings.Contains(event, want) {
+			t.Errorf("got event %q, want %q in it", event, want)
+		}
+	}
+
+	if app.pendingApproval.Summary != "create GitRepository my-app/my-app, create Kustomization my-app/my-app" {
+		t.Errorf("got summary %q", app.pendingApproval.Summary)
+	}
+
+	// A newer version supersedes the pending approval, so approving the
+	// previous one does not apply either.
+	approve(t, app, "2.0.0")
+
+	server.mu.Lock()
+	server.version = "2.1.0"
+	server.mu.Unlock()
+
+	check("2.1.0")
+
+	if event := <-events; !strings.Contains(event, approvedVersionAnnotation+"=2.1.0") {
+		t.Errorf("got event %q, want the approval of 2.1.0 requested", event)
+	}
+
+	// Once the version is approved, the update is applied.
+	approve(t, app, "v2.1.0")
+	check("")
+
+	if app.progress == nil || app.progress.Phase != v1alpha1.UpdatePhaseVerifying || app.progress.Version != "2.1.0" {
+		t.Fatalf("got update %+v, want 2.1.0 verifying", app.progress)
+	}
+
+	if repositories, kustomizations := fluxObjects(t, app); len(repositories) != 1 || len(kustomizations) != 1 {
+		t.Errorf("got %d GitRepositories and %d Kustomizations, want the update applied", len(repositories), len(kustomizations))
+	}
+}
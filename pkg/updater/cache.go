@@ -0,0 +1,235 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+	log "github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// cacheSyncTimeout is how long to wait for the informers to list the cached
+// objects on startup.
+const cacheSyncTimeout = 2 * time.Minute
+
+// cachedObjects are the kinds watched by the shared informers. They are read
+// from the cache, all other objects are read from the API server. Kinds whose
+// CRD is not installed, e.g. HelmRelease without the helm-controller, are not
+// watched.
+var cachedObjects = []client.Object{
+	&kustomizeapi.Kustomization{},
+	&helmapi.HelmRelease{},
+	&sourceapi.GitRepository{},
+	&sourceapi.HelmRepository{},
+	&sourceapi.Bucket{},
+	&corev1.Namespace{},
+}
+
+// objectRef identifies an object of any kind.
+type objectRef struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+func refOf(obj client.Object) objectRef {
+	return objectRef{kind: kindOf(obj), namespace: obj.GetNamespace(), name: obj.GetName()}
+}
+
+// subscription is the wait of an application for a change of its objects.
+type subscription struct {
+	refs    []objectRef
+	changed chan struct{}
+}
+
+// changeNotifier wakes up the applications waiting for a change of one of
+// their objects.
+type changeNotifier struct {
+	mu   sync.Mutex
+	subs map[types.NamespacedName]*subscription
+}
+
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{subs: map[types.NamespacedName]*subscription{}}
+}
+
+// next returns a channel that is closed on the next change of one of the
+// objects, replacing the previous subscription of the application. Waiters
+// get the channel before reading the cache, so that no change is missed.
+func (n *changeNotifier) next(app types.NamespacedName, objs ...client.Object) <-chan struct{} {
+	sub := &subscription{changed: make(chan struct{})}
+
+	for _, obj := range objs {
+		if obj != nil {
+			sub.refs = append(sub.refs, refOf(obj))
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.subs[app] = sub
+
+	return sub.changed
+}
+
+// cancel drops the subscription of the application.
+func (n *changeNotifier) cancel(app types.NamespacedName) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.subs, app)
+}
+
+// notify wakes up the applications waiting for a change of the object.
+func (n *changeNotifier) notify(ref objectRef) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for app, sub := range n.subs {
+		for _, r := range sub.refs {
+			if r == ref {
+				close(sub.changed)
+				delete(n.subs, app)
+
+				break
+			}
+		}
+	}
+}
+
+// notifyHandler notifies the changes of the objects of an informer.
+func (n *changeNotifier) notifyHandler() toolscache.ResourceEventHandler {
+	notify := func(obj interface{}) {
+		if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+
+		if o, ok := obj.(client.Object); ok {
+			n.notify(refOf(o))
+		}
+	}
+
+	return toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, obj interface{}) { notify(obj) },
+		DeleteFunc: notify,
+	}
+}
+
+// startCache starts the shared informers of the cached objects and waits for
+// them to sync.
+func (cfg *Config) startCache(ctx context.Context, restConfig *rest.Config) error {
+	var err error
+
+	cfg.cache, err = cache.New(restConfig, cache.Options{Scheme: scheme})
+	if err != nil {
+		return fmt.Errorf("creating cache: %w", err)
+	}
+
+	cfg.changes = newChangeNotifier()
+	cfg.cachedKinds = sets.NewString()
+
+	for _, obj := range cachedObjects {
+		kind := kindOf(obj)
+
+		served, err := cfg.isServed(obj)
+		if err != nil {
+			return err
+		}
+
+		if !served {
+			log.Infof("%s is not served by the API server, not watching it", kind)
+
+			continue
+		}
+
+		informer, err := cfg.cache.GetInformer(ctx, obj)
+		if err != nil {
+			return fmt.Errorf("getting %s informer: %w", kind, err)
+		}
+
+		informer.AddEventHandler(cfg.changes.notifyHandler())
+
+		cfg.cachedKinds.Insert(kind)
+	}
+
+	go func() {
+		if err := cfg.cache.Start(ctx); err != nil {
+			log.Errorf("running cache: %v", err)
+		}
+	}()
+
+	syncCtx, cancel := context.WithTimeout(ctx, cacheSyncTimeout)
+	defer cancel()
+
+	if !cfg.cache.WaitForCacheSync(syncCtx) {
+		return fmt.Errorf("timed out waiting for the cache to sync")
+	}
+
+	return nil
+}
+
+// isServed returns false when the API server does not serve the kind of obj,
+// e.g. because its CRD is not installed.
+func (cfg *Config) isServed(obj client.Object) (bool, error) {
+	gvk, err := apiutil.GVKForObject(obj, scheme)
+	if err != nil {
+		return false, fmt.Errorf("getting kind of %T: %w", obj, err)
+	}
+
+	if _, err := cfg.client.RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+		if apimeta.IsNoMatchError(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("looking up %s: %w", gvk, err)
+	}
+
+	return true, nil
+}
+
+// isCached returns true when objects of the kind of obj are read from the cache.
+func (cfg *Config) isCached(obj client.Object) bool {
+	return cfg.cachedKinds.Has(kindOf(obj))
+}
+
+// getCached returns the object as last seen by the informers, or nil when it
+// does not exist. Objects that are not cached are read from the API server.
+// The cache may lag behind recent writes, which have to be read with
+// getCurrent instead.
+func (cfg *Config) getCached(ctx context.Context, obj client.Object) (client.Object, error) {
+	if !cfg.isCached(obj) {
+		return cfg.getCurrent(ctx, obj)
+	}
+
+	got, ok := obj.DeepCopyObject().(client.Object)
+	if !ok {
+		return nil, fmt.Errorf("copying %s", kindOf(obj))
+	}
+
+	if err := cfg.cache.Get(ctx, client.ObjectKeyFromObject(obj), got); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("getting %s %s: %w", kindOf(obj), obj.GetName(), err)
+	}
+
+	return got, nil
+}
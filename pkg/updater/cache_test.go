@@ -0,0 +1,107 @@
+package updater
+
+import (
+	"testing"
+
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestChangeNotifier(t *testing.T) {
+	app := types.NamespacedName{Namespace: "nua", Name: "app"}
+	other := types.NamespacedName{Namespace: "nua", Name: "other"}
+
+	objectMeta := metav1.ObjectMeta{Namespace: "my-app", Name: "my-app"}
+	release := &kustomizeapi.Kustomization{ObjectMeta: objectMeta}
+	source := &sourceapi.GitRepository{ObjectMeta: objectMeta}
+
+	n := newChangeNotifier()
+
+	changed := n.next(app, release, source)
+	otherChanged := n.next(other, &kustomizeapi.Kustomization{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "other"}})
+
+	// Same name, but another kind.
+	n.notify(refOf(&sourceapi.Bucket{ObjectMeta: objectMeta}))
+
+	if isClosed(changed) || isClosed(otherChanged) {
+		t.Fatal("notified of a change of another object")
+	}
+
+	n.notify(refOf(source))
+
+	if !isClosed(changed) {
+		t.Fatal("not notified of a change of the source")
+	}
+
+	if isClosed(otherChanged) {
+		t.Fatal("another application was notified")
+	}
+
+	// The subscription ended with the notification.
+	n.notify(refOf(release))
+
+	changed = n.next(app, release, nil)
+	replaced := n.next(app, release)
+
+	n.notify(refOf(release))
+
+	if isClosed(changed) {
+		t.Error("replaced subscription was notified")
+	}
+
+	if !isClosed(replaced) {
+		t.Error("not notified of a change of the release")
+	}
+
+	changed = n.next(app, release)
+	n.cancel(app)
+	n.notify(refOf(release))
+
+	if isClosed(changed) {
+		t.Error("cancelled subscription was notified")
+	}
+}
+
+func TestIsServed(t *testing.T) {
+	// A cluster with the kustomize-controller, but no helm-controller.
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(kustomizeapi.GroupVersion.WithKind(kustomizeapi.KustomizationKind), apimeta.RESTScopeNamespace)
+
+	cfg := &Config{client: fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(mapper).Build()}
+
+	for _, tc := range []struct {
+		obj  client.Object
+		want bool
+	}{
+		{obj: &kustomizeapi.Kustomization{}, want: true},
+		{obj: &helmapi.HelmRelease{}, want: false},
+		{obj: (&application{}).generateOCIRepository(&v1alpha1.OCISource{URL: "oci://ghcr.io/example/my-app"}, "my-app", "my-app"), want: false},
+	} {
+		served, err := cfg.isServed(tc.obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if served != tc.want {
+			t.Errorf("%s served: got %t, want %t", kindOf(tc.obj), served, tc.want)
+		}
+	}
+}
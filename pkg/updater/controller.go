@@ -0,0 +1,146 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+// rewatchInterval is the time to wait before listing and watching the
+// NebraskaApplications again after the watch ended.
+const rewatchInterval = 5 * time.Second
+
+// watchApplications keeps the running applications in sync with the
+// NebraskaApplication objects in the cluster until the context is cancelled.
+func (cfg *Config) watchApplications(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := cfg.listAndWatchApplications(ctx); err != nil {
+			log.Errorf("watching NebraskaApplications: %v", err)
+		}
+	}, rewatchInterval)
+
+	for key := range cfg.apps {
+		cfg.removeApplication(key)
+	}
+}
+
+func (cfg *Config) listAndWatchApplications(ctx context.Context) error {
+	var list v1alpha1.NebraskaApplicationList
+	if err := cfg.client.List(ctx, &list, client.InNamespace(cfg.WatchNamespace)); err != nil {
+		return fmt.Errorf("listing NebraskaApplications: %w", err)
+	}
+
+	// Stop the applications that were deleted while we were not watching.
+	seen := map[types.NamespacedName]bool{}
+
+	for i := range list.Items {
+		obj := &list.Items[i]
+		seen[client.ObjectKeyFromObject(obj)] = true
+
+		cfg.syncApplication(ctx, obj)
+	}
+
+	for key := range cfg.apps {
+		if !seen[key] {
+			cfg.removeApplication(key)
+		}
+	}
+
+	w, err := cfg.client.Watch(ctx, &v1alpha1.NebraskaApplicationList{}, &client.ListOptions{
+		Namespace: cfg.WatchNamespace,
+		Raw:       &metav1.ListOptions{ResourceVersion: list.ResourceVersion},
+	})
+	if err != nil {
+		return fmt.Errorf("watching NebraskaApplications: %w", err)
+	}
+
+	defer w.Stop()
+
+	for event := range w.ResultChan() {
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			obj, ok := event.Object.(*v1alpha1.NebraskaApplication)
+			if !ok {
+				continue
+			}
+
+			cfg.syncApplication(ctx, obj)
+		case watch.Deleted:
+			obj, ok := event.Object.(*v1alpha1.NebraskaApplication)
+			if !ok {
+				continue
+			}
+
+			cfg.removeApplication(client.ObjectKeyFromObject(obj))
+		case watch.Error:
+			return fmt.Errorf("watch failed: %w", apierrors.FromObject(event.Object))
+		case watch.Bookmark:
+		}
+	}
+
+	log.Debug("NebraskaApplication watch ended")
+
+	return nil
+}
+
+// syncApplication starts the application for the given object. Changes of the
+// spec are passed to the running application, it is only restarted when its
+// identity changed.
+func (cfg *Config) syncApplication(ctx context.Context, obj *v1alpha1.NebraskaApplication) {
+	key := client.ObjectKeyFromObject(obj)
+
+	current, ok := cfg.apps[key]
+	if ok && current.syncedGeneration == obj.Generation {
+		return
+	}
+
+	if ok && !current.needsRestart(obj) {
+		current.sync(obj)
+
+		log.Infof("updated NebraskaApplication %s", key)
+
+		return
+	}
+
+	if ok {
+		log.Infof("app ID, server or target namespace of NebraskaApplication %s changed, restarting it", key)
+
+		current.finish()
+		cfg.removeApplication(key)
+	}
+
+	app := newApplication(cfg, obj)
+	app.start(ctx)
+
+	cfg.apps[key] = app
+
+	log.Infof("started NebraskaApplication %s", key)
+}
+
+// removeApplication stops the application and waits for it to finish.
+func (cfg *Config) removeApplication(key types.NamespacedName) {
+	app, ok := cfg.apps[key]
+	if !ok {
+		return
+	}
+
+	app.stop()
+	app.deleteMetrics()
+	cfg.changes.cancel(key)
+	cfg.health.remove(key)
+
+	delete(cfg.apps, key)
+
+	log.Infof("stopped NebraskaApplication %s", key)
+}
@@ -0,0 +1,91 @@
+package updater
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+func TestNeedsRestart(t *testing.T) {
+	cfg := &Config{NebraskaServer: "https://nebraska.example.com/v1/update"}
+
+	obj := &v1alpha1.NebraskaApplication{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nua", Name: "my-app", Generation: 1},
+		Spec:       v1alpha1.NebraskaApplicationSpec{AppID: "my-app-id"},
+	}
+
+	app := newApplication(cfg, obj)
+
+	for _, tc := range []struct {
+		name   string
+		change func(spec *v1alpha1.NebraskaApplicationSpec)
+		want   bool
+	}{
+		{name: "app ID", change: func(spec *v1alpha1.NebraskaApplicationSpec) { spec.AppID = "other-id" }, want: true},
+		{name: "server", change: func(spec *v1alpha1.NebraskaApplicationSpec) { spec.Server = "https://other.example.com" }, want: true},
+		{name: "target namespace", change: func(spec *v1alpha1.NebraskaApplicationSpec) { spec.TargetNamespace = "other" }, want: true},
+		{name: "default server", change: func(spec *v1alpha1.NebraskaApplicationSpec) { spec.Server = cfg.NebraskaServer }},
+		{name: "channel", change: func(spec *v1alpha1.NebraskaApplicationSpec) { spec.Channel = "beta" }},
+		{name: "paused", change: func(spec *v1alpha1.NebraskaApplicationSpec) { spec.Paused = true }},
+		{name: "approval", change: func(spec *v1alpha1.NebraskaApplicationSpec) { spec.RequireApproval = true }},
+	} {
+		changed := obj.DeepCopy()
+		changed.Generation++
+		tc.change(&changed.Spec)
+
+		if got := app.needsRestart(changed); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateSpec(t *testing.T) {
+	cfg := &Config{NebraskaServer: "https://nebraska.example.com/v1/update"}
+
+	obj := &v1alpha1.NebraskaApplication{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nua", Name: "my-app", Generation: 1},
+		Spec:       v1alpha1.NebraskaApplicationSpec{AppID: "my-app-id"},
+	}
+
+	app := newApplication(cfg, obj)
+	app.log = log.WithField("test", t.Name())
+	app.pendingApproval = &v1alpha1.PendingApproval{Version: "1.1.0"}
+	app.deferredVersion = "1.1.0"
+	app.running = &updateRun{version: "1.1.0"}
+
+	for generation := int64(2); generation <= 3; generation++ {
+		changed := obj.DeepCopy()
+		changed.Generation = generation
+		changed.Spec.Interval = &metav1.Duration{Duration: 42}
+
+		// Only the latest spec is passed when the application is busy.
+		app.sync(changed)
+	}
+
+	if app.syncedGeneration != 3 {
+		t.Errorf("synced generation: got %d, want 3", app.syncedGeneration)
+	}
+
+	app.updateSpec(<-app.specs)
+
+	if app.generation != 3 {
+		t.Errorf("generation: got %d, want 3", app.generation)
+	}
+
+	if app.interval() != 42 {
+		t.Errorf("interval: got %s, want 42ns", app.interval())
+	}
+
+	if app.spec.Server != cfg.NebraskaServer || app.spec.Channel != defaultChannel {
+		t.Errorf("defaults not applied: %+v", app.spec)
+	}
+
+	// The state of the running and waiting updates is kept.
+	if app.running == nil || app.pendingApproval == nil || app.deferredVersion == "" {
+		t.Error("update state was dropped")
+	}
+}
@@ -0,0 +1,153 @@
+package updater
+
+import (
+	"errors"
+
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+)
+
+// Agent specific error codes reported to Nebraska in error events. They are
+// kept above 1000 so they can't be confused with the codes used by the Omaha
+// clients of operating systems. The codes are documented in
+// docs/error-codes.md and must not be changed once released.
+const (
+	// errorCodeUnknown is reported for failures without a specific code.
+	errorCodeUnknown = 0
+
+	// errorCodeRolledBack is reported when the previous version was restored
+	// after a failure without a more specific code. Rolled back failures with
+	// a code are reported with errorCodeRolledBackOffset added to it.
+	errorCodeRolledBack = 1001
+
+	// errorCodeVerificationFailed is reported when the update manifest does
+	// not match the Nebraska package or is not signed by a trusted key, or the
+	// trusted keys can't be read.
+	errorCodeVerificationFailed = 1002
+
+	// errorCodeVersionPolicy is reported when the update is skipped because
+	// its version is not allowed by the version policy of the application.
+	errorCodeVersionPolicy = 1003
+
+	// The following codes up to errorCodeArtifactFailed are reported when
+	// Flux failed to reconcile the update.
+
+	// errorCodeBuildFailed is reported when the Kustomization could not be
+	// built.
+	errorCodeBuildFailed = 1004
+
+	// errorCodeHealthCheckFailed is reported when the health checks of the
+	// Kustomization failed.
+	errorCodeHealthCheckFailed = 1005
+
+	// errorCodeDependencyNotReady is reported when a dependency of the
+	// Kustomization or HelmRelease is not ready.
+	errorCodeDependencyNotReady = 1006
+
+	// errorCodeReconciliationFailed is reported for other reconciliation
+	// failures, e.g. a failed Helm install or upgrade.
+	errorCodeReconciliationFailed = 1007
+
+	// errorCodeArtifactFailed is reported when Flux stalled fetching the
+	// source of the update. Sources that are still retried time out instead.
+	errorCodeArtifactFailed = 1008
+
+	// errorCodeManifestFetchFailed is reported when the update manifest could
+	// not be downloaded.
+	errorCodeManifestFetchFailed = 1009
+
+	// errorCodeManifestInvalid is reported when the update manifest could not
+	// be decoded or is not valid.
+	errorCodeManifestInvalid = 1010
+
+	// errorCodeNamespaceFailed is reported when the namespace of the Flux
+	// objects could not be created.
+	errorCodeNamespaceFailed = 1011
+
+	// errorCodeApplyFailed is reported when the Flux objects could not be
+	// read, created or updated.
+	errorCodeApplyFailed = 1012
+
+	// errorCodeReadinessTimeout is reported when the update did not become
+	// ready before its deadline.
+	errorCodeReadinessTimeout = 1013
+
+	// errorCodeRollbackFailed is reported when the previous version could not
+	// be restored or did not become ready again.
+	errorCodeRollbackFailed = 1014
+
+	// errorCodeInterrupted is reported when the agent restarted while it was
+	// fetching or applying the update.
+	errorCodeInterrupted = 1015
+
+	// errorCodeRolledBackOffset is added to the code of a failure when the
+	// previous version was restored, e.g. 1113 for an update that did not
+	// become ready and was rolled back, so that Nebraska can tell it from a
+	// failure that was not rolled back.
+	errorCodeRolledBackOffset = 100
+)
+
+// codedError is a failure with the error code reported to Nebraska.
+type codedError struct {
+	code int
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// withErrorCode returns err with the error code reported for it.
+func withErrorCode(code int, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// errorCodeOf returns the error code reported to Nebraska for err, or
+// errorCodeUnknown.
+func errorCodeOf(err error) int {
+	var (
+		verifyErr *verificationError
+		failedErr *releaseFailedError
+		codedErr  *codedError
+	)
+
+	switch {
+	case errors.As(err, &verifyErr):
+		return errorCodeVerificationFailed
+	case errors.As(err, &failedErr):
+		return failedErr.errorCode()
+	case errors.As(err, &codedErr):
+		return codedErr.code
+	default:
+		return errorCodeUnknown
+	}
+}
+
+// rolledBackErrorCode returns the error code reported for a failure with the
+// given code after the previous version was restored.
+func rolledBackErrorCode(code int) int {
+	if code == errorCodeUnknown {
+		return errorCodeRolledBack
+	}
+
+	return code + errorCodeRolledBackOffset
+}
+
+// errorCode returns the error code of the reason of the failure.
+func (e *releaseFailedError) errorCode() int {
+	switch e.reason {
+	case kustomizeapi.BuildFailedReason:
+		return errorCodeBuildFailed
+	case kustomizeapi.HealthCheckFailedReason:
+		return errorCodeHealthCheckFailed
+	case kustomizeapi.DependencyNotReadyReason:
+		return errorCodeDependencyNotReady
+	case kustomizeapi.ArtifactFailedReason:
+		return errorCodeArtifactFailed
+	default:
+		return errorCodeReconciliationFailed
+	}
+}
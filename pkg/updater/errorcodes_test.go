@@ -0,0 +1,130 @@
+package updater
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+	"github.com/fluxcd/pkg/apis/meta"
+)
+
+func TestReleaseFailedErrorCode(t *testing.T) {
+	codes := map[string]int{
+		kustomizeapi.BuildFailedReason:          errorCodeBuildFailed,
+		kustomizeapi.HealthCheckFailedReason:    errorCodeHealthCheckFailed,
+		kustomizeapi.DependencyNotReadyReason:   errorCodeDependencyNotReady,
+		kustomizeapi.ArtifactFailedReason:       errorCodeArtifactFailed,
+		kustomizeapi.PruneFailedReason:          errorCodeReconciliationFailed,
+		kustomizeapi.ReconciliationFailedReason: errorCodeReconciliationFailed,
+		helmapi.InstallFailedReason:             errorCodeReconciliationFailed,
+		helmapi.UpgradeFailedReason:             errorCodeReconciliationFailed,
+		helmapi.TestFailedReason:                errorCodeReconciliationFailed,
+		helmapi.RollbackFailedReason:            errorCodeReconciliationFailed,
+		helmapi.UninstallFailedReason:           errorCodeReconciliationFailed,
+		helmapi.InitFailedReason:                errorCodeReconciliationFailed,
+		helmapi.GetLastReleaseFailedReason:      errorCodeReconciliationFailed,
+		// Reasons of a Stalled condition.
+		meta.ProgressingReason: errorCodeReconciliationFailed,
+		"":                     errorCodeReconciliationFailed,
+	}
+
+	for _, reason := range terminalReasons.List() {
+		if _, ok := codes[reason]; !ok {
+			t.Errorf("no error code expected for the terminal reason %s", reason)
+		}
+	}
+
+	for reason, want := range codes {
+		err := &releaseFailedError{kind: kustomizeapi.KustomizationKind, name: "my-app", reason: reason}
+
+		if got := err.errorCode(); got != want {
+			t.Errorf("%q: got %d, want %d", reason, got, want)
+		}
+	}
+}
+
+func TestErrorCodeOf(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{
+			name: "nil",
+			want: errorCodeUnknown,
+		},
+		{
+			name: "plain error",
+			err:  errors.New("connection refused"),
+			want: errorCodeUnknown,
+		},
+		{
+			name: "verification",
+			err:  fmt.Errorf("getting update manifest: %w", &verificationError{errors.New("expected SHA-256")}),
+			want: errorCodeVerificationFailed,
+		},
+		{
+			name: "failed release",
+			err: fmt.Errorf("waiting for the Kustomization to be ready: %w",
+				&releaseFailedError{kind: kustomizeapi.KustomizationKind, reason: kustomizeapi.HealthCheckFailedReason}),
+			want: errorCodeHealthCheckFailed,
+		},
+		{
+			name: "failed HelmRelease",
+			err:  &releaseFailedError{kind: helmapi.HelmReleaseKind, reason: helmapi.UpgradeFailedReason},
+			want: errorCodeReconciliationFailed,
+		},
+		{
+			name: "readiness timeout",
+			err:  fmt.Errorf("waiting for the Kustomization to be ready: %w", withErrorCode(errorCodeReadinessTimeout, errors.New("timed out"))),
+			want: errorCodeReadinessTimeout,
+		},
+		{
+			name: "nested codes",
+			err:  withErrorCode(errorCodeApplyFailed, fmt.Errorf("a: %w", withErrorCode(errorCodeNamespaceFailed, errors.New("b")))),
+			want: errorCodeApplyFailed,
+		},
+	} {
+		if got := errorCodeOf(tc.err); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	// All the codes are passed through.
+	for _, code := range []int{
+		errorCodeRolledBack, errorCodeVerificationFailed, errorCodeVersionPolicy, errorCodeBuildFailed,
+		errorCodeHealthCheckFailed, errorCodeDependencyNotReady, errorCodeReconciliationFailed,
+		errorCodeArtifactFailed, errorCodeManifestFetchFailed, errorCodeManifestInvalid, errorCodeNamespaceFailed,
+		errorCodeApplyFailed, errorCodeReadinessTimeout, errorCodeRollbackFailed, errorCodeInterrupted,
+	} {
+		err := withErrorCode(code, errors.New("failed"))
+
+		if got := errorCodeOf(fmt.Errorf("wrapped: %w", err)); got != code {
+			t.Errorf("got %d, want %d", got, code)
+		}
+
+		if err.Error() != "failed" {
+			t.Errorf("got message %q", err.Error())
+		}
+	}
+}
+
+func TestRolledBackErrorCode(t *testing.T) {
+	for code, want := range map[int]int{
+		errorCodeUnknown:              errorCodeRolledBack,
+		errorCodeBuildFailed:          1104,
+		errorCodeHealthCheckFailed:    1105,
+		errorCodeDependencyNotReady:   1106,
+		errorCodeReconciliationFailed: 1107,
+		errorCodeArtifactFailed:       1108,
+		errorCodeNamespaceFailed:      1111,
+		errorCodeApplyFailed:          1112,
+		errorCodeReadinessTimeout:     1113,
+	} {
+		if got := rolledBackErrorCode(code); got != want {
+			t.Errorf("%d: got %d, want %d", code, got, want)
+		}
+	}
+}
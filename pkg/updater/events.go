@@ -0,0 +1,59 @@
+package updater
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+const eventSourceComponent = "nebraska-update-agent"
+
+// Reasons of the events recorded on a NebraskaApplication for the steps of an
+// update.
+const (
+	eventReasonUpdateFound        = "UpdateFound"
+	eventReasonUpdateDeferred     = "UpdateDeferred"
+	eventReasonUpdatePlanned      = "UpdatePlanned"
+	eventReasonApprovalRequired   = "ApprovalRequired"
+	eventReasonUpdatePaused       = "UpdatePaused"
+	eventReasonUpdateRejected     = "UpdateRejected"
+	eventReasonManifestFetched    = "ManifestFetched"
+	eventReasonFluxObjectsApplied = "FluxObjectsApplied"
+	eventReasonUpdateReady        = "UpdateReady"
+	eventReasonUpdateFailed       = "UpdateFailed"
+	eventReasonRolledBack         = "RolledBack"
+	eventReasonRollbackFailed     = "RollbackFailed"
+	eventReasonReleaseSuspended   = "ReleaseSuspended"
+)
+
+// Annotations of the update events holding the versions of the update.
+var (
+	fromVersionAnnotation = v1alpha1.GroupVersion.Group + "/from-version"
+	toVersionAnnotation   = v1alpha1.GroupVersion.Group + "/to-version"
+)
+
+// newEventBroadcaster returns a broadcaster that sends the recorded events to
+// the API server.
+func newEventBroadcaster(clientset kubernetes.Interface) record.EventBroadcaster {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+
+	return broadcaster
+}
+
+// recordEvent records an event of the update from the installed version to the
+// given version on the NebraskaApplication.
+func (app *application) recordEvent(eventType, reason, toVersion, messageFmt string, args ...interface{}) {
+	annotations := map[string]string{
+		fromVersionAnnotation: app.currentVersion,
+		toVersionAnnotation:   toVersion,
+	}
+
+	message := fmt.Sprintf("Update from %s to %s: %s", app.currentVersion, toVersion, fmt.Sprintf(messageFmt, args...))
+
+	app.cfg.recorder.AnnotatedEventf(app.object, annotations, eventType, reason, "%s", message)
+}
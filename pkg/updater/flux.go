@@ -0,0 +1,379 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blang/semver/v4"
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+	"github.com/fluxcd/pkg/apis/meta"
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// defaultReadinessTimeout is how long to wait for a Kustomization or
+// HelmRelease to become ready when no timeout is set.
+const defaultReadinessTimeout = 10 * time.Minute
+
+// reconcileState is the state of the reconciliation of a Kustomization or
+// HelmRelease.
+type reconcileState int
+
+const (
+	releaseProgressing reconcileState = iota
+	releaseReady
+	releaseFailed
+)
+
+// terminalReasons are the reasons of a false Ready condition that Flux does
+// not recover from without a change of the object. ArtifactFailed is not one
+// of them, Kustomizations report it until their source fetched an artifact.
+var terminalReasons = sets.NewString(
+	kustomizeapi.BuildFailedReason,
+	kustomizeapi.HealthCheckFailedReason,
+	kustomizeapi.DependencyNotReadyReason,
+	kustomizeapi.PruneFailedReason,
+	kustomizeapi.ReconciliationFailedReason,
+	helmapi.InstallFailedReason,
+	helmapi.UpgradeFailedReason,
+	helmapi.TestFailedReason,
+	helmapi.RollbackFailedReason,
+	helmapi.UninstallFailedReason,
+	helmapi.InitFailedReason,
+	helmapi.GetLastReleaseFailedReason,
+)
+
+// releaseFailedError is returned when Flux failed to reconcile a
+// Kustomization or HelmRelease.
+type releaseFailedError struct {
+	kind    string
+	name    string
+	reason  string
+	message string
+}
+
+func (e *releaseFailedError) Error() string {
+	return fmt.Sprintf("%s %s failed: %s: %s", e.kind, e.name, e.reason, e.message)
+}
+
+// releaseObject is a Flux object that deploys the contents of a source to the
+// cluster, i.e. a Kustomization or a HelmRelease.
+type releaseObject interface {
+	client.Object
+	GetConditions() []metav1.Condition
+}
+
+// kindOf returns the kind of the given object as registered in the scheme.
+func kindOf(obj client.Object) string {
+	gvk, err := apiutil.GVKForObject(obj, scheme)
+	if err != nil {
+		return fmt.Sprintf("%T", obj)
+	}
+
+	return gvk.Kind
+}
+
+// observedGeneration returns the generation last reconciled by Flux.
+func observedGeneration(obj releaseObject) int64 {
+	switch o := obj.(type) {
+	case *kustomizeapi.Kustomization:
+		return o.Status.ObservedGeneration
+	case *helmapi.HelmRelease:
+		return o.Status.ObservedGeneration
+	default:
+		return -1
+	}
+}
+
+// isReady returns true when Flux reconciled the latest generation of the
+// object and marked it as ready.
+func isReady(obj releaseObject) bool {
+	return obj.GetGeneration() == observedGeneration(obj) &&
+		apimeta.IsStatusConditionTrue(obj.GetConditions(), meta.ReadyCondition)
+}
+
+// releaseState classifies the conditions of the object as progressing, ready
+// or failed. The returned condition explains a failure.
+func releaseState(obj releaseObject) (reconcileState, *metav1.Condition) {
+	if obj.GetGeneration() != observedGeneration(obj) {
+		return releaseProgressing, nil
+	}
+
+	if stalled := apimeta.FindStatusCondition(obj.GetConditions(), meta.StalledCondition); stalled != nil && stalled.Status == metav1.ConditionTrue {
+		return releaseFailed, stalled
+	}
+
+	ready := apimeta.FindStatusCondition(obj.GetConditions(), meta.ReadyCondition)
+
+	switch {
+	case ready == nil:
+		return releaseProgressing, nil
+	case ready.Status == metav1.ConditionTrue:
+		return releaseReady, nil
+	case ready.Status == metav1.ConditionFalse && terminalReasons.Has(ready.Reason):
+		return releaseFailed, ready
+	default:
+		return releaseProgressing, nil
+	}
+}
+
+// releaseRevisions returns the source revision of the last reconciliation
+// attempt of the release and of the last successful one. For HelmReleases it
+// is the chart version.
+func releaseRevisions(obj releaseObject) (string, string) {
+	switch o := obj.(type) {
+	case *kustomizeapi.Kustomization:
+		return o.Status.LastAttemptedRevision, o.Status.LastAppliedRevision
+	case *helmapi.HelmRelease:
+		return o.Status.LastAttemptedRevision, o.Status.LastAppliedRevision
+	default:
+		return "", ""
+	}
+}
+
+// expectedRevision returns the revision the release has to apply when its
+// source has an artifact of the given revision, or an empty string when any
+// revision is accepted. HelmReleases apply the chart version, which is only
+// known when the chart version is not a range.
+func expectedRevision(obj releaseObject, sourceRevision string) string {
+	switch o := obj.(type) {
+	case *kustomizeapi.Kustomization:
+		return sourceRevision
+	case *helmapi.HelmRelease:
+		if _, err := semver.Parse(o.Spec.Chart.Spec.Version); err != nil {
+			return ""
+		}
+
+		return o.Spec.Chart.Spec.Version
+	default:
+		return ""
+	}
+}
+
+// revisionState classifies the release like releaseState, but only counts it
+// as ready once it applied the expected revision, and as failed when it failed
+// to apply it. Until then, the state is of a previous revision and the release
+// is progressing.
+func revisionState(obj releaseObject, expected string) (reconcileState, *metav1.Condition) {
+	state, cond := releaseState(obj)
+	attempted, applied := releaseRevisions(obj)
+
+	isExpected := func(revision string) bool {
+		if expected == "" {
+			return revision != ""
+		}
+
+		return revision == expected
+	}
+
+	switch {
+	case state == releaseReady && !isExpected(applied):
+		return releaseProgressing, nil
+	case state == releaseFailed && !isExpected(attempted):
+		return releaseProgressing, nil
+	default:
+		return state, cond
+	}
+}
+
+// sourceStatus returns the generation last reconciled by source-controller,
+// the revision of the artifact of the source and whether it is ready.
+func sourceStatus(obj client.Object) (int64, string, bool) {
+	var (
+		observed   int64
+		artifact   *sourceapi.Artifact
+		conditions []metav1.Condition
+	)
+
+	switch o := obj.(type) {
+	case *sourceapi.GitRepository:
+		observed, artifact, conditions = o.Status.ObservedGeneration, o.Status.Artifact, o.Status.Conditions
+	case *sourceapi.Bucket:
+		observed, artifact, conditions = o.Status.ObservedGeneration, o.Status.Artifact, o.Status.Conditions
+	case *sourceapi.HelmRepository:
+		observed, artifact, conditions = o.Status.ObservedGeneration, o.Status.Artifact, o.Status.Conditions
+	case *unstructured.Unstructured:
+		// OCIRepository.
+		observed, _, _ = unstructured.NestedInt64(o.Object, "status", "observedGeneration")
+		revision, _, _ := unstructured.NestedString(o.Object, "status", "artifact", "revision")
+
+		return observed, revision, isUnstructuredReady(o)
+	default:
+		return -1, "", false
+	}
+
+	if artifact == nil {
+		return observed, "", false
+	}
+
+	return observed, artifact.Revision, apimeta.IsStatusConditionTrue(conditions, meta.ReadyCondition)
+}
+
+// isUnstructuredReady returns true when the Ready condition of the object is
+// true.
+func isUnstructuredReady(obj *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if ok && cond["type"] == meta.ReadyCondition {
+			return cond["status"] == string(metav1.ConditionTrue)
+		}
+	}
+
+	return false
+}
+
+// fetchedRevision returns the revision of the artifact of the source once
+// source-controller fetched the artifact of the latest generation, and the
+// artifact matches the reference of the spec. Otherwise, it returns an empty
+// string.
+func fetchedRevision(obj client.Object) string {
+	observed, revision, ready := sourceStatus(obj)
+
+	if observed != obj.GetGeneration() || !ready || revision == "" || !revisionMatchesRef(obj, revision) {
+		return ""
+	}
+
+	return revision
+}
+
+// revisionMatchesRef returns whether the artifact revision is of the Git or OCI
+// reference of the source. Revisions are formatted as <ref>/<commit or
+// digest>, or <ref>@<commit or digest> by newer Flux versions. Sources without
+// a reference in the revision, e.g. Buckets, semver ranges and OCI tags of Flux
+// versions that only record the digest, always match.
+func revisionMatchesRef(obj client.Object, revision string) bool {
+	switch o := obj.(type) {
+	case *sourceapi.GitRepository:
+		ref := o.Spec.Reference
+
+		switch {
+		case ref == nil:
+			return true
+		case ref.Commit != "":
+			return strings.HasSuffix(revision, ref.Commit)
+		case ref.SemVer != "":
+			return true
+		case ref.Tag != "":
+			return hasRefPrefix(revision, ref.Tag)
+		case ref.Branch != "":
+			return hasRefPrefix(revision, ref.Branch)
+		}
+	case *unstructured.Unstructured:
+		if digest, _, _ := unstructured.NestedString(o.Object, "spec", "ref", "digest"); digest != "" {
+			return strings.HasSuffix(revision, strings.TrimPrefix(digest, "sha256:"))
+		}
+
+		if tag, _, _ := unstructured.NestedString(o.Object, "spec", "ref", "tag"); tag != "" && strings.ContainsAny(revision, "/@") {
+			return hasRefPrefix(revision, tag)
+		}
+	}
+
+	return true
+}
+
+func hasRefPrefix(revision, ref string) bool {
+	return strings.HasPrefix(revision, ref+"/") || strings.HasPrefix(revision, ref+"@")
+}
+
+// getCurrent returns the object as it currently exists in the cluster, or nil
+// when it does not exist.
+func (cfg *Config) getCurrent(ctx context.Context, obj client.Object) (client.Object, error) {
+	got, ok := obj.DeepCopyObject().(client.Object)
+	if !ok {
+		return nil, fmt.Errorf("copying %s", kindOf(obj))
+	}
+
+	if err := cfg.client.Get(ctx, client.ObjectKeyFromObject(obj), got); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("getting %s %s: %w", kindOf(obj), obj.GetName(), err)
+	}
+
+	return got, nil
+}
+
+// createOrUpdate creates the object or replaces the existing one. The labels,
+// annotations, finalizers and owner references set by others on the existing
+// object are kept.
+func (cfg *Config) createOrUpdate(ctx context.Context, obj client.Object) error {
+	got, err := cfg.getCurrent(ctx, obj)
+	if err != nil {
+		return fmt.Errorf("looking up %s: %w", kindOf(obj), err)
+	}
+
+	if got == nil {
+		// Create the object since it does not exists.
+		if err := cfg.client.Create(ctx, obj); err != nil {
+			return fmt.Errorf("creating %s: %w", kindOf(obj), err)
+		}
+
+		return nil
+	}
+
+	obj.SetResourceVersion(got.GetResourceVersion())
+	mergeMetadata(obj, got)
+
+	if err := cfg.client.Update(ctx, obj); err != nil {
+		return fmt.Errorf("updating %s: %w", kindOf(obj), err)
+	}
+
+	return nil
+}
+
+// mergeMetadata adds the metadata of the existing object that obj does not
+// set itself.
+func mergeMetadata(obj, existing client.Object) {
+	obj.SetLabels(mergeMaps(existing.GetLabels(), obj.GetLabels()))
+	obj.SetAnnotations(mergeMaps(existing.GetAnnotations(), obj.GetAnnotations()))
+
+	if len(obj.GetFinalizers()) == 0 {
+		obj.SetFinalizers(existing.GetFinalizers())
+	}
+
+	if len(obj.GetOwnerReferences()) == 0 {
+		obj.SetOwnerReferences(existing.GetOwnerReferences())
+	}
+}
+
+// mergeMaps returns the entries of both maps, with the ones of override taking
+// precedence.
+func mergeMaps(base, override map[string]string) map[string]string {
+	if len(base) == 0 {
+		return override
+	}
+
+	merged := make(map[string]string, len(base)+len(override))
+
+	for k, v := range base {
+		merged[k] = v
+	}
+
+	for k, v := range override {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// delete deletes the object, ignoring objects that do not exist.
+func (cfg *Config) delete(ctx context.Context, obj client.Object) error {
+	if err := cfg.client.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("deleting %s: %w", kindOf(obj), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,440 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+	"github.com/fluxcd/pkg/apis/meta"
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func condition(condType string, status metav1.ConditionStatus, reason string) metav1.Condition {
+	return metav1.Condition{Type: condType, Status: status, Reason: reason, Message: reason + " message"}
+}
+
+func kustomizationWith(generation, observed int64, conditions ...metav1.Condition) *kustomizeapi.Kustomization {
+	return &kustomizeapi.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "my-app", Name: "my-app", Generation: generation},
+		Status:     kustomizeapi.KustomizationStatus{ObservedGeneration: observed, Conditions: conditions},
+	}
+}
+
+func TestReleaseState(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		release    releaseObject
+		want       reconcileState
+		wantReason string
+	}{
+		{
+			name:    "no conditions",
+			release: kustomizationWith(1, 1),
+			want:    releaseProgressing,
+		},
+		{
+			name:    "ready",
+			release: kustomizationWith(1, 1, condition(meta.ReadyCondition, metav1.ConditionTrue, meta.SucceededReason)),
+			want:    releaseReady,
+		},
+		{
+			name:    "ready unknown",
+			release: kustomizationWith(1, 1, condition(meta.ReadyCondition, metav1.ConditionUnknown, meta.ProgressingReason)),
+			want:    releaseProgressing,
+		},
+		{
+			name:    "not ready while progressing",
+			release: kustomizationWith(1, 1, condition(meta.ReadyCondition, metav1.ConditionFalse, meta.ProgressingReason)),
+			want:    releaseProgressing,
+		},
+		{
+			name:    "generation not observed",
+			release: kustomizationWith(2, 1, condition(meta.ReadyCondition, metav1.ConditionTrue, meta.SucceededReason)),
+			want:    releaseProgressing,
+		},
+		{
+			name:    "failure of a previous generation",
+			release: kustomizationWith(2, 1, condition(meta.ReadyCondition, metav1.ConditionFalse, kustomizeapi.BuildFailedReason)),
+			want:    releaseProgressing,
+		},
+		{
+			name: "stalled",
+			release: kustomizationWith(1, 1,
+				condition(meta.StalledCondition, metav1.ConditionTrue, kustomizeapi.ArtifactFailedReason),
+				condition(meta.ReadyCondition, metav1.ConditionFalse, kustomizeapi.ArtifactFailedReason)),
+			want:       releaseFailed,
+			wantReason: kustomizeapi.ArtifactFailedReason,
+		},
+		{
+			name: "not stalled",
+			release: kustomizationWith(1, 1,
+				condition(meta.StalledCondition, metav1.ConditionFalse, meta.ProgressingReason),
+				condition(meta.ReadyCondition, metav1.ConditionTrue, meta.SucceededReason)),
+			want: releaseReady,
+		},
+		{
+			name:    "artifact not fetched yet",
+			release: kustomizationWith(1, 1, condition(meta.ReadyCondition, metav1.ConditionFalse, kustomizeapi.ArtifactFailedReason)),
+			want:    releaseProgressing,
+		},
+		{
+			name: "HelmRelease upgrade failed",
+			release: &helmapi.HelmRelease{
+				ObjectMeta: metav1.ObjectMeta{Generation: 3},
+				Status: helmapi.HelmReleaseStatus{
+					ObservedGeneration: 3,
+					Conditions:         []metav1.Condition{condition(meta.ReadyCondition, metav1.ConditionFalse, helmapi.UpgradeFailedReason)},
+				},
+			},
+			want:       releaseFailed,
+			wantReason: helmapi.UpgradeFailedReason,
+		},
+	} {
+		got, cond := releaseState(tc.release)
+
+		if got != tc.want {
+			t.Errorf("%s: got state %d, want %d", tc.name, got, tc.want)
+		}
+
+		if reason := ""; cond != nil || tc.wantReason != "" {
+			if cond != nil {
+				reason = cond.Reason
+			}
+
+			if reason != tc.wantReason {
+				t.Errorf("%s: got reason %q, want %q", tc.name, reason, tc.wantReason)
+			}
+		}
+	}
+}
+
+func TestTerminalReasons(t *testing.T) {
+	for reason, terminal := range map[string]bool{
+		kustomizeapi.BuildFailedReason:          true,
+		kustomizeapi.HealthCheckFailedReason:    true,
+		kustomizeapi.DependencyNotReadyReason:   true,
+		kustomizeapi.PruneFailedReason:          true,
+		kustomizeapi.ReconciliationFailedReason: true,
+		helmapi.InstallFailedReason:             true,
+		helmapi.UpgradeFailedReason:             true,
+		helmapi.TestFailedReason:                true,
+		helmapi.RollbackFailedReason:            true,
+		helmapi.UninstallFailedReason:           true,
+		helmapi.InitFailedReason:                true,
+		helmapi.GetLastReleaseFailedReason:      true,
+		kustomizeapi.ArtifactFailedReason:       false,
+		meta.ProgressingReason:                  false,
+		meta.SucceededReason:                    false,
+	} {
+		release := kustomizationWith(1, 1, condition(meta.ReadyCondition, metav1.ConditionFalse, reason))
+
+		want := releaseProgressing
+		if terminal {
+			want = releaseFailed
+		}
+
+		if got, _ := releaseState(release); got != want {
+			t.Errorf("%s: got state %d, want %d", reason, got, want)
+		}
+	}
+}
+
+func TestRevisionState(t *testing.T) {
+	ready := condition(meta.ReadyCondition, metav1.ConditionTrue, meta.SucceededReason)
+	failed := condition(meta.ReadyCondition, metav1.ConditionFalse, kustomizeapi.HealthCheckFailedReason)
+
+	withRevisions := func(k *kustomizeapi.Kustomization, attempted, applied string) *kustomizeapi.Kustomization {
+		k.Status.LastAttemptedRevision = attempted
+		k.Status.LastAppliedRevision = applied
+
+		return k
+	}
+
+	for _, tc := range []struct {
+		name     string
+		release  releaseObject
+		expected string
+		want     reconcileState
+	}{
+		{
+			name:     "ready with the revision",
+			release:  withRevisions(kustomizationWith(1, 1, ready), "main/2", "main/2"),
+			expected: "main/2",
+			want:     releaseReady,
+		},
+		{
+			name:     "ready with the previous revision",
+			release:  withRevisions(kustomizationWith(1, 1, ready), "main/1", "main/1"),
+			expected: "main/2",
+			want:     releaseProgressing,
+		},
+		{
+			name:     "failed with the revision",
+			release:  withRevisions(kustomizationWith(1, 1, failed), "main/2", "main/1"),
+			expected: "main/2",
+			want:     releaseFailed,
+		},
+		{
+			name:     "failed with the previous revision",
+			release:  withRevisions(kustomizationWith(1, 1, failed), "main/1", "main/0"),
+			expected: "main/2",
+			want:     releaseProgressing,
+		},
+		{
+			name:    "any revision",
+			release: withRevisions(kustomizationWith(1, 1, ready), "1.2.3", "1.2.3"),
+			want:    releaseReady,
+		},
+		{
+			name:    "no revision applied",
+			release: kustomizationWith(1, 1, ready),
+			want:    releaseProgressing,
+		},
+	} {
+		if got, _ := revisionState(tc.release, tc.expected); got != tc.want {
+			t.Errorf("%s: got state %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestExpectedRevision(t *testing.T) {
+	helmRelease := func(version string) *helmapi.HelmRelease {
+		release := &helmapi.HelmRelease{}
+		release.Spec.Chart.Spec.Version = version
+
+		return release
+	}
+
+	for _, tc := range []struct {
+		name    string
+		release releaseObject
+		want    string
+	}{
+		{name: "Kustomization", release: &kustomizeapi.Kustomization{}, want: "main/2"},
+		{name: "chart version", release: helmRelease("1.2.3"), want: "1.2.3"},
+		{name: "chart version range", release: helmRelease(">=1.2.0")},
+		{name: "latest chart version", release: helmRelease("")},
+	} {
+		if got := expectedRevision(tc.release, "main/2"); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func gitRepositoryWith(ref *sourceapi.GitRepositoryRef, generation, observed int64, revision string) *sourceapi.GitRepository {
+	repo := &sourceapi.GitRepository{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "my-app", Name: "my-app", Generation: generation},
+		Spec:       sourceapi.GitRepositorySpec{URL: "https://github.com/example/my-app", Reference: ref},
+		Status: sourceapi.GitRepositoryStatus{
+			ObservedGeneration: observed,
+			Conditions:         []metav1.Condition{condition(meta.ReadyCondition, metav1.ConditionTrue, meta.SucceededReason)},
+		},
+	}
+
+	if revision != "" {
+		repo.Status.Artifact = &sourceapi.Artifact{Revision: revision}
+	}
+
+	return repo
+}
+
+func ociRepositoryWith(ref map[string]interface{}, revision string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"ref": ref},
+		"status": map[string]interface{}{
+			"observedGeneration": int64(1),
+			"artifact":           map[string]interface{}{"revision": revision},
+			"conditions":         []interface{}{map[string]interface{}{"type": "Ready", "status": "True"}},
+		},
+	}}
+	obj.SetGroupVersionKind(ociRepositoryGroupVersion.WithKind(ociRepositoryKind))
+	obj.SetGeneration(1)
+
+	return obj
+}
+
+func TestFetchedRevision(t *testing.T) {
+	const commit = "9ffef1969677057e21dfe99accbf22f343f96300"
+
+	notReady := gitRepositoryWith(nil, 1, 1, "main/"+commit)
+	notReady.Status.Conditions[0].Status = metav1.ConditionFalse
+
+	for _, tc := range []struct {
+		name   string
+		source client.Object
+		want   string
+	}{
+		{
+			name:   "commit",
+			source: gitRepositoryWith(&sourceapi.GitRepositoryRef{Commit: commit}, 2, 2, "HEAD/"+commit),
+			want:   "HEAD/" + commit,
+		},
+		{
+			name:   "previous commit",
+			source: gitRepositoryWith(&sourceapi.GitRepositoryRef{Commit: commit}, 2, 2, "HEAD/0000000000000000000000000000000000000000"),
+		},
+		{
+			name:   "generation not observed",
+			source: gitRepositoryWith(&sourceapi.GitRepositoryRef{Commit: commit}, 2, 1, "HEAD/"+commit),
+		},
+		{
+			name:   "no artifact",
+			source: gitRepositoryWith(nil, 1, 1, ""),
+		},
+		{
+			name:   "not ready",
+			source: notReady,
+		},
+		{
+			name:   "tag",
+			source: gitRepositoryWith(&sourceapi.GitRepositoryRef{Tag: "v1.2.0"}, 1, 1, "v1.2.0/"+commit),
+			want:   "v1.2.0/" + commit,
+		},
+		{
+			name:   "previous tag",
+			source: gitRepositoryWith(&sourceapi.GitRepositoryRef{Tag: "v1.2.0"}, 1, 1, "v1.1.0/"+commit),
+		},
+		{
+			name:   "tag of newer Flux",
+			source: gitRepositoryWith(&sourceapi.GitRepositoryRef{Tag: "v1.2.0"}, 1, 1, "v1.2.0@sha1:"+commit),
+			want:   "v1.2.0@sha1:" + commit,
+		},
+		{
+			name:   "branch",
+			source: gitRepositoryWith(&sourceapi.GitRepositoryRef{Branch: "release-1.2"}, 1, 1, "release-1.2/"+commit),
+			want:   "release-1.2/" + commit,
+		},
+		{
+			name:   "previous branch",
+			source: gitRepositoryWith(&sourceapi.GitRepositoryRef{Branch: "release-1.2"}, 1, 1, "release-1.1/"+commit),
+		},
+		{
+			name:   "semver",
+			source: gitRepositoryWith(&sourceapi.GitRepositoryRef{SemVer: ">=1.2.0"}, 1, 1, "v1.2.3/"+commit),
+			want:   "v1.2.3/" + commit,
+		},
+		{
+			name:   "OCI digest",
+			source: ociRepositoryWith(map[string]interface{}{"digest": "sha256:2e8a3b"}, "sha256:2e8a3b"),
+			want:   "sha256:2e8a3b",
+		},
+		{
+			name:   "previous OCI digest",
+			source: ociRepositoryWith(map[string]interface{}{"digest": "sha256:2e8a3b"}, "sha256:1d7a2a"),
+		},
+		{
+			name:   "OCI tag",
+			source: ociRepositoryWith(map[string]interface{}{"tag": "v2"}, "v2/2e8a3b"),
+			want:   "v2/2e8a3b",
+		},
+		{
+			name:   "previous OCI tag",
+			source: ociRepositoryWith(map[string]interface{}{"tag": "v2"}, "v1/1d7a2a"),
+		},
+		{
+			name:   "OCI tag with digest revision",
+			source: ociRepositoryWith(map[string]interface{}{"tag": "v2"}, "2e8a3b"),
+			want:   "2e8a3b",
+		},
+		{
+			name: "Bucket",
+			source: &sourceapi.Bucket{
+				ObjectMeta: metav1.ObjectMeta{Generation: 2},
+				Status: sourceapi.BucketStatus{
+					ObservedGeneration: 2,
+					Artifact:           &sourceapi.Artifact{Revision: "checksum"},
+					Conditions:         []metav1.Condition{condition(meta.ReadyCondition, metav1.ConditionTrue, meta.SucceededReason)},
+				},
+			},
+			want: "checksum",
+		},
+	} {
+		if got := fetchedRevision(tc.source); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCheckReadinessWaitsForRevision(t *testing.T) {
+	ctx := context.Background()
+
+	const (
+		oldRevision = "v1.0.0/1111111111111111111111111111111111111111"
+		newRevision = "v1.1.0/2222222222222222222222222222222222222222"
+	)
+
+	ready := condition(meta.ReadyCondition, metav1.ConditionTrue, meta.SucceededReason)
+
+	// The update only changed the tag of the source, so the Kustomization is
+	// still ready with the previous revision.
+	kustomization := kustomizationWith(1, 1, ready)
+	kustomization.Spec.SourceRef = kustomizeapi.CrossNamespaceSourceReference{Kind: sourceapi.GitRepositoryKind, Name: "my-app"}
+	kustomization.Status.LastAttemptedRevision = oldRevision
+	kustomization.Status.LastAppliedRevision = oldRevision
+
+	source := gitRepositoryWith(&sourceapi.GitRepositoryRef{Tag: "v1.1.0"}, 2, 1, oldRevision)
+
+	app := &application{
+		cfg: &Config{client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(kustomization, source).Build()},
+		log: log.WithField("test", t.Name()),
+	}
+
+	update := func(obj client.Object, change func()) {
+		t.Helper()
+
+		if err := app.cfg.client.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+			t.Fatal(err)
+		}
+
+		change()
+
+		if err := app.cfg.client.Update(ctx, obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(step string, want bool) {
+		t.Helper()
+
+		got, waiting, err := app.checkReadiness(ctx, kustomization.DeepCopy(), source.DeepCopy())
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+
+		if got != want {
+			t.Errorf("%s: got ready %t, want %t, waiting for %v", step, got, want, waiting)
+		}
+	}
+
+	check("source not fetched", false)
+
+	update(source, func() {
+		source.Status.ObservedGeneration = 2
+		source.Status.Artifact.Revision = newRevision
+	})
+
+	check("revision not applied", false)
+
+	update(kustomization, func() {
+		kustomization.Status.LastAttemptedRevision = newRevision
+		kustomization.Status.LastAppliedRevision = newRevision
+	})
+
+	check("revision applied", true)
+
+	// A rollback restores the previous tag, the artifact of the update is not
+	// mistaken for the restored one.
+	update(source, func() {
+		source.Spec.Reference.Tag = "v1.0.0"
+		source.Generation = 3
+	})
+
+	check("restored source not fetched", false)
+}
@@ -0,0 +1,162 @@
+package updater
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// healthChecker tracks the state that the liveness and readiness probes of the
+// agent report on. It is updated by the applications and read by the HTTP
+// server, hence the lock.
+type healthChecker struct {
+	mu sync.Mutex
+
+	// initialized is set once the Kubernetes client is ready.
+	initialized bool
+	apps        map[types.NamespacedName]*appHealth
+
+	failureThreshold  int
+	reconcileDeadline time.Duration
+}
+
+// appHealth is the health of a single application.
+type appHealth struct {
+	// setUp is set once the Nebraska client of the application is created.
+	setUp bool
+
+	// failures is the number of consecutive failed checks.
+	failures int
+
+	// reconcileStart is the start of the running reconciliation, if any.
+	reconcileStart time.Time
+}
+
+func newHealthChecker(failureThreshold int, reconcileDeadline time.Duration) *healthChecker {
+	return &healthChecker{
+		apps:              map[types.NamespacedName]*appHealth{},
+		failureThreshold:  failureThreshold,
+		reconcileDeadline: reconcileDeadline,
+	}
+}
+
+func (h *healthChecker) setInitialized() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.initialized = true
+}
+
+func (h *healthChecker) reconcileStarted(key types.NamespacedName) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	app, ok := h.apps[key]
+	if !ok {
+		app = &appHealth{}
+		h.apps[key] = app
+	}
+
+	app.reconcileStart = time.Now()
+}
+
+func (h *healthChecker) reconcileFinished(key types.NamespacedName, setUp bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	app, ok := h.apps[key]
+	if !ok {
+		return
+	}
+
+	app.setUp = setUp
+	app.reconcileStart = time.Time{}
+
+	if err != nil {
+		app.failures++
+	} else {
+		app.failures = 0
+	}
+}
+
+func (h *healthChecker) remove(key types.NamespacedName) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.apps, key)
+}
+
+// live returns an error when a reconciliation is stuck for longer than the
+// reconcile deadline.
+func (h *healthChecker) live() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var problems []string
+
+	for key, app := range h.apps {
+		if app.reconcileStart.IsZero() || h.reconcileDeadline <= 0 {
+			continue
+		}
+
+		if running := time.Since(app.reconcileStart); running > h.reconcileDeadline {
+			problems = append(problems, fmt.Sprintf("%s is reconciling for %s", key, running.Round(time.Second)))
+		}
+	}
+
+	return problemsError(problems)
+}
+
+// ready returns an error when the Kubernetes client or the Nebraska client of
+// an application is not initialized, or when the last checks of an application
+// failed.
+func (h *healthChecker) ready() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.initialized {
+		return fmt.Errorf("kubernetes client not initialized")
+	}
+
+	var problems []string
+
+	for key, app := range h.apps {
+		switch {
+		case !app.setUp:
+			problems = append(problems, fmt.Sprintf("nebraska client of %s not initialized", key))
+		case h.failureThreshold > 0 && app.failures >= h.failureThreshold:
+			problems = append(problems, fmt.Sprintf("last %d checks of %s failed", app.failures, key))
+		}
+	}
+
+	return problemsError(problems)
+}
+
+func problemsError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+
+	// Map iteration is random, keep the output stable.
+	sort.Strings(problems)
+
+	return fmt.Errorf("%s", strings.Join(problems, ", "))
+}
+
+// probeHandler serves the result of the given check.
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,96 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// runWithLeaderElection runs the given function once this replica holds the
+// Lease. The function's context is cancelled when the Lease is lost, after
+// which an error is returned so that the agent restarts as a follower.
+func (cfg *Config) runWithLeaderElection(ctx context.Context, run func(context.Context)) error {
+	identity, err := leaderIdentity()
+	if err != nil {
+		return fmt.Errorf("getting leader election identity: %w", err)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      cfg.LeaderElectionID,
+			Namespace: cfg.LeaderElectionNamespace,
+		},
+		Client: cfg.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	stopped := make(chan struct{})
+
+	log.Infof("waiting to become the leader as %s", identity)
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				defer close(stopped)
+
+				log.Info("became the leader")
+
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				log.Info("stopped leading")
+			},
+			OnNewLeader: func(current string) {
+				if current != identity {
+					log.Infof("%s is the leader", current)
+				}
+			},
+		},
+	})
+
+	// RunOrDie only returns without having led when the context is cancelled.
+	// Otherwise wait for the applications to stop before exiting, so that the
+	// next leader does not race with them.
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+	}
+
+	return fmt.Errorf("lost the leader election Lease %s/%s", cfg.LeaderElectionNamespace, cfg.LeaderElectionID)
+}
+
+// leaderIdentity returns a unique identity of this replica. POD_NAME is set by
+// the deployment through the downward API.
+func leaderIdentity() (string, error) {
+	name := os.Getenv("POD_NAME")
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("getting hostname: %w", err)
+		}
+
+		name = hostname
+	}
+
+	return name + "_" + string(uuid.NewUUID()), nil
+}
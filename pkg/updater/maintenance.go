@@ -0,0 +1,358 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"time"
+	// Embed the time zone database, so that windows work on images without
+	// one.
+	_ "time/tzdata"
+
+	"github.com/kinvolk/nebraska/updater"
+
+	"github.com/robfig/cron/v3"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+// maxScheduleActivations bounds the search for the latest opening of a cron
+// schedule, which is only long for schedules opening every few minutes.
+const maxScheduleActivations = 10000
+
+// window is an open maintenance window.
+type window struct {
+	end time.Time
+}
+
+// updateWindow returns the maintenance window the update deploying release
+// can be applied in now, or nil when the update has to be deferred. With the
+// Defer overrun policy, an update that can't become ready within any window is
+// an error, as deferring it would never let it start.
+func (app *application) updateWindow(now time.Time, release releaseObject) (*window, error) {
+	// The timeout is only known once the manifest was fetched for an open
+	// window, unless the application sets it.
+	if app.spec.OverrunPolicy == v1alpha1.OverrunPolicyDefer && (release != nil || app.spec.ReadinessTimeout != nil) {
+		if err := app.checkWindowLength(app.readinessTimeout(release)); err != nil {
+			return nil, err
+		}
+	}
+
+	win, err := app.openWindow(now)
+	if err != nil || win == nil {
+		return nil, err
+	}
+
+	// Don't start updates that could not become ready before the window ends.
+	if app.spec.OverrunPolicy == v1alpha1.OverrunPolicyDefer && !win.end.IsZero() && win.end.Sub(now) < app.readinessTimeout(release) {
+		return nil, nil
+	}
+
+	return win, nil
+}
+
+// windowRelease returns the release of the update when its timeout decides
+// whether the update fits into the maintenance window, else nil, and the
+// manifest it fetched for it. Failures to fetch the manifest are reported when
+// the update is started, which fetches it again.
+func (app *application) windowRelease(ctx context.Context, info *updater.UpdateInfo, now time.Time) (releaseObject, *v1alpha1.UpdateManifest) {
+	if app.spec.OverrunPolicy != v1alpha1.OverrunPolicyDefer || app.spec.ReadinessTimeout != nil {
+		return nil, nil
+	}
+
+	// Nothing is fetched while the windows are closed.
+	if win, err := app.openWindow(now); err != nil || win == nil || win.end.IsZero() {
+		return nil, nil
+	}
+
+	m, err := app.getUpdateManifest(ctx, info)
+	if err != nil {
+		app.log.Warnf("getting the timeout of the update for the maintenance window: %v", err)
+
+		return nil, nil
+	}
+
+	if err := app.getUpdateConfig(ctx, info, m); err != nil {
+		app.log.Warnf("getting the timeout of the update for the maintenance window: %v", err)
+
+		return nil, m
+	}
+
+	return app.release, m
+}
+
+// checkWindowLength returns an error when the readiness timeout is longer than
+// all maintenance windows.
+func (app *application) checkWindowLength(timeout time.Duration) error {
+	var longest time.Duration
+
+	for i := range app.spec.MaintenanceWindows {
+		length, err := windowLength(&app.spec.MaintenanceWindows[i])
+		if err != nil {
+			return fmt.Errorf("maintenance window %d: %w", i, err)
+		}
+
+		if length > longest {
+			longest = length
+		}
+	}
+
+	if longest > 0 && timeout > longest {
+		return fmt.Errorf("the readiness timeout of %s is longer than the longest maintenance window of %s, so the update would never be started with the %s overrun policy",
+			timeout, longest, v1alpha1.OverrunPolicyDefer)
+	}
+
+	return nil
+}
+
+// deferUpdate remembers the update to the given version as pending until the
+// next maintenance window opens.
+func (app *application) deferUpdate(version string) error {
+	if app.deferredVersion == version {
+		return nil
+	}
+
+	app.deferredVersion = version
+	app.pendingVersion = version
+
+	next, err := app.nextWindowStart(time.Now())
+	if err != nil {
+		return fmt.Errorf("getting next maintenance window: %w", err)
+	}
+
+	app.log.Infof("deferring update to %s until the maintenance window opens at %s", version, next)
+
+	app.recordEvent(corev1.EventTypeNormal, eventReasonUpdateDeferred, version,
+		"deferred until the maintenance window opens at %s", next.Format(time.RFC3339))
+
+	return nil
+}
+
+// verifyDeadline returns the time by which the release has to be ready when
+// verifying starts at the given time, and the reason of the failure once it
+// passed. With the Rollback overrun policy, it is the end of the window.
+func (app *application) verifyDeadline(win *window, release releaseObject, now time.Time) (time.Time, string) {
+	timeout := app.readinessTimeout(release)
+	deadline := now.Add(timeout)
+
+	if app.spec.OverrunPolicy == v1alpha1.OverrunPolicyRollback && !win.end.IsZero() && win.end.Before(deadline) {
+		return win.end, fmt.Sprintf("maintenance window ended at %s", win.end.Format(time.RFC3339))
+	}
+
+	return deadline, fmt.Sprintf("timed out after %s", timeout)
+}
+
+// openWindow returns the maintenance window that is open at the given time, or
+// nil when all windows are closed. Without windows, updates are allowed at any
+// time and the returned window never ends.
+func (app *application) openWindow(now time.Time) (*window, error) {
+	if len(app.spec.MaintenanceWindows) == 0 {
+		return &window{}, nil
+	}
+
+	var open *window
+
+	for i := range app.spec.MaintenanceWindows {
+		end, err := windowEnd(&app.spec.MaintenanceWindows[i], now)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance window %d: %w", i, err)
+		}
+
+		// Use the window that stays open for the longest time.
+		if !end.IsZero() && (open == nil || end.After(open.end)) {
+			open = &window{end: end}
+		}
+	}
+
+	return open, nil
+}
+
+// nextWindowStart returns the next time one of the maintenance windows opens.
+func (app *application) nextWindowStart(now time.Time) (time.Time, error) {
+	var next time.Time
+
+	for i := range app.spec.MaintenanceWindows {
+		start, err := windowNextStart(&app.spec.MaintenanceWindows[i], now)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("maintenance window %d: %w", i, err)
+		}
+
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+
+	return next, nil
+}
+
+// windowEnd returns the end of the window when it is open at the given time,
+// or the zero time when it is closed.
+func windowEnd(w *v1alpha1.MaintenanceWindow, now time.Time) (time.Time, error) {
+	loc, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("loading time zone: %w", err)
+	}
+
+	now = now.In(loc)
+
+	if w.Schedule != "" {
+		return scheduleWindowEnd(w, now)
+	}
+
+	// Windows closing after midnight were opened on the previous day.
+	for _, days := range []int{0, -1} {
+		start, end, err := dailyWindow(w, now.AddDate(0, 0, days))
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if !start.IsZero() && !now.Before(start) && now.Before(end) {
+			return end, nil
+		}
+	}
+
+	return time.Time{}, nil
+}
+
+// windowNextStart returns the next time the window opens after the given time.
+func windowNextStart(w *v1alpha1.MaintenanceWindow, now time.Time) (time.Time, error) {
+	loc, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("loading time zone: %w", err)
+	}
+
+	now = now.In(loc)
+
+	if w.Schedule != "" {
+		schedule, err := parseSchedule(w)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return schedule.Next(now), nil
+	}
+
+	// Every day of the week is tried once, plus the current day next week.
+	for days := 0; days <= 7; days++ {
+		start, _, err := dailyWindow(w, now.AddDate(0, 0, days))
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if !start.IsZero() && start.After(now) {
+			return start, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("window never opens")
+}
+
+// windowLength returns how long the window stays open. The length of daily
+// windows is the one on days without a change of the clocks.
+func windowLength(w *v1alpha1.MaintenanceWindow) (time.Duration, error) {
+	if w.Schedule != "" {
+		if _, err := parseSchedule(w); err != nil {
+			return 0, err
+		}
+
+		return w.Duration.Duration, nil
+	}
+
+	start, end, err := dailyWindow(&v1alpha1.MaintenanceWindow{Start: w.Start, End: w.End}, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		return 0, err
+	}
+
+	return end.Sub(start), nil
+}
+
+// dailyWindow returns the start and end of the window opening on the day of
+// the given time, or zero times when it does not open on that day.
+func dailyWindow(w *v1alpha1.MaintenanceWindow, day time.Time) (time.Time, time.Time, error) {
+	if w.Start == "" || w.End == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("either start and end or schedule and duration are required")
+	}
+
+	if !opensOn(w, day.Weekday()) {
+		return time.Time{}, time.Time{}, nil
+	}
+
+	start, err := timeOfDay(day, w.Start)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("parsing start: %w", err)
+	}
+
+	end, err := timeOfDay(day, w.End)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("parsing end: %w", err)
+	}
+
+	if !end.After(start) {
+		end = end.AddDate(0, 0, 1)
+	}
+
+	return start, end, nil
+}
+
+// opensOn returns true when the window opens on the given day of the week.
+func opensOn(w *v1alpha1.MaintenanceWindow, weekday time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+
+	for _, day := range w.Days {
+		if string(day) == weekday.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// timeOfDay returns the given HH:MM time on the day of the given time.
+func timeOfDay(day time.Time, value string) (time.Time, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, day.Location()), nil
+}
+
+// scheduleWindowEnd returns the end of the latest window of the cron schedule
+// that is open at the given time, or the zero time when none is.
+func scheduleWindowEnd(w *v1alpha1.MaintenanceWindow, now time.Time) (time.Time, error) {
+	schedule, err := parseSchedule(w)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	duration := w.Duration.Duration
+
+	// Next returns the first opening after the given time, so only openings
+	// of windows that are still open are considered.
+	var end time.Time
+
+	start := schedule.Next(now.Add(-duration))
+
+	for i := 0; i < maxScheduleActivations && !start.After(now); i++ {
+		end = start.Add(duration)
+		start = schedule.Next(start)
+	}
+
+	return end, nil
+}
+
+func parseSchedule(w *v1alpha1.MaintenanceWindow) (cron.Schedule, error) {
+	if w.Duration == nil || w.Duration.Duration <= 0 {
+		return nil, fmt.Errorf("schedule requires a positive duration")
+	}
+
+	schedule, err := cron.ParseStandard(w.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("parsing schedule: %w", err)
+	}
+
+	return schedule, nil
+}
@@ -0,0 +1,543 @@
+package updater
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+	"github.com/kinvolk/go-omaha/omaha"
+	"github.com/kinvolk/nebraska/updater"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return loc
+}
+
+func TestDailyWindow(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+
+	for _, tc := range []struct {
+		name         string
+		window       v1alpha1.MaintenanceWindow
+		day          time.Time
+		wantStart    time.Time
+		wantDuration time.Duration
+		wantErr      string
+	}{
+		{
+			name:         "same day",
+			window:       v1alpha1.MaintenanceWindow{Start: "02:00", End: "04:00"},
+			day:          time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+			wantStart:    time.Date(2022, 6, 1, 2, 0, 0, 0, time.UTC),
+			wantDuration: 2 * time.Hour,
+		},
+		{
+			name:         "across midnight",
+			window:       v1alpha1.MaintenanceWindow{Start: "22:00", End: "02:00"},
+			day:          time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+			wantStart:    time.Date(2022, 6, 1, 22, 0, 0, 0, time.UTC),
+			wantDuration: 4 * time.Hour,
+		},
+		{
+			name:         "whole day",
+			window:       v1alpha1.MaintenanceWindow{Start: "00:00", End: "00:00"},
+			day:          time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+			wantStart:    time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC),
+			wantDuration: 24 * time.Hour,
+		},
+		{
+			name:      "other day of the week",
+			window:    v1alpha1.MaintenanceWindow{Days: []v1alpha1.Weekday{"Monday"}, Start: "02:00", End: "04:00"},
+			day:       time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+			wantStart: time.Time{},
+		},
+		{
+			name:         "day of the week",
+			window:       v1alpha1.MaintenanceWindow{Days: []v1alpha1.Weekday{"Monday", "Wednesday"}, Start: "02:00", End: "04:00"},
+			day:          time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+			wantStart:    time.Date(2022, 6, 1, 2, 0, 0, 0, time.UTC),
+			wantDuration: 2 * time.Hour,
+		},
+		{
+			name:         "start of daylight saving time",
+			window:       v1alpha1.MaintenanceWindow{Start: "01:00", End: "04:00"},
+			day:          time.Date(2022, 3, 27, 12, 0, 0, 0, berlin),
+			wantStart:    time.Date(2022, 3, 27, 1, 0, 0, 0, berlin),
+			wantDuration: 2 * time.Hour,
+		},
+		{
+			name:         "end of daylight saving time",
+			window:       v1alpha1.MaintenanceWindow{Start: "01:00", End: "04:00"},
+			day:          time.Date(2022, 10, 30, 12, 0, 0, 0, berlin),
+			wantStart:    time.Date(2022, 10, 30, 1, 0, 0, 0, berlin),
+			wantDuration: 4 * time.Hour,
+		},
+		{
+			name:    "no end",
+			window:  v1alpha1.MaintenanceWindow{Start: "02:00"},
+			day:     time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+			wantErr: "either start and end or schedule and duration are required",
+		},
+		{
+			name:    "invalid start",
+			window:  v1alpha1.MaintenanceWindow{Start: "25:00", End: "04:00"},
+			day:     time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+			wantErr: "parsing start",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			start, end, err := dailyWindow(&tc.window, tc.day)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !start.Equal(tc.wantStart) {
+				t.Errorf("start: got %s, want %s", start, tc.wantStart)
+			}
+
+			if !start.IsZero() && end.Sub(start) != tc.wantDuration {
+				t.Errorf("duration: got %s, want %s", end.Sub(start), tc.wantDuration)
+			}
+		})
+	}
+}
+
+func TestWindowEnd(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	for _, tc := range []struct {
+		name    string
+		window  v1alpha1.MaintenanceWindow
+		now     time.Time
+		want    time.Time
+		wantErr string
+	}{
+		{
+			name:   "open",
+			window: v1alpha1.MaintenanceWindow{Start: "02:00", End: "04:00"},
+			now:    time.Date(2022, 6, 1, 3, 0, 0, 0, time.UTC),
+			want:   time.Date(2022, 6, 1, 4, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "opening",
+			window: v1alpha1.MaintenanceWindow{Start: "02:00", End: "04:00"},
+			now:    time.Date(2022, 6, 1, 2, 0, 0, 0, time.UTC),
+			want:   time.Date(2022, 6, 1, 4, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "closing",
+			window: v1alpha1.MaintenanceWindow{Start: "02:00", End: "04:00"},
+			now:    time.Date(2022, 6, 1, 4, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "before midnight",
+			window: v1alpha1.MaintenanceWindow{Start: "22:00", End: "02:00"},
+			now:    time.Date(2022, 6, 1, 23, 0, 0, 0, time.UTC),
+			want:   time.Date(2022, 6, 2, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "after midnight",
+			window: v1alpha1.MaintenanceWindow{Start: "22:00", End: "02:00"},
+			now:    time.Date(2022, 6, 2, 1, 0, 0, 0, time.UTC),
+			want:   time.Date(2022, 6, 2, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "after midnight of the day it opened",
+			window: v1alpha1.MaintenanceWindow{Days: []v1alpha1.Weekday{"Friday"}, Start: "22:00", End: "02:00"},
+			now:    time.Date(2022, 6, 4, 1, 0, 0, 0, time.UTC),
+			want:   time.Date(2022, 6, 4, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "on a closed day",
+			window: v1alpha1.MaintenanceWindow{Days: []v1alpha1.Weekday{"Friday"}, Start: "22:00", End: "02:00"},
+			now:    time.Date(2022, 6, 4, 23, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "time zone",
+			window: v1alpha1.MaintenanceWindow{Start: "02:00", End: "04:00", TimeZone: "America/New_York"},
+			now:    time.Date(2022, 6, 1, 7, 0, 0, 0, time.UTC),
+			want:   time.Date(2022, 6, 1, 4, 0, 0, 0, newYork),
+		},
+		{
+			name:   "closed in the time zone",
+			window: v1alpha1.MaintenanceWindow{Start: "02:00", End: "04:00", TimeZone: "America/New_York"},
+			now:    time.Date(2022, 6, 1, 3, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "day of the week in the time zone",
+			window: v1alpha1.MaintenanceWindow{Days: []v1alpha1.Weekday{"Tuesday"}, Start: "22:00", End: "23:00", TimeZone: "America/New_York"},
+			now:    time.Date(2022, 6, 1, 2, 30, 0, 0, time.UTC),
+			want:   time.Date(2022, 5, 31, 23, 0, 0, 0, newYork),
+		},
+		{
+			name:   "schedule",
+			window: v1alpha1.MaintenanceWindow{Schedule: "0 2 * * *", Duration: &metav1.Duration{Duration: 2 * time.Hour}},
+			now:    time.Date(2022, 6, 1, 3, 0, 0, 0, time.UTC),
+			want:   time.Date(2022, 6, 1, 4, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "schedule across midnight",
+			window: v1alpha1.MaintenanceWindow{Schedule: "0 23 * * *", Duration: &metav1.Duration{Duration: 2 * time.Hour}},
+			now:    time.Date(2022, 6, 2, 0, 30, 0, 0, time.UTC),
+			want:   time.Date(2022, 6, 2, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "schedule closed",
+			window: v1alpha1.MaintenanceWindow{Schedule: "0 2 * * *", Duration: &metav1.Duration{Duration: 2 * time.Hour}},
+			now:    time.Date(2022, 6, 1, 5, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "schedule without duration",
+			window:  v1alpha1.MaintenanceWindow{Schedule: "0 2 * * *"},
+			now:     time.Date(2022, 6, 1, 3, 0, 0, 0, time.UTC),
+			wantErr: "schedule requires a positive duration",
+		},
+		{
+			name:    "unknown time zone",
+			window:  v1alpha1.MaintenanceWindow{Start: "02:00", End: "04:00", TimeZone: "Mars/Olympus_Mons"},
+			now:     time.Date(2022, 6, 1, 3, 0, 0, 0, time.UTC),
+			wantErr: "loading time zone",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := windowEnd(&tc.window, tc.now)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !got.Equal(tc.want) {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNextWindowStart(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+
+	for _, tc := range []struct {
+		name    string
+		windows []v1alpha1.MaintenanceWindow
+		now     time.Time
+		want    time.Time
+		wantErr string
+	}{
+		{
+			name:    "later today",
+			windows: []v1alpha1.MaintenanceWindow{{Start: "02:00", End: "04:00"}},
+			now:     time.Date(2022, 6, 1, 1, 0, 0, 0, time.UTC),
+			want:    time.Date(2022, 6, 1, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "tomorrow while open",
+			windows: []v1alpha1.MaintenanceWindow{{Start: "02:00", End: "04:00"}},
+			now:     time.Date(2022, 6, 1, 3, 0, 0, 0, time.UTC),
+			want:    time.Date(2022, 6, 2, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "next week",
+			windows: []v1alpha1.MaintenanceWindow{{Days: []v1alpha1.Weekday{"Wednesday"}, Start: "02:00", End: "04:00"}},
+			now:     time.Date(2022, 6, 1, 3, 0, 0, 0, time.UTC),
+			want:    time.Date(2022, 6, 8, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "earliest window",
+			windows: []v1alpha1.MaintenanceWindow{
+				{Days: []v1alpha1.Weekday{"Monday"}, Start: "10:00", End: "12:00"},
+				{Start: "22:00", End: "23:00"},
+			},
+			now:  time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2022, 6, 1, 22, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "time zone",
+			windows: []v1alpha1.MaintenanceWindow{{Start: "02:00", End: "04:00", TimeZone: "Europe/Berlin"}},
+			now:     time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+			want:    time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "start of daylight saving time",
+			windows: []v1alpha1.MaintenanceWindow{{Start: "03:00", End: "05:00", TimeZone: "Europe/Berlin"}},
+			now:     time.Date(2022, 3, 26, 12, 0, 0, 0, berlin),
+			want:    time.Date(2022, 3, 27, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "end of daylight saving time",
+			windows: []v1alpha1.MaintenanceWindow{{Start: "03:00", End: "05:00", TimeZone: "Europe/Berlin"}},
+			now:     time.Date(2022, 10, 29, 12, 0, 0, 0, berlin),
+			want:    time.Date(2022, 10, 30, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "schedule",
+			windows: []v1alpha1.MaintenanceWindow{{Schedule: "30 1 * * 0", Duration: &metav1.Duration{Duration: time.Hour}}},
+			now:     time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+			want:    time.Date(2022, 6, 5, 1, 30, 0, 0, time.UTC),
+		},
+		{
+			name:    "invalid window",
+			windows: []v1alpha1.MaintenanceWindow{{Start: "02:00", End: "4 o'clock"}},
+			now:     time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+			wantErr: "maintenance window 0: parsing end",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := &application{}
+			app.spec.MaintenanceWindows = tc.windows
+
+			got, err := app.nextWindowStart(tc.now)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !got.Equal(tc.want) {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUpdateWindow(t *testing.T) {
+	// The window closes 8 minutes after now.
+	now := time.Date(2022, 6, 1, 23, 52, 0, 0, time.UTC)
+	closes := time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC)
+	window := v1alpha1.MaintenanceWindow{Start: "22:00", End: "00:00"}
+
+	withTimeout := func(timeout time.Duration) *kustomizeapi.Kustomization {
+		return &kustomizeapi.Kustomization{Spec: kustomizeapi.KustomizationSpec{Timeout: &metav1.Duration{Duration: timeout}}}
+	}
+
+	for _, tc := range []struct {
+		name             string
+		windows          []v1alpha1.MaintenanceWindow
+		policy           v1alpha1.OverrunPolicy
+		readinessTimeout *metav1.Duration
+		release          releaseObject
+		now              time.Time
+		wantOpen         bool
+		wantEnd          time.Time
+		wantErr          string
+	}{
+		{
+			name:     "no windows",
+			now:      now,
+			wantOpen: true,
+		},
+		{
+			name:    "closed",
+			windows: []v1alpha1.MaintenanceWindow{window},
+			now:     time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "overrun continues",
+			windows:  []v1alpha1.MaintenanceWindow{window},
+			policy:   v1alpha1.OverrunPolicyContinue,
+			release:  withTimeout(time.Hour),
+			now:      now,
+			wantOpen: true,
+			wantEnd:  closes,
+		},
+		{
+			name:     "Kustomization timeout fits",
+			windows:  []v1alpha1.MaintenanceWindow{window},
+			policy:   v1alpha1.OverrunPolicyDefer,
+			release:  withTimeout(5 * time.Minute),
+			now:      now,
+			wantOpen: true,
+			wantEnd:  closes,
+		},
+		{
+			name:    "Kustomization timeout does not fit",
+			windows: []v1alpha1.MaintenanceWindow{window},
+			policy:  v1alpha1.OverrunPolicyDefer,
+			release: withTimeout(15 * time.Minute),
+			now:     now,
+		},
+		{
+			name:    "default timeout does not fit",
+			windows: []v1alpha1.MaintenanceWindow{window},
+			policy:  v1alpha1.OverrunPolicyDefer,
+			now:     now,
+		},
+		{
+			name:             "readiness timeout takes precedence",
+			windows:          []v1alpha1.MaintenanceWindow{window},
+			policy:           v1alpha1.OverrunPolicyDefer,
+			readinessTimeout: &metav1.Duration{Duration: 15 * time.Minute},
+			release:          withTimeout(5 * time.Minute),
+			now:              now,
+		},
+		{
+			name:    "Kustomization timeout longer than the window",
+			windows: []v1alpha1.MaintenanceWindow{window},
+			policy:  v1alpha1.OverrunPolicyDefer,
+			release: withTimeout(3 * time.Hour),
+			now:     now,
+			wantErr: "readiness timeout of 3h0m0s is longer than the longest maintenance window of 2h0m0s",
+		},
+		{
+			name:             "readiness timeout longer than the window while closed",
+			windows:          []v1alpha1.MaintenanceWindow{window},
+			policy:           v1alpha1.OverrunPolicyDefer,
+			readinessTimeout: &metav1.Duration{Duration: 3 * time.Hour},
+			now:              time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+			wantErr:          "would never be started",
+		},
+		{
+			name:    "timeout longer than the schedule",
+			windows: []v1alpha1.MaintenanceWindow{{Schedule: "0 * * * *", Duration: &metav1.Duration{Duration: 30 * time.Minute}}},
+			policy:  v1alpha1.OverrunPolicyDefer,
+			release: withTimeout(time.Hour),
+			now:     now,
+			wantErr: "longest maintenance window of 30m0s",
+		},
+		{
+			name:    "unknown timeout while closed",
+			windows: []v1alpha1.MaintenanceWindow{{Start: "22:00", End: "22:05"}},
+			policy:  v1alpha1.OverrunPolicyDefer,
+			now:     time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "timeout longer than the window overruns",
+			windows:  []v1alpha1.MaintenanceWindow{window},
+			policy:   v1alpha1.OverrunPolicyContinue,
+			release:  withTimeout(3 * time.Hour),
+			now:      now,
+			wantOpen: true,
+			wantEnd:  closes,
+		},
+		{
+			name:     "longest open window",
+			windows:  []v1alpha1.MaintenanceWindow{window, {Start: "23:00", End: "01:00"}},
+			policy:   v1alpha1.OverrunPolicyDefer,
+			now:      now,
+			wantOpen: true,
+			wantEnd:  closes.Add(time.Hour),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := &application{}
+			app.spec.MaintenanceWindows = tc.windows
+			app.spec.OverrunPolicy = tc.policy
+			app.spec.ReadinessTimeout = tc.readinessTimeout
+
+			win, err := app.updateWindow(tc.now, tc.release)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if (win != nil) != tc.wantOpen {
+				t.Fatalf("got window %v, want open %t", win, tc.wantOpen)
+			}
+
+			if win != nil && !win.end.Equal(tc.wantEnd) {
+				t.Errorf("end: got %s, want %s", win.end, tc.wantEnd)
+			}
+		})
+	}
+}
+
+func TestUpdateInWindowFetchesManifestOnce(t *testing.T) {
+	ctx := context.Background()
+	data := []byte(testManifest)
+
+	var downloads int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	app := newTestApplication(t, &fakeOmaha{})
+	withFluxCluster(app)
+
+	// The window opened an hour ago and stays open for two more hours.
+	now := time.Now().UTC()
+	app.spec.OverrunPolicy = v1alpha1.OverrunPolicyDefer
+	app.spec.MaintenanceWindows = []v1alpha1.MaintenanceWindow{{
+		Start: now.Add(-time.Hour).Format("15:04"),
+		End:   now.Add(2 * time.Hour).Format("15:04"),
+	}}
+
+	info := &updater.UpdateInfo{
+		HasUpdate: true,
+		Version:   "2.0.0",
+		URLs:      []string{server.URL + "/v2.0.0/"},
+		Packages:  []*omaha.Package{testPackage(data)},
+	}
+
+	release, m := app.windowRelease(ctx, info, now)
+	if release == nil || m == nil {
+		t.Fatalf("got release %v and manifest %v, want both fetched", release, m)
+	}
+
+	win, err := app.updateWindow(now, release)
+	if err != nil || win == nil {
+		t.Fatalf("got window %v, %v, want it open", win, err)
+	}
+
+	if err := app.startUpdate(ctx, info, m, win); err != nil {
+		t.Fatal(err)
+	}
+
+	if app.progress == nil || app.progress.Phase != v1alpha1.UpdatePhaseVerifying {
+		t.Fatalf("got progress %+v, want the update verifying", app.progress)
+	}
+
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("manifest downloaded %d times, want once", n)
+	}
+}
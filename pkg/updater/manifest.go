@@ -0,0 +1,550 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kinvolk/nebraska/updater"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+const (
+	// maxDownloadSize is the maximum size of an update manifest or its
+	// signature in bytes.
+	maxDownloadSize = 1 << 20
+
+	downloadTimeout = 30 * time.Second
+)
+
+var downloadHTTPClient = &http.Client{Timeout: downloadTimeout}
+
+// getUpdateManifest returns the update manifest of the update. Update URLs with
+// nua_* query parameters use the legacy format, otherwise the manifest is
+// downloaded from the update URL.
+func (app *application) getUpdateManifest(ctx context.Context, info *updater.UpdateInfo) (*v1alpha1.UpdateManifest, error) {
+	u, err := url.Parse(info.URL())
+	if err != nil {
+		return nil, withErrorCode(errorCodeManifestFetchFailed, fmt.Errorf("parsing update URL: %w", err))
+	}
+
+	if isLegacyURL(u) {
+		app.log.Debug("update URL uses the legacy format")
+
+		// Legacy update URLs are not downloaded, so there is nothing to
+		// verify a signature against.
+		if app.spec.Verification != nil {
+			return nil, &verificationError{fmt.Errorf("legacy update URLs can't be verified, publish an update manifest instead")}
+		}
+
+		m, err := legacyManifest(u)
+		if err != nil {
+			return nil, withErrorCode(errorCodeManifestInvalid, err)
+		}
+
+		return m, nil
+	}
+
+	manifestURL := getManifestURL(info)
+
+	app.log.Debugf("fetching update manifest from %s", manifestURL)
+
+	data, err := download(ctx, manifestURL)
+	if err != nil {
+		return nil, withErrorCode(errorCodeManifestFetchFailed, fmt.Errorf("fetching update manifest: %w", err))
+	}
+
+	// Nothing is decoded before the manifest is verified.
+	if err := verifyPackage(info.Package(), data); err != nil {
+		return nil, err
+	}
+
+	if err := app.verifySignature(ctx, manifestURL, data); err != nil {
+		return nil, err
+	}
+
+	m, err := parseManifest(data)
+	if err != nil {
+		return nil, withErrorCode(errorCodeManifestInvalid, err)
+	}
+
+	return m, nil
+}
+
+// isLegacyURL returns true when the URL carries the deployment instructions as
+// nua_* query parameters.
+func isLegacyURL(u *url.URL) bool {
+	for key := range u.Query() {
+		if strings.HasPrefix(key, "nua_") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getManifestURL returns the URL of the update manifest. Following the Omaha
+// protocol, the name of the package is appended to the update URL.
+func getManifestURL(info *updater.UpdateInfo) string {
+	manifestURL := info.URL()
+
+	if pkg := info.Package(); pkg != nil && pkg.Name != "" {
+		if !strings.HasSuffix(manifestURL, "/") {
+			manifestURL += "/"
+		}
+
+		manifestURL += url.PathEscape(pkg.Name)
+	}
+
+	return manifestURL
+}
+
+// download returns the contents of the given URL.
+func download(ctx context.Context, downloadURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, err := downloadHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %w", downloadURL, err)
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("requesting %s: got status %s", downloadURL, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDownloadSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	if len(data) > maxDownloadSize {
+		return nil, fmt.Errorf("response of %s is larger than %d bytes", downloadURL, maxDownloadSize)
+	}
+
+	return data, nil
+}
+
+// parseManifest strictly decodes and validates the YAML or JSON update
+// manifest.
+func parseManifest(data []byte) (*v1alpha1.UpdateManifest, error) {
+	var m v1alpha1.UpdateManifest
+
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		return nil, fmt.Errorf("decoding update manifest: %w", err)
+	}
+
+	if err := validateManifest(&m); err != nil {
+		return nil, fmt.Errorf("validating update manifest: %w", err)
+	}
+
+	return &m, nil
+}
+
+// validateManifest returns all the problems found in the update manifest.
+func validateManifest(m *v1alpha1.UpdateManifest) error {
+	var errs field.ErrorList
+
+	if m.APIVersion != v1alpha1.GroupVersion.String() {
+		errs = append(errs, field.NotSupported(field.NewPath("apiVersion"), m.APIVersion, []string{v1alpha1.GroupVersion.String()}))
+	}
+
+	if m.Kind != v1alpha1.UpdateManifestKind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), m.Kind, []string{v1alpha1.UpdateManifestKind}))
+	}
+
+	metadataPath := field.NewPath("metadata")
+
+	if m.Metadata.Name == "" {
+		errs = append(errs, field.Required(metadataPath.Child("name"), ""))
+	} else {
+		for _, msg := range validation.IsDNS1123Subdomain(m.Metadata.Name) {
+			errs = append(errs, field.Invalid(metadataPath.Child("name"), m.Metadata.Name, msg))
+		}
+	}
+
+	if m.Metadata.Namespace != "" {
+		for _, msg := range validation.IsDNS1123Label(m.Metadata.Namespace) {
+			errs = append(errs, field.Invalid(metadataPath.Child("namespace"), m.Metadata.Namespace, msg))
+		}
+	}
+
+	errs = append(errs, validateManifestSpec(&m.Spec, field.NewPath("spec"))...)
+
+	return errs.ToAggregate()
+}
+
+func validateManifestSpec(spec *v1alpha1.UpdateManifestSpec, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	sourcePath := fldPath.Child("source")
+	source := spec.Source
+	sources := 0
+
+	if source.Git != nil {
+		sources++
+
+		errs = append(errs, validateGitSource(source.Git, sourcePath.Child("git"))...)
+	}
+
+	if source.OCI != nil {
+		sources++
+
+		ociPath := sourcePath.Child("oci")
+
+		if !strings.HasPrefix(source.OCI.URL, "oci://") {
+			errs = append(errs, field.Invalid(ociPath.Child("url"), source.OCI.URL, "must start with oci://"))
+		}
+
+		if (source.OCI.Digest == "") == (source.OCI.Tag == "") {
+			errs = append(errs, field.Invalid(ociPath, "", "exactly one of digest and tag is required"))
+		}
+	}
+
+	if source.Bucket != nil {
+		sources++
+
+		if source.Bucket.Endpoint == "" {
+			errs = append(errs, field.Required(sourcePath.Child("bucket", "endpoint"), ""))
+		}
+
+		if source.Bucket.BucketName == "" {
+			errs = append(errs, field.Required(sourcePath.Child("bucket", "bucketName"), ""))
+		}
+	}
+
+	if source.HelmRepository != nil {
+		sources++
+
+		if source.HelmRepository.URL == "" {
+			errs = append(errs, field.Required(sourcePath.Child("helmRepository", "url"), ""))
+		}
+	}
+
+	if sources != 1 {
+		errs = append(errs, field.Invalid(sourcePath, "", "exactly one of git, oci, bucket and helmRepository is required"))
+	}
+
+	switch {
+	case spec.Kustomization != nil && spec.HelmRelease != nil:
+		errs = append(errs, field.Invalid(fldPath, "", "only one of kustomization and helmRelease can be given"))
+	case spec.Kustomization != nil:
+		if source.HelmRepository != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("kustomization"), "", "can't deploy a helmRepository source"))
+		}
+	case spec.HelmRelease != nil:
+		if source.HelmRepository == nil {
+			errs = append(errs, field.Invalid(fldPath.Child("helmRelease"), "", "requires a helmRepository source"))
+		}
+
+		if spec.HelmRelease.Chart.Spec.Chart == "" {
+			errs = append(errs, field.Required(fldPath.Child("helmRelease", "chart", "spec", "chart"), ""))
+		}
+	default:
+		errs = append(errs, field.Required(fldPath, "one of kustomization and helmRelease is required"))
+	}
+
+	return errs
+}
+
+// gitURLSchemes are the schemes of Git repository URLs supported by Flux.
+var gitURLSchemes = []string{"http", "https", "ssh"}
+
+func validateGitSource(source *v1alpha1.GitSource, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	urlPath := fldPath.Child("url")
+
+	if source.URL == "" {
+		return append(errs, field.Required(urlPath, ""))
+	}
+
+	u, err := url.Parse(source.URL)
+	if err != nil {
+		return append(errs, field.Invalid(urlPath, source.URL, err.Error()))
+	}
+
+	if !sets.NewString(gitURLSchemes...).Has(u.Scheme) {
+		errs = append(errs, field.NotSupported(urlPath.Child("scheme"), u.Scheme, gitURLSchemes))
+	}
+
+	if u.Host == "" {
+		errs = append(errs, field.Invalid(urlPath, source.URL, "must have a host"))
+	}
+
+	secretPath := fldPath.Child("secretRef", "name")
+
+	switch {
+	case source.SecretRef == nil:
+		if u.Scheme == "ssh" {
+			errs = append(errs, field.Required(secretPath, "SSH repositories require a Secret with the identity and known_hosts"))
+		}
+	case source.SecretRef.Name == "":
+		errs = append(errs, field.Required(secretPath, ""))
+	default:
+		for _, msg := range validation.IsDNS1123Subdomain(source.SecretRef.Name) {
+			errs = append(errs, field.Invalid(secretPath, source.SecretRef.Name, msg))
+		}
+	}
+
+	return append(errs, validateGitRepositorySpec(&source.GitRepositorySpec, fldPath)...)
+}
+
+// gitImplementations are the Git clients supported by Flux.
+var gitImplementations = []string{sourceapi.GoGitImplementation, sourceapi.LibGit2Implementation}
+
+// validateGitRepositorySpec validates the fields of the GitRepository spec
+// besides the URL and the Secret.
+func validateGitRepositorySpec(spec *sourceapi.GitRepositorySpec, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	if spec.Interval.Duration < 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("interval"), spec.Interval.Duration.String(), "must not be negative"))
+	}
+
+	if spec.Timeout != nil && spec.Timeout.Duration <= 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("timeout"), spec.Timeout.Duration.String(), "must be positive"))
+	}
+
+	if ref := spec.Reference; ref != nil {
+		refs := 0
+
+		for _, value := range []string{ref.Tag, ref.SemVer, ref.Commit} {
+			if value != "" {
+				refs++
+			}
+		}
+
+		if refs > 1 {
+			errs = append(errs, field.Invalid(fldPath.Child("ref"), "", "only one of tag, semver and commit can be given"))
+		}
+	}
+
+	if v := spec.Verification; v != nil {
+		if v.Mode != "head" {
+			errs = append(errs, field.NotSupported(fldPath.Child("verify", "mode"), v.Mode, []string{"head"}))
+		}
+
+		if v.SecretRef.Name == "" {
+			errs = append(errs, field.Required(fldPath.Child("verify", "secretRef", "name"), ""))
+		}
+	}
+
+	// A suspended source never becomes ready.
+	if spec.Suspend {
+		errs = append(errs, field.Forbidden(fldPath.Child("suspend"), "updates can't suspend the source"))
+	}
+
+	if spec.GitImplementation != "" && !sets.NewString(gitImplementations...).Has(spec.GitImplementation) {
+		errs = append(errs, field.NotSupported(fldPath.Child("gitImplementation"), spec.GitImplementation, gitImplementations))
+	}
+
+	if spec.RecurseSubmodules && spec.GitImplementation == sourceapi.LibGit2Implementation {
+		errs = append(errs, field.Invalid(fldPath.Child("recurseSubmodules"), true, "only supported by the go-git implementation"))
+	}
+
+	for i, include := range spec.Include {
+		if include.GitRepositoryRef.Name == "" {
+			errs = append(errs, field.Required(fldPath.Child("include").Index(i).Child("repository", "name"), ""))
+		}
+	}
+
+	return errs
+}
+
+// legacyManifest converts an update URL using the legacy query parameter format
+// into an update manifest. For example:
+// https://github.com/surajssd/test-flux?nua_commit=OWZmZWYxOTY5Njc3MDU3ZTIxZGZlOTlhY2NiZjIyZjM0M2Y5NjMwMA%3D%3D&nua_kustomize_config=CnNwZWM6CiAgaW50ZXJ2YWw6IDE1bQogIHBhdGg6ICIuL2s4cyIKICBwcnVuZTogdHJ1ZQogIHNvdXJjZVJlZjoKICAgIGtpbmQ6IEdpdFJlcG9zaXRvcnkKICAgIG5hbWU6IG15LWFwcAoK&nua_namespace=bmV3
+func legacyManifest(u *url.URL) (*v1alpha1.UpdateManifest, error) {
+	m := &v1alpha1.UpdateManifest{
+		APIVersion: v1alpha1.GroupVersion.String(),
+		Kind:       v1alpha1.UpdateManifestKind,
+	}
+
+	// Get namespace and the Kustomization or HelmRelease spec config from the URL.
+	encodedNamespace := u.Query().Get("nua_namespace")
+	encodedKustomizeCfg := u.Query().Get("nua_kustomize_config")
+	encodedHelmReleaseCfg := u.Query().Get("nua_helm_release")
+
+	// The namespace may be given by the NebraskaApplication instead.
+	if encodedNamespace != "" {
+		namespace, err := base64Decode(encodedNamespace)
+		if err != nil {
+			return nil, fmt.Errorf("decoding repo sub-path: %w", err)
+		}
+
+		m.Metadata.Namespace = namespace
+	}
+
+	// A HelmRelease config means the URL points to a Helm repository.
+	if encodedHelmReleaseCfg != "" {
+		helmReleaseCfg, err := base64Decode(encodedHelmReleaseCfg)
+		if err != nil {
+			return nil, fmt.Errorf("decoding HelmRelease config: %w", err)
+		}
+
+		pkg, err := parseHelmReleaseConfig(helmReleaseCfg)
+		if err != nil {
+			return nil, fmt.Errorf("parsing HelmRelease config: %w", err)
+		}
+
+		m.Metadata.Name = pkg.Spec.Chart.Spec.SourceRef.Name
+		m.Spec.HelmRelease = pkg.Spec
+		m.Spec.Source.HelmRepository = &v1alpha1.HelmRepositorySource{
+			URL: legacySourceURL(u),
+		}
+	} else {
+		kustomizeCfg, err := base64Decode(encodedKustomizeCfg)
+		if err != nil {
+			return nil, fmt.Errorf("decoding kustomize config: %w", err)
+		}
+
+		// Convert the YAML string into object.
+		pkg, err := parseKustomizeConfig(kustomizeCfg)
+		if err != nil {
+			return nil, fmt.Errorf("parsing kustomize config: %w", err)
+		}
+
+		if pkg.Spec == nil {
+			return nil, fmt.Errorf("kustomize config has no spec")
+		}
+
+		m.Metadata.Name = pkg.Spec.SourceRef.Name
+		m.Spec.Kustomization = pkg.Spec
+
+		if err := legacySource(u, &m.Spec.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateManifest(m); err != nil {
+		return nil, fmt.Errorf("validating update URL: %w", err)
+	}
+
+	return m, nil
+}
+
+// legacySource converts the update URL into the source of the Kustomization:
+//   - oci://registry.example.com/my-app with nua_oci_digest or nua_oci_tag is
+//     an OCI repository,
+//   - a URL with nua_bucket is a bucket of an S3 compatible endpoint, the path
+//     of the URL is the prefix inside the bucket,
+//   - any other URL is a Git repository checked out at nua_commit, using the
+//     credentials of the Secret named by nua_secret.
+func legacySource(u *url.URL, source *v1alpha1.UpdateSource) error {
+	insecure, err := decodeInsecure(u)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case u.Scheme == "oci":
+		source.OCI = &v1alpha1.OCISource{
+			URL:      "oci://" + path.Join(u.Host, u.Path),
+			Insecure: insecure,
+		}
+
+		if encodedDigest := u.Query().Get("nua_oci_digest"); encodedDigest != "" {
+			if source.OCI.Digest, err = base64Decode(encodedDigest); err != nil {
+				return fmt.Errorf("decoding digest: %w", err)
+			}
+		}
+
+		if encodedTag := u.Query().Get("nua_oci_tag"); encodedTag != "" {
+			if source.OCI.Tag, err = base64Decode(encodedTag); err != nil {
+				return fmt.Errorf("decoding tag: %w", err)
+			}
+		}
+	case u.Query().Get("nua_bucket") != "":
+		bucketName, err := base64Decode(u.Query().Get("nua_bucket"))
+		if err != nil {
+			return fmt.Errorf("decoding bucket name: %w", err)
+		}
+
+		source.Bucket = &v1alpha1.BucketSource{
+			Endpoint:   u.Host,
+			BucketName: bucketName,
+			Prefix:     strings.Trim(u.Path, "/"),
+			Insecure:   insecure,
+		}
+	default:
+		commit, err := base64Decode(u.Query().Get("nua_commit"))
+		if err != nil {
+			return fmt.Errorf("decoding commit: %w", err)
+		}
+
+		source.Git = &v1alpha1.GitSource{
+			GitRepositorySpec: sourceapi.GitRepositorySpec{
+				URL: legacySourceURL(u),
+				Reference: &sourceapi.GitRepositoryRef{
+					Commit: commit,
+				},
+			},
+		}
+
+		if encodedSecret := u.Query().Get("nua_secret"); encodedSecret != "" {
+			secret, err := base64Decode(encodedSecret)
+			if err != nil {
+				return fmt.Errorf("decoding secret: %w", err)
+			}
+
+			source.Git.SecretRef = &meta.LocalObjectReference{Name: secret}
+		}
+	}
+
+	return nil
+}
+
+// legacySourceURL returns the URL of the Git or Helm repository without the
+// nua_* query parameters, e.g. ssh://git@github.com:22/surajssd/test-flux for
+// ssh://git@github.com:22/surajssd/test-flux?nua_commit=...
+func legacySourceURL(u *url.URL) string {
+	gitURL := *u
+	query := u.Query()
+
+	for key := range query {
+		if strings.HasPrefix(key, "nua_") {
+			query.Del(key)
+		}
+	}
+
+	gitURL.RawQuery = query.Encode()
+	gitURL.Fragment = ""
+
+	return gitURL.String()
+}
+
+// decodeInsecure returns whether nua_insecure allows plain HTTP connections to
+// the source.
+func decodeInsecure(u *url.URL) (bool, error) {
+	encodedInsecure := u.Query().Get("nua_insecure")
+	if encodedInsecure == "" {
+		return false, nil
+	}
+
+	insecure, err := base64Decode(encodedInsecure)
+	if err != nil {
+		return false, fmt.Errorf("decoding insecure: %w", err)
+	}
+
+	return insecure == "true", nil
+}
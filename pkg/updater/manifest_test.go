@@ -0,0 +1,653 @@
+package updater
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/kinvolk/go-omaha/omaha"
+	"github.com/kinvolk/nebraska/updater"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+const testManifest = `
+apiVersion: nebraska.kinvolk.io/v1alpha1
+kind: UpdateManifest
+metadata:
+  name: my-app
+  namespace: my-app
+spec:
+  source:
+    git:
+      url: https://github.com/example/my-app
+      ref:
+        commit: 9ffef1969677057e21dfe99accbf22f343f96300
+  kustomization:
+    interval: 15m
+    path: ./k8s
+    prune: true
+`
+
+const testHelmManifest = `
+apiVersion: nebraska.kinvolk.io/v1alpha1
+kind: UpdateManifest
+metadata:
+  name: my-app
+spec:
+  source:
+    helmRepository:
+      url: https://charts.example.com
+  helmRelease:
+    interval: 15m
+    chart:
+      spec:
+        chart: my-app
+        version: 1.2.3
+`
+
+// manifestWith returns the test manifest with the source replaced.
+func manifestWith(source string) string {
+	header := testManifest[:strings.Index(testManifest, "  source:\n")]
+	footer := testManifest[strings.Index(testManifest, "  kustomization:\n"):]
+
+	return header + "  source:\n" + source + footer
+}
+
+func TestParseManifest(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{
+			name: "Kustomization of a Git repository",
+			data: testManifest,
+		},
+		{
+			name: "HelmRelease of a Helm repository",
+			data: testHelmManifest,
+		},
+		{
+			name: "JSON",
+			data: `{"apiVersion": "nebraska.kinvolk.io/v1alpha1", "kind": "UpdateManifest", "metadata": {"name": "my-app"},
+				"spec": {"source": {"bucket": {"endpoint": "minio:9000", "bucketName": "releases"}}, "kustomization": {"path": "./k8s"}}}`,
+		},
+		{
+			name:    "malformed YAML",
+			data:    "apiVersion: [nebraska.kinvolk.io/v1alpha1\n",
+			wantErr: "decoding update manifest",
+		},
+		{
+			name:    "not an object",
+			data:    "- my-app\n",
+			wantErr: "decoding update manifest",
+		},
+		{
+			name:    "empty",
+			data:    "",
+			wantErr: "apiVersion: Unsupported value",
+		},
+		{
+			name:    "unknown field",
+			data:    testManifest + "status: {}\n",
+			wantErr: `unknown field "status"`,
+		},
+		{
+			name:    "unknown field of the source",
+			data:    manifestWith("    git:\n      url: https://github.com/example/my-app\n      branch: main\n"),
+			wantErr: `unknown field "branch"`,
+		},
+		{
+			name:    "duplicate field",
+			data:    testManifest + "kind: UpdateManifest\n",
+			wantErr: "decoding update manifest",
+		},
+		{
+			name:    "newer apiVersion",
+			data:    strings.Replace(testManifest, "v1alpha1", "v1beta1", 1),
+			wantErr: "apiVersion: Unsupported value",
+		},
+		{
+			name:    "other kind",
+			data:    strings.Replace(testManifest, "kind: UpdateManifest", "kind: Kustomization", 1),
+			wantErr: "kind: Unsupported value",
+		},
+		{
+			name:    "invalid name",
+			data:    strings.Replace(testManifest, "name: my-app", "name: My_App", 1),
+			wantErr: "metadata.name: Invalid value",
+		},
+		{
+			name:    "invalid namespace",
+			data:    strings.Replace(testManifest, "namespace: my-app", "namespace: my.app", 1),
+			wantErr: "metadata.namespace: Invalid value",
+		},
+		{
+			name:    "no source",
+			data:    manifestWith(""),
+			wantErr: "exactly one of git, oci, bucket and helmRepository is required",
+		},
+		{
+			name: "two sources",
+			data: manifestWith("    git:\n      url: https://github.com/example/my-app\n" +
+				"    oci:\n      url: oci://ghcr.io/example/my-app\n      tag: v1.2.3\n"),
+			wantErr: "exactly one of git, oci, bucket and helmRepository is required",
+		},
+		{
+			name:    "OCI repository without oci scheme",
+			data:    manifestWith("    oci:\n      url: https://ghcr.io/example/my-app\n      tag: v1.2.3\n"),
+			wantErr: "must start with oci://",
+		},
+		{
+			name:    "OCI repository with digest and tag",
+			data:    manifestWith("    oci:\n      url: oci://ghcr.io/example/my-app\n      tag: v1.2.3\n      digest: sha256:2e8a3b\n"),
+			wantErr: "exactly one of digest and tag is required",
+		},
+		{
+			name:    "bucket without name",
+			data:    manifestWith("    bucket:\n      endpoint: minio:9000\n"),
+			wantErr: "spec.source.bucket.bucketName: Required value",
+		},
+		{
+			name:    "no release",
+			data:    testManifest[:strings.Index(testManifest, "  kustomization:\n")],
+			wantErr: "one of kustomization and helmRelease is required",
+		},
+		{
+			name:    "Kustomization of a Helm repository",
+			data:    manifestWith("    helmRepository:\n      url: https://charts.example.com\n"),
+			wantErr: "can't deploy a helmRepository source",
+		},
+		{
+			name:    "HelmRelease of a Git repository",
+			data:    strings.Replace(testHelmManifest, "helmRepository:\n      url: https://charts.example.com", "git:\n      url: https://github.com/example/my-app", 1),
+			wantErr: "requires a helmRepository source",
+		},
+		{
+			name:    "HelmRelease without chart",
+			data:    strings.Replace(testHelmManifest, "        chart: my-app\n", "", 1),
+			wantErr: "spec.helmRelease.chart.spec.chart: Required value",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := parseManifest([]byte(tc.data))
+
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if m.Metadata.Name != "my-app" {
+					t.Errorf("got name %q", m.Metadata.Name)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateGitSource(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		source  string
+		wantErr string
+	}{
+		{
+			name:   "SSH with Secret",
+			source: "url: ssh://git@github.com:22/example/my-app\nsecretRef:\n  name: my-app-git",
+		},
+		{
+			name:   "semver with branch and submodules",
+			source: "url: https://github.com/example/my-app\nref:\n  branch: main\n  semver: '>=1.0.0'\nrecurseSubmodules: true",
+		},
+		{
+			name:    "no URL",
+			source:  "interval: 5m",
+			wantErr: "spec.source.git.url: Required value",
+		},
+		{
+			name:    "unsupported scheme",
+			source:  "url: git://github.com/example/my-app",
+			wantErr: `spec.source.git.url.scheme: Unsupported value: "git"`,
+		},
+		{
+			name:    "no host",
+			source:  "url: https:///example/my-app",
+			wantErr: "must have a host",
+		},
+		{
+			name:    "SSH without Secret",
+			source:  "url: ssh://git@github.com/example/my-app",
+			wantErr: "spec.source.git.secretRef.name: Required value",
+		},
+		{
+			name:    "invalid Secret name",
+			source:  "url: https://github.com/example/my-app\nsecretRef:\n  name: My_Secret",
+			wantErr: "spec.source.git.secretRef.name: Invalid value",
+		},
+		{
+			name:    "negative interval",
+			source:  "url: https://github.com/example/my-app\ninterval: -5m",
+			wantErr: "spec.source.git.interval: Invalid value",
+		},
+		{
+			name:    "zero timeout",
+			source:  "url: https://github.com/example/my-app\ntimeout: 0s",
+			wantErr: "spec.source.git.timeout: Invalid value",
+		},
+		{
+			name:    "tag and commit",
+			source:  "url: https://github.com/example/my-app\nref:\n  tag: v1.2.3\n  commit: 9ffef19",
+			wantErr: "only one of tag, semver and commit can be given",
+		},
+		{
+			name:    "verify without Secret",
+			source:  "url: https://github.com/example/my-app\nverify:\n  mode: head\n  secretRef:\n    name: ''",
+			wantErr: "spec.source.git.verify.secretRef.name: Required value",
+		},
+		{
+			name:    "verify mode",
+			source:  "url: https://github.com/example/my-app\nverify:\n  mode: tag\n  secretRef:\n    name: keys",
+			wantErr: `spec.source.git.verify.mode: Unsupported value: "tag"`,
+		},
+		{
+			name:    "suspended",
+			source:  "url: https://github.com/example/my-app\nsuspend: true",
+			wantErr: "spec.source.git.suspend: Forbidden",
+		},
+		{
+			name:    "unknown Git implementation",
+			source:  "url: https://github.com/example/my-app\ngitImplementation: git",
+			wantErr: `spec.source.git.gitImplementation: Unsupported value: "git"`,
+		},
+		{
+			name:    "submodules with libgit2",
+			source:  "url: https://github.com/example/my-app\ngitImplementation: libgit2\nrecurseSubmodules: true",
+			wantErr: "only supported by the go-git implementation",
+		},
+		{
+			name:    "include without repository",
+			source:  "url: https://github.com/example/my-app\ninclude:\n- repository:\n    name: ''",
+			wantErr: "spec.source.git.include[0].repository.name: Required value",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			source := "    git:\n      " + strings.ReplaceAll(tc.source, "\n", "\n      ") + "\n"
+
+			_, err := parseManifest([]byte(manifestWith(source)))
+
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func b64(value string) string {
+	return url.QueryEscape(base64.StdEncoding.EncodeToString([]byte(value)))
+}
+
+func TestLegacyManifest(t *testing.T) {
+	kustomizeConfig := b64("spec:\n  interval: 15m\n  path: ./k8s\n  sourceRef:\n    kind: GitRepository\n    name: my-app\n")
+
+	for _, tc := range []struct {
+		name    string
+		url     string
+		check   func(t *testing.T, m *v1alpha1.UpdateManifest)
+		wantErr string
+	}{
+		{
+			name: "Git repository",
+			url: "https://github.com/example/my-app?nua_commit=" + b64("9ffef19") + "&nua_namespace=" + b64("my-ns") +
+				"&nua_secret=" + b64("my-app-git") + "&nua_kustomize_config=" + kustomizeConfig,
+			check: func(t *testing.T, m *v1alpha1.UpdateManifest) {
+				git := m.Spec.Source.Git
+				if git == nil {
+					t.Fatal("no Git source")
+				}
+
+				if git.URL != "https://github.com/example/my-app" {
+					t.Errorf("got URL %q, the nua_* parameters should be removed", git.URL)
+				}
+
+				if git.Reference.Commit != "9ffef19" || git.SecretRef.Name != "my-app-git" {
+					t.Errorf("got commit %q and Secret %v", git.Reference.Commit, git.SecretRef)
+				}
+
+				if m.Metadata.Name != "my-app" || m.Metadata.Namespace != "my-ns" || m.Spec.Kustomization.Path != "./k8s" {
+					t.Errorf("got metadata %+v and Kustomization %+v", m.Metadata, m.Spec.Kustomization)
+				}
+			},
+		},
+		{
+			name: "SSH Git repository keeps other query parameters",
+			url: "ssh://git@github.com:22/example/my-app?depth=1&nua_commit=" + b64("9ffef19") +
+				"&nua_secret=" + b64("my-app-git") + "&nua_kustomize_config=" + kustomizeConfig,
+			check: func(t *testing.T, m *v1alpha1.UpdateManifest) {
+				if got := m.Spec.Source.Git.URL; got != "ssh://git@github.com:22/example/my-app?depth=1" {
+					t.Errorf("got URL %q", got)
+				}
+			},
+		},
+		{
+			name: "OCI repository",
+			url:  "oci://ghcr.io/example/my-app?nua_oci_tag=" + b64("v1.2.3") + "&nua_insecure=" + b64("true") + "&nua_kustomize_config=" + kustomizeConfig,
+			check: func(t *testing.T, m *v1alpha1.UpdateManifest) {
+				oci := m.Spec.Source.OCI
+				if oci == nil || oci.URL != "oci://ghcr.io/example/my-app" || oci.Tag != "v1.2.3" || !oci.Insecure {
+					t.Errorf("got OCI source %+v", oci)
+				}
+			},
+		},
+		{
+			name: "bucket",
+			url:  "https://minio.example.com:9000/my-app/v1.2.3/?nua_bucket=" + b64("releases") + "&nua_kustomize_config=" + kustomizeConfig,
+			check: func(t *testing.T, m *v1alpha1.UpdateManifest) {
+				bucket := m.Spec.Source.Bucket
+				if bucket == nil || bucket.Endpoint != "minio.example.com:9000" || bucket.BucketName != "releases" ||
+					bucket.Prefix != "my-app/v1.2.3" || bucket.Insecure {
+					t.Errorf("got bucket source %+v", bucket)
+				}
+			},
+		},
+		{
+			name: "Helm repository",
+			url: "https://charts.example.com/stable?nua_helm_release=" +
+				b64("spec:\n  chart:\n    spec:\n      chart: my-app\n      version: 1.2.3\n      sourceRef:\n        kind: HelmRepository\n        name: my-app\n"),
+			check: func(t *testing.T, m *v1alpha1.UpdateManifest) {
+				if repo := m.Spec.Source.HelmRepository; repo == nil || repo.URL != "https://charts.example.com/stable" {
+					t.Errorf("got Helm repository %+v", repo)
+				}
+
+				if m.Spec.HelmRelease.Chart.Spec.Version != "1.2.3" {
+					t.Errorf("got HelmRelease %+v", m.Spec.HelmRelease)
+				}
+			},
+		},
+		{
+			name: "Helm repository keeps port and other query parameters",
+			url: "http://charts.example.com:8080/stable?channel=beta&nua_helm_release=" +
+				b64("spec:\n  chart:\n    spec:\n      chart: my-app\n      sourceRef:\n        kind: HelmRepository\n        name: my-app\n        namespace: flux-system\n"),
+			check: func(t *testing.T, m *v1alpha1.UpdateManifest) {
+				if got := m.Spec.Source.HelmRepository.URL; got != "http://charts.example.com:8080/stable?channel=beta" {
+					t.Errorf("got URL %q", got)
+				}
+			},
+		},
+		{
+			name:    "no commit",
+			url:     "https://github.com/example/my-app?nua_kustomize_config=" + kustomizeConfig,
+			wantErr: "decoding commit: got empty string",
+		},
+		{
+			name:    "invalid base64",
+			url:     "https://github.com/example/my-app?nua_commit=not-base64!&nua_kustomize_config=" + kustomizeConfig,
+			wantErr: "decoding commit",
+		},
+		{
+			name:    "no kustomize config",
+			url:     "https://github.com/example/my-app?nua_commit=" + b64("9ffef19"),
+			wantErr: "decoding kustomize config",
+		},
+		{
+			name:    "kustomize config without spec",
+			url:     "https://github.com/example/my-app?nua_commit=" + b64("9ffef19") + "&nua_kustomize_config=" + b64("path: ./k8s\n"),
+			wantErr: "kustomize config has no spec",
+		},
+		{
+			name:    "HelmRelease config without spec",
+			url:     "https://charts.example.com?nua_helm_release=" + b64("chart: my-app\n"),
+			wantErr: "HelmRelease config has no spec",
+		},
+		{
+			name:    "invalid insecure",
+			url:     "oci://ghcr.io/example/my-app?nua_oci_tag=" + b64("v1.2.3") + "&nua_insecure=yes!&nua_kustomize_config=" + kustomizeConfig,
+			wantErr: "decoding insecure",
+		},
+		{
+			name:    "invalid result",
+			url:     "oci://ghcr.io/example/my-app?nua_kustomize_config=" + kustomizeConfig,
+			wantErr: "exactly one of digest and tag is required",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !isLegacyURL(u) {
+				t.Fatal("not detected as a legacy URL")
+			}
+
+			m, err := legacyManifest(u)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			tc.check(t, m)
+		})
+	}
+}
+
+func TestGenerateConfigsSetsChartSource(t *testing.T) {
+	data := strings.Replace(testHelmManifest, "        version: 1.2.3\n",
+		"        version: 1.2.3\n        sourceRef:\n          kind: HelmRepository\n          name: charts\n          namespace: flux-system\n", 1)
+
+	m, err := parseManifest([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{log: log.WithField("test", t.Name())}
+	app.spec.TargetNamespace = "my-app"
+
+	if err := app.generateConfigs(m); err != nil {
+		t.Fatal(err)
+	}
+
+	release, ok := app.release.(*helmapi.HelmRelease)
+	if !ok {
+		t.Fatalf("got release %T, want a HelmRelease", app.release)
+	}
+
+	// The chart is fetched from the HelmRepository of the update, not the one
+	// named in the manifest.
+	want := helmapi.CrossNamespaceObjectReference{Kind: sourceapi.HelmRepositoryKind, Name: "my-app"}
+	if got := release.Spec.Chart.Spec.SourceRef; got != want {
+		t.Errorf("got chart source %+v, want %+v", got, want)
+	}
+
+	if refOf(app.source) != (objectRef{kind: sourceapi.HelmRepositoryKind, namespace: "my-app", name: "my-app"}) {
+		t.Errorf("got source %s %s/%s", kindOf(app.source), app.source.GetNamespace(), app.source.GetName())
+	}
+}
+
+func TestDecodeInsecure(t *testing.T) {
+	for query, want := range map[string]bool{
+		"":                                 false,
+		"nua_insecure=" + b64("true"):      true,
+		"nua_insecure=" + b64("false"):     false,
+		"nua_insecure=" + b64("TRUE"):      false,
+		"other=1&nua_insecure=" + b64("1"): false,
+	} {
+		got, err := decodeInsecure(&url.URL{RawQuery: query})
+		if err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+
+		if got != want {
+			t.Errorf("%q: got %t, want %t", query, got, want)
+		}
+	}
+}
+
+// testPackage returns the Omaha package of the data.
+func testPackage(data []byte) *omaha.Package {
+	hash := sha256.Sum256(data)
+
+	return &omaha.Package{Name: "manifest.yaml", SHA256: hex.EncodeToString(hash[:]), Size: uint64(len(data))}
+}
+
+func TestGetUpdateManifest(t *testing.T) {
+	large := []byte(testManifest + "#" + strings.Repeat("x", maxDownloadSize) + "\n")
+
+	files := map[string][]byte{
+		"/v1.2.3/manifest.yaml":  []byte(testManifest),
+		"/invalid/manifest.yaml": []byte(testManifest + "status: {}\n"),
+		"/large/manifest.yaml":   large,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	legacyURL := "https://github.com/example/my-app?nua_commit=" + b64("9ffef19") + "&nua_kustomize_config=" +
+		b64("spec:\n  path: ./k8s\n  sourceRef:\n    kind: GitRepository\n    name: my-app\n")
+
+	for _, tc := range []struct {
+		name         string
+		url          string
+		pkg          *omaha.Package
+		verification *v1alpha1.Verification
+		wantErr      string
+		wantCode     int
+	}{
+		{
+			name: "manifest",
+			url:  server.URL + "/v1.2.3/",
+			pkg:  testPackage([]byte(testManifest)),
+		},
+		{
+			name: "legacy URL",
+			url:  legacyURL,
+		},
+		{
+			name:         "legacy URL with verification",
+			url:          legacyURL,
+			verification: &v1alpha1.Verification{},
+			wantErr:      "legacy update URLs can't be verified",
+			wantCode:     errorCodeVerificationFailed,
+		},
+		{
+			name:     "not found",
+			url:      server.URL + "/v1.2.4/",
+			pkg:      testPackage([]byte(testManifest)),
+			wantErr:  "404 Not Found",
+			wantCode: errorCodeManifestFetchFailed,
+		},
+		{
+			name:     "larger than 1 MiB",
+			url:      server.URL + "/large/",
+			pkg:      testPackage(large),
+			wantErr:  "larger than 1048576 bytes",
+			wantCode: errorCodeManifestFetchFailed,
+		},
+		{
+			name:     "other size",
+			url:      server.URL + "/v1.2.3/",
+			pkg:      testPackage([]byte(testHelmManifest)),
+			wantErr:  "bytes, got",
+			wantCode: errorCodeVerificationFailed,
+		},
+		{
+			name:     "tampered manifest",
+			url:      server.URL + "/v1.2.3/",
+			pkg:      &omaha.Package{Name: "manifest.yaml", SHA256: testPackage([]byte(testHelmManifest)).SHA256},
+			wantErr:  "expected SHA-256",
+			wantCode: errorCodeVerificationFailed,
+		},
+		{
+			name:     "no hash",
+			url:      server.URL + "/v1.2.3/",
+			pkg:      &omaha.Package{Name: "manifest.yaml"},
+			wantErr:  "no SHA-256 hash",
+			wantCode: errorCodeVerificationFailed,
+		},
+		{
+			name:     "unknown field",
+			url:      server.URL + "/invalid/",
+			pkg:      testPackage(files["/invalid/manifest.yaml"]),
+			wantErr:  `unknown field "status"`,
+			wantCode: errorCodeManifestInvalid,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := &application{log: log.WithField("test", t.Name())}
+			app.spec.Verification = tc.verification
+
+			info := &updater.UpdateInfo{URLs: []string{tc.url}}
+			if tc.pkg != nil {
+				info.Packages = []*omaha.Package{tc.pkg}
+			}
+
+			m, err := app.getUpdateManifest(context.Background(), info)
+
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if m.Spec.Source.Git == nil {
+					t.Errorf("got manifest %+v", m)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+
+			if code := errorCodeOf(err); code != tc.wantCode {
+				t.Errorf("got error code %d, want %d", code, tc.wantCode)
+			}
+
+			var verifyErr *verificationError
+			if isVerifyErr := errors.As(err, &verifyErr); isVerifyErr != (tc.wantCode == errorCodeVerificationFailed) {
+				t.Errorf("verification error: got %t", isVerifyErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package updater
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const metricsNamespace = "nua"
+
+// Results of an update check.
+const (
+	checkResultNoUpdate = "no_update"
+	checkResultUpdate   = "update"
+	checkResultError    = "error"
+)
+
+// Phases of an update.
+const (
+	phaseFetch     = "fetch"
+	phaseApply     = "apply"
+	phaseReadiness = "readiness"
+)
+
+// Results of a rollback.
+const (
+	rollbackResultSucceeded = "succeeded"
+	rollbackResultFailed    = "failed"
+)
+
+// appLabels identify the NebraskaApplication of a metric.
+var appLabels = []string{"namespace", "name"}
+
+var (
+	updateChecksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "update_checks_total",
+		Help:      "Number of update checks with Nebraska by result.",
+	}, append(appLabels, "result"))
+
+	updateCheckDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "update_check_duration_seconds",
+		Help:      "Duration of update checks with Nebraska by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, append(appLabels, "result"))
+
+	lastSuccessfulCheck = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_successful_check_timestamp_seconds",
+		Help:      "Unix time of the last successful update check with Nebraska.",
+	}, appLabels)
+
+	installedVersionInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "installed_version_info",
+		Help:      "Version of the application installed by the agent.",
+	}, append(appLabels, "app_id", "version"))
+
+	updatePhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "update_phase_duration_seconds",
+		Help:      "Duration of the phases of an update.",
+		// Waiting for readiness takes up to ten minutes.
+		Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600},
+	}, append(appLabels, "phase"))
+
+	rollbacksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rollbacks_total",
+		Help:      "Number of rollbacks of failed updates by result.",
+	}, append(appLabels, "result"))
+
+	pausedInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "paused_info",
+		Help:      "Set while updates of the application are paused, labelled with the scope and reason of the pause.",
+	}, append(appLabels, "scope", "reason"))
+
+	pendingEvents = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pending_omaha_events",
+		Help:      "Number of Omaha events waiting to be delivered to Nebraska.",
+	}, appLabels)
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		updateChecksTotal,
+		updateCheckDuration,
+		lastSuccessfulCheck,
+		installedVersionInfo,
+		updatePhaseDuration,
+		rollbacksTotal,
+		pausedInfo,
+		pendingEvents,
+	)
+}
+
+// observeCheck records the result of an update check started at start.
+func (app *application) observeCheck(result string, start time.Time) {
+	labels := []string{app.key.Namespace, app.key.Name, result}
+
+	updateChecksTotal.WithLabelValues(labels...).Inc()
+	updateCheckDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+
+	if result != checkResultError {
+		lastSuccessfulCheck.WithLabelValues(app.key.Namespace, app.key.Name).SetToCurrentTime()
+	}
+}
+
+// observePhase records the duration of an update phase started at start.
+func (app *application) observePhase(phase string, start time.Time) {
+	updatePhaseDuration.WithLabelValues(app.key.Namespace, app.key.Name, phase).Observe(time.Since(start).Seconds())
+}
+
+// observeRollback counts a rollback with the given result.
+func (app *application) observeRollback(result string) {
+	rollbacksTotal.WithLabelValues(app.key.Namespace, app.key.Name, result).Inc()
+}
+
+// setVersionMetric replaces the installed version of the application.
+func (app *application) setVersionMetric(version string) {
+	if app.versionMetric != "" {
+		installedVersionInfo.DeleteLabelValues(app.key.Namespace, app.key.Name, app.spec.AppID, app.versionMetric)
+	}
+
+	installedVersionInfo.WithLabelValues(app.key.Namespace, app.key.Name, app.spec.AppID, version).Set(1)
+	app.versionMetric = version
+}
+
+// setPauseMetric replaces the pause of the application, nil removes it.
+func (app *application) setPauseMetric(p *pause) {
+	if app.pauseMetric != nil {
+		pausedInfo.DeleteLabelValues(app.key.Namespace, app.key.Name, app.pauseMetric.scope, app.pauseMetric.reason)
+	}
+
+	if p != nil {
+		pausedInfo.WithLabelValues(app.key.Namespace, app.key.Name, p.scope, p.reason).Set(1)
+	}
+
+	app.pauseMetric = p
+}
+
+// setPendingEventsMetric updates the number of undelivered events.
+func (app *application) setPendingEventsMetric() {
+	pendingEvents.WithLabelValues(app.key.Namespace, app.key.Name).Set(float64(len(app.events)))
+}
+
+// deleteMetrics removes the metrics of a stopped application, so that
+// applications that are no longer managed are not reported.
+func (app *application) deleteMetrics() {
+	namespace, name := app.key.Namespace, app.key.Name
+
+	for _, result := range []string{checkResultNoUpdate, checkResultUpdate, checkResultError} {
+		updateChecksTotal.DeleteLabelValues(namespace, name, result)
+		updateCheckDuration.DeleteLabelValues(namespace, name, result)
+	}
+
+	for _, phase := range []string{phaseFetch, phaseApply, phaseReadiness} {
+		updatePhaseDuration.DeleteLabelValues(namespace, name, phase)
+	}
+
+	for _, result := range []string{rollbackResultSucceeded, rollbackResultFailed} {
+		rollbacksTotal.DeleteLabelValues(namespace, name, result)
+	}
+
+	lastSuccessfulCheck.DeleteLabelValues(namespace, name)
+	pendingEvents.DeleteLabelValues(namespace, name)
+
+	if app.versionMetric != "" {
+		installedVersionInfo.DeleteLabelValues(namespace, name, app.spec.AppID, app.versionMetric)
+	}
+
+	app.setPauseMetric(nil)
+}
@@ -0,0 +1,126 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Scopes of a pause.
+const (
+	pauseScopeApplication = "application"
+	pauseScopeGlobal      = "global"
+)
+
+// pauseReasonUnreadable is the reason of the pause while the pause ConfigMap
+// can't be read.
+const pauseReasonUnreadable = "pause ConfigMap can't be read"
+
+// pause is the reason updates of an application are not applied.
+type pause struct {
+	scope  string
+	reason string
+}
+
+func (p pause) String() string {
+	if p.reason == "" {
+		return fmt.Sprintf("paused (%s)", p.scope)
+	}
+
+	return fmt.Sprintf("paused (%s): %s", p.scope, p.reason)
+}
+
+// getPause returns why updates of the application are paused, or nil when
+// they are not. The NebraskaApplication pauses a single application, the pause
+// ConfigMap all of them. The pause ConfigMap is a kill switch, so when it can't
+// be read, e.g. because the agent is not allowed to or its paused key is
+// invalid, updates are paused as well and the error is returned.
+func (app *application) getPause(ctx context.Context) (*pause, error) {
+	if app.spec.Paused {
+		return &pause{scope: pauseScopeApplication, reason: app.spec.PauseReason}, nil
+	}
+
+	p, err := app.cfg.getGlobalPause(ctx)
+	if err != nil {
+		app.log.Errorf("pausing updates: %v", err)
+
+		return &pause{scope: pauseScopeGlobal, reason: pauseReasonUnreadable}, err
+	}
+
+	return p, nil
+}
+
+// getGlobalPause returns the pause set by the pause ConfigMap. Updates are
+// paused while the ConfigMap exists, unless its paused key is false.
+func (cfg *Config) getGlobalPause(ctx context.Context) (*pause, error) {
+	if cfg.PauseConfigMap.Name == "" {
+		return nil, nil
+	}
+
+	var cm corev1.ConfigMap
+	if err := cfg.client.Get(ctx, cfg.PauseConfigMap, &cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("getting pause ConfigMap %s: %w", cfg.PauseConfigMap, err)
+	}
+
+	if value, ok := cm.Data["paused"]; ok {
+		paused, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("parsing paused of ConfigMap %s: %w", cfg.PauseConfigMap, err)
+		}
+
+		if !paused {
+			return nil, nil
+		}
+	}
+
+	return &pause{scope: pauseScopeGlobal, reason: cm.Data["reason"]}, nil
+}
+
+// updatePause records changes of the pause state in the log and the metrics.
+func (app *application) updatePause(p *pause) {
+	switch {
+	case p == nil && app.paused == nil:
+		return
+	case p == nil:
+		app.log.Info("updates resumed")
+	case app.paused == nil || *app.paused != *p:
+		app.log.Infof("updates %s", p)
+	default:
+		return
+	}
+
+	app.paused = p
+	app.setPauseMetric(p)
+}
+
+// skipPausedUpdate keeps the update to the given version pending while the
+// application is paused. The error of an unreadable pause ConfigMap is returned,
+// so it is recorded in the status.
+func (app *application) skipPausedUpdate(version string, p *pause, pauseErr error) error {
+	app.pendingVersion = version
+
+	if app.pausedVersion == version {
+		return pauseErr
+	}
+
+	app.pausedVersion = version
+
+	if pauseErr != nil {
+		app.recordEvent(corev1.EventTypeWarning, eventReasonUpdatePaused, version, "not applied, updates are %s: %v", p, pauseErr)
+
+		return pauseErr
+	}
+
+	app.log.Infof("not applying update to %s, updates are %s", version, p)
+
+	app.recordEvent(corev1.EventTypeNormal, eventReasonUpdatePaused, version, "not applied, updates are %s", p)
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+// forbiddenConfigMapClient is a client that is not allowed to get ConfigMaps.
+type forbiddenConfigMapClient struct {
+	client.WithWatch
+}
+
+func (c forbiddenConfigMapClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if _, ok := obj.(*corev1.ConfigMap); ok {
+		return apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, key.Name, errors.New("not allowed"))
+	}
+
+	return c.WithWatch.Get(ctx, key, obj)
+}
+
+func TestGetPause(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		appPaused bool
+		data      map[string]string
+		noCM      bool
+		forbidden bool
+		want      *pause
+		wantErr   bool
+	}{
+		{
+			name:      "application",
+			appPaused: true,
+			noCM:      true,
+			want:      &pause{scope: pauseScopeApplication, reason: "app reason"},
+		},
+		{
+			name: "no ConfigMap",
+			noCM: true,
+		},
+		{
+			name: "ConfigMap",
+			data: map[string]string{"reason": "cluster upgrade"},
+			want: &pause{scope: pauseScopeGlobal, reason: "cluster upgrade"},
+		},
+		{
+			name: "ConfigMap paused",
+			data: map[string]string{"paused": "true"},
+			want: &pause{scope: pauseScopeGlobal},
+		},
+		{
+			name: "ConfigMap not paused",
+			data: map[string]string{"paused": "false", "reason": "cluster upgrade"},
+		},
+		{
+			name:    "ConfigMap with invalid paused",
+			data:    map[string]string{"paused": "maybe"},
+			want:    &pause{scope: pauseScopeGlobal, reason: pauseReasonUnreadable},
+			wantErr: true,
+		},
+		{
+			name:      "ConfigMap forbidden",
+			noCM:      true,
+			forbidden: true,
+			want:      &pause{scope: pauseScopeGlobal, reason: pauseReasonUnreadable},
+			wantErr:   true,
+		},
+		{
+			name:      "application and ConfigMap forbidden",
+			appPaused: true,
+			noCM:      true,
+			forbidden: true,
+			want:      &pause{scope: pauseScopeApplication, reason: "app reason"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			builder := fake.NewClientBuilder().WithScheme(scheme)
+
+			if !tc.noCM {
+				builder = builder.WithObjects(&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "nua", Name: "nua-pause"},
+					Data:       tc.data,
+				})
+			}
+
+			var c client.WithWatch = builder.Build()
+			if tc.forbidden {
+				c = forbiddenConfigMapClient{c}
+			}
+
+			app := &application{
+				cfg: &Config{
+					client:         c,
+					PauseConfigMap: types.NamespacedName{Namespace: "nua", Name: "nua-pause"},
+				},
+				log: log.WithField("test", t.Name()),
+			}
+			app.spec.Paused = tc.appPaused
+			app.spec.PauseReason = "app reason"
+
+			got, err := app.getPause(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, want error %t", err, tc.wantErr)
+			}
+
+			switch {
+			case got == nil && tc.want == nil:
+			case got == nil || tc.want == nil || *got != *tc.want:
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnreadablePauseBlocksUpdates(t *testing.T) {
+	ctx := context.Background()
+
+	app := newTestApplication(t, &fakeOmaha{version: "2.0.0"})
+	app.cfg.client = forbiddenConfigMapClient{app.cfg.client}
+	app.cfg.PauseConfigMap = types.NamespacedName{Namespace: "nua", Name: "nua-pause"}
+
+	for i := 0; i < 2; i++ {
+		err := app.reconcile(ctx)
+		if !apierrors.IsForbidden(err) {
+			t.Fatalf("check %d: got error %v, want forbidden", i, err)
+		}
+
+		if err := app.updateStatus(ctx, err); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if app.progress != nil || app.pendingVersion != "2.0.0" {
+		t.Errorf("got update %+v, pending version %q, want 2.0.0 pending", app.progress, app.pendingVersion)
+	}
+
+	var obj v1alpha1.NebraskaApplication
+	if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(obj.Status.LastError, "not allowed") {
+		t.Errorf("got last error %q, want the pause ConfigMap error", obj.Status.LastError)
+	}
+
+	// The skipped update is recorded once, with the error.
+	events := app.cfg.recorder.(*record.FakeRecorder).Events
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+
+	if event := <-events; !strings.Contains(event, eventReasonUpdatePaused) || !strings.Contains(event, "not allowed") {
+		t.Errorf("got event %q", event)
+	}
+}
@@ -0,0 +1,164 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kinvolk/nebraska/updater"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// maxEventDiffSize is the maximum size of the diff included in an event, the
+// full diff is logged.
+const maxEventDiffSize = 1024
+
+// dryRun returns true when updates of the application are only planned.
+func (app *application) dryRun() bool {
+	return app.cfg.DryRun || app.spec.DryRun
+}
+
+// planUpdate decodes the update and logs how it would change the Flux objects
+// in the cluster, without changing them or reporting to Nebraska.
+func (app *application) planUpdate(ctx context.Context, info *updater.UpdateInfo) error {
+	version := info.Version
+
+	// The plan only changes with the update.
+	if app.pendingVersion == version {
+		return nil
+	}
+
+	if err := app.getUpdateConfig(ctx, info, nil); err != nil {
+		return fmt.Errorf("getting the update config provided in Nebraska update: %w", err)
+	}
+
+	diffs, err := app.diffFluxCRs(ctx)
+	if err != nil {
+		return fmt.Errorf("comparing flux CRs: %w", err)
+	}
+
+	app.pendingVersion = version
+
+	diff := formatDiffs(diffs)
+
+	app.log.Infof("dry run, update to %s would change the Flux objects:\n%s", version, diff)
+
+	if len(diff) > maxEventDiffSize {
+		// Don't cut a character of the diff in half.
+		end := maxEventDiffSize
+		for end > 0 && !utf8.RuneStart(diff[end]) {
+			end--
+		}
+
+		diff = diff[:end] + "\n[truncated, see the agent log]"
+	}
+
+	app.recordEvent(corev1.EventTypeNormal, eventReasonUpdatePlanned, version, "dry run, not applied:\n%s", diff)
+
+	return nil
+}
+
+// objectDiff is the change the agent would make to a Flux object.
+type objectDiff struct {
+	obj     client.Object
+	created bool
+	diff    string
+}
+
+func (d objectDiff) String() string {
+	return fmt.Sprintf("%s %s/%s", kindOf(d.obj), d.obj.GetNamespace(), d.obj.GetName())
+}
+
+// diffFluxCRs returns the changes the generated Flux objects would make to the
+// objects in the cluster.
+func (app *application) diffFluxCRs(ctx context.Context) ([]objectDiff, error) {
+	var diffs []objectDiff
+
+	for _, obj := range []client.Object{app.source, app.release} {
+		current, err := app.cfg.getCached(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+
+		// The metadata set by others is kept when the object is updated.
+		desired := obj
+		if current != nil {
+			desired = obj.DeepCopyObject().(client.Object)
+			mergeMetadata(desired, current)
+		}
+
+		desiredView, err := planView(desired)
+		if err != nil {
+			return nil, err
+		}
+
+		currentView := map[string]interface{}(nil)
+
+		if current != nil {
+			if currentView, err = planView(current); err != nil {
+				return nil, err
+			}
+		}
+
+		if d := cmp.Diff(currentView, desiredView); d != "" {
+			diffs = append(diffs, objectDiff{obj: obj, created: current == nil, diff: d})
+		}
+	}
+
+	return diffs, nil
+}
+
+// formatDiffs returns the full diff of the changes.
+func formatDiffs(diffs []objectDiff) string {
+	if len(diffs) == 0 {
+		return "no changes"
+	}
+
+	var out strings.Builder
+
+	for _, d := range diffs {
+		fmt.Fprintf(&out, "%s:\n%s", d, d.diff)
+	}
+
+	return out.String()
+}
+
+// summarizeDiffs returns a one line summary of the changes.
+func summarizeDiffs(diffs []objectDiff) string {
+	if len(diffs) == 0 {
+		return "no changes"
+	}
+
+	changes := make([]string, 0, len(diffs))
+
+	for _, d := range diffs {
+		action := "update"
+		if d.created {
+			action = "create"
+		}
+
+		changes = append(changes, fmt.Sprintf("%s %s", action, d))
+	}
+
+	return strings.Join(changes, ", ")
+}
+
+// planView returns the parts of the object set by the agent, leaving out
+// e.g. the status and the metadata set by the API server.
+func planView(obj client.Object) (map[string]interface{}, error) {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, fmt.Errorf("converting %s: %w", kindOf(obj), err)
+	}
+
+	return map[string]interface{}{
+		"labels":      obj.GetLabels(),
+		"annotations": obj.GetAnnotations(),
+		"spec":        u["spec"],
+	}, nil
+}
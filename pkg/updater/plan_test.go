@@ -0,0 +1,121 @@
+package updater
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+// testLegacyURL is an update deploying a Kustomization of ./k8s from a
+// GitRepository, both named my-app in the my-app namespace.
+var testLegacyURL = "https://github.com/example/my-app?nua_commit=" + b64("9ffef19") + "&nua_namespace=" + b64("my-app") +
+	"&nua_kustomize_config=" + b64("spec:\n  path: ./k8s\n  sourceRef:\n    kind: GitRepository\n    name: my-app\n")
+
+// withFluxCluster replaces the cluster of the application with one running the
+// source- and kustomize-controller, holding its NebraskaApplication and the
+// given objects.
+func withFluxCluster(app *application, objs ...client.Object) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(sourceapi.GroupVersion.WithKind(sourceapi.GitRepositoryKind), apimeta.RESTScopeNamespace)
+	mapper.Add(kustomizeapi.GroupVersion.WithKind(kustomizeapi.KustomizationKind), apimeta.RESTScopeNamespace)
+
+	obj := &v1alpha1.NebraskaApplication{
+		ObjectMeta: metav1.ObjectMeta{Namespace: app.key.Namespace, Name: app.key.Name, Generation: 1},
+		Spec:       app.spec,
+	}
+
+	app.cfg.client = fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(mapper).WithObjects(append(objs, obj)...).Build()
+	app.cfg.changes = newChangeNotifier()
+}
+
+// fluxObjects returns the GitRepositories and Kustomizations in the cluster.
+func fluxObjects(t *testing.T, app *application) ([]sourceapi.GitRepository, []kustomizeapi.Kustomization) {
+	t.Helper()
+
+	var (
+		repositories   sourceapi.GitRepositoryList
+		kustomizations kustomizeapi.KustomizationList
+	)
+
+	if err := app.cfg.client.List(context.Background(), &repositories); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.cfg.client.List(context.Background(), &kustomizations); err != nil {
+		t.Fatal(err)
+	}
+
+	return repositories.Items, kustomizations.Items
+}
+
+func TestDryRunDoesNotWriteFluxObjects(t *testing.T) {
+	ctx := context.Background()
+
+	// The previous version deploys ./v1.
+	installed := &kustomizeapi.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "my-app", Name: "my-app", ResourceVersion: "1"},
+		Spec: kustomizeapi.KustomizationSpec{
+			Path:      "./v1",
+			SourceRef: kustomizeapi.CrossNamespaceSourceReference{Kind: sourceapi.GitRepositoryKind, Name: "my-app"},
+		},
+	}
+
+	server := &fakeOmaha{version: "2.0.0", url: testLegacyURL}
+
+	app := newTestApplication(t, server)
+	app.spec.DryRun = true
+	withFluxCluster(app, installed)
+
+	for i := 0; i < 2; i++ {
+		if err := app.reconcile(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repositories, kustomizations := fluxObjects(t, app)
+
+	if len(repositories) != 0 {
+		t.Errorf("dry run created %d GitRepositories", len(repositories))
+	}
+
+	if len(kustomizations) != 1 || kustomizations[0].Spec.Path != "./v1" || kustomizations[0].ResourceVersion != "1" {
+		t.Errorf("dry run changed the Kustomizations: %+v", kustomizations)
+	}
+
+	if app.progress != nil || app.pendingVersion != "2.0.0" {
+		t.Errorf("got update %+v and pending version %q, want 2.0.0 planned", app.progress, app.pendingVersion)
+	}
+
+	// The plan is recorded once, and nothing is reported to Nebraska.
+	events := app.cfg.recorder.(*record.FakeRecorder).Events
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+
+	event := <-events
+	for _, want := range []string{eventReasonUpdatePlanned, "GitRepository my-app/my-app:", "Kustomization my-app/my-app:", "./k8s"} {
+		if !strings.Contains(event, want) {
+			t.Errorf("got event %q, want %q in it", event, want)
+		}
+	}
+
+	if !utf8.ValidString(event) {
+		t.Errorf("got event with invalid UTF-8 %q", event)
+	}
+
+	if len(server.events) != 0 {
+		t.Errorf("got %d Omaha events, want none", len(server.events))
+	}
+}
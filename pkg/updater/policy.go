@@ -0,0 +1,110 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/blang/semver/v4"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// checkVersionPolicy returns an error when the update to the given version is
+// not allowed by the version policy of the application.
+func (app *application) checkVersionPolicy(version string) error {
+	policy := app.spec.VersionPolicy
+	if policy == nil {
+		return nil
+	}
+
+	v, err := semver.ParseTolerant(version)
+	if err != nil {
+		return fmt.Errorf("parsing version %s: %w", version, err)
+	}
+
+	if len(v.Pre) > 0 && !policy.AllowPrerelease {
+		return fmt.Errorf("%s is a pre-release version", version)
+	}
+
+	if !policy.AllowDowngrade {
+		current, err := semver.ParseTolerant(app.currentVersion)
+		if err != nil {
+			return fmt.Errorf("parsing installed version %s: %w", app.currentVersion, err)
+		}
+
+		if v.LT(current) {
+			return fmt.Errorf("%s is a downgrade from %s", version, app.currentVersion)
+		}
+	}
+
+	if policy.Constraint != "" {
+		inRange, err := semver.ParseRange(normalizeConstraint(policy.Constraint))
+		if err != nil {
+			return fmt.Errorf("parsing constraint %q: %w", policy.Constraint, err)
+		}
+
+		if !inRange(v) {
+			return fmt.Errorf("%s does not match the constraint %q", version, policy.Constraint)
+		}
+	}
+
+	return nil
+}
+
+// rejectUpdate skips the update to the given version, which is not allowed by
+// the version policy, and reports it to Nebraska once.
+func (app *application) rejectUpdate(ctx context.Context, version string, policyErr error) error {
+	if app.rejectedVersion == version {
+		return nil
+	}
+
+	app.rejectedVersion = version
+
+	app.log.Warnf("skipping update to %s: %v", version, policyErr)
+
+	app.recordEvent(corev1.EventTypeWarning, eventReasonUpdateRejected, version, "skipped by the version policy: %v", policyErr)
+
+	// Dry runs don't report to Nebraska.
+	if !app.dryRun() {
+		app.reportError(ctx, errorCodeVersionPolicy)
+	}
+
+	return nil
+}
+
+// normalizeConstraint removes the v prefix of the versions of the constraint
+// and completes the versions given without minor or patch version, e.g.
+// ">=v2.3 <3" becomes ">=2.3.0 <3.0.0".
+func normalizeConstraint(constraint string) string {
+	fields := strings.Fields(constraint)
+
+	for i, field := range fields {
+		version := strings.TrimLeft(field, "<>=!")
+		op := field[:len(field)-len(version)]
+		version = strings.TrimPrefix(version, "v")
+
+		if parts := strings.Split(version, "."); len(parts) < 3 && isNumeric(parts) {
+			for len(parts) < 3 {
+				parts = append(parts, "0")
+			}
+
+			version = strings.Join(parts, ".")
+		}
+
+		fields[i] = op + version
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func isNumeric(parts []string) bool {
+	for _, part := range parts {
+		if _, err := strconv.ParseUint(part, 10, 64); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,356 @@
+package updater
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kinvolk/go-omaha/omaha"
+	"github.com/kinvolk/nebraska/updater"
+
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+const testAppID = "my-app-id"
+
+// fakeOmaha is a Nebraska server offering an update to version, if set, at url
+// and recording the events it receives. Events fail while err is set, and are
+// rejected while status is not ok.
+type fakeOmaha struct {
+	mu       sync.Mutex
+	version  string
+	url      string
+	err      error
+	status   omaha.AppStatus
+	events   []*omaha.EventRequest
+	versions []string
+}
+
+func (f *fakeOmaha) Handle(_ context.Context, _ string, req *omaha.Request) (*omaha.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resp := omaha.NewResponse()
+
+	for _, reqApp := range req.Apps {
+		if len(reqApp.Events) > 0 && f.err != nil {
+			return nil, f.err
+		}
+
+		status := f.status
+		if status == "" {
+			status = omaha.AppOK
+		}
+
+		respApp := resp.AddApp(reqApp.ID, status)
+
+		for _, event := range reqApp.Events {
+			f.events = append(f.events, event)
+			f.versions = append(f.versions, reqApp.Version)
+
+			respApp.AddEvent()
+		}
+
+		if reqApp.UpdateCheck == nil {
+			continue
+		}
+
+		if f.version == "" {
+			respApp.AddUpdateCheck(omaha.NoUpdate)
+
+			continue
+		}
+
+		update := respApp.AddUpdateCheck(omaha.UpdateOK)
+		update.AddManifest(f.version)
+
+		if f.url != "" {
+			update.AddURL(f.url)
+		}
+	}
+
+	return resp, nil
+}
+
+// errorCodes returns the codes of the error events received.
+func (f *fakeOmaha) errorCodes() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var codes []int
+
+	for _, event := range f.events {
+		if event.Result == omaha.EventResultError {
+			codes = append(codes, event.ErrorCode)
+		}
+	}
+
+	return codes
+}
+
+// newTestApplication returns an application reporting to the fake Nebraska
+// server, with the NebraskaApplication and the given objects in a fake cluster.
+func newTestApplication(t *testing.T, server *fakeOmaha, objs ...client.Object) *application {
+	t.Helper()
+
+	obj := &v1alpha1.NebraskaApplication{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nua", Name: "my-app", Generation: 1},
+		Spec:       v1alpha1.NebraskaApplicationSpec{AppID: testAppID},
+	}
+
+	cfg := &Config{
+		NebraskaServer: "http://nebraska.example.com/v1/update",
+		client:         fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(objs, obj)...).Build(),
+		recorder:       record.NewFakeRecorder(100),
+	}
+
+	app := newApplication(cfg, obj)
+	app.log = log.WithField("test", t.Name())
+	app.currentVersion = "1.0.0"
+
+	var err error
+
+	app.nbsClient, err = updater.New(updater.Config{
+		OmahaURL:        app.spec.Server,
+		AppID:           app.spec.AppID,
+		Channel:         app.spec.Channel,
+		InstanceID:      "test",
+		InstanceVersion: app.currentVersion,
+		OmahaReqHandler: server,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(app.deleteMetrics)
+
+	return app
+}
+
+func TestNormalizeConstraint(t *testing.T) {
+	for constraint, want := range map[string]string{
+		">=2.3 <3":          ">=2.3.0 <3.0.0",
+		"2":                 "2.0.0",
+		"!=1.2":             "!=1.2.0",
+		">=v2.3 <v3":        ">=2.3.0 <3.0.0",
+		">=v2.3.1":          ">=2.3.1",
+		"v1.2.3":            "1.2.3",
+		">=1.2.0-rc.1":      ">=1.2.0-rc.1",
+		">=v1.2.0-rc.1 <2":  ">=1.2.0-rc.1 <2.0.0",
+		"<1 || >=2":         "<1.0.0 || >=2.0.0",
+		">=1.2.3  <1.3":     ">=1.2.3 <1.3.0",
+		"1.x":               "1.x",
+		">=1.2.3 <2.0.0 ":   ">=1.2.3 <2.0.0",
+		"":                  "",
+		">=1.2.3-beta <1.3": ">=1.2.3-beta <1.3.0",
+	} {
+		if got := normalizeConstraint(constraint); got != want {
+			t.Errorf("normalizeConstraint(%q): got %q, want %q", constraint, got, want)
+		}
+	}
+}
+
+func TestCheckVersionPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		policy  *v1alpha1.VersionPolicy
+		current string
+		version string
+		wantErr string
+	}{
+		{
+			name:    "no policy",
+			current: "2.0.0",
+			version: "1.0.0-rc.1",
+		},
+		{
+			name:    "upgrade",
+			policy:  &v1alpha1.VersionPolicy{},
+			current: "1.0.0",
+			version: "1.1.0",
+		},
+		{
+			name:    "v prefix",
+			policy:  &v1alpha1.VersionPolicy{Constraint: ">=v1.1 <v2"},
+			current: "v1.0.0",
+			version: "v1.1.0",
+		},
+		{
+			name:    "same version",
+			policy:  &v1alpha1.VersionPolicy{},
+			current: "v1.1.0",
+			version: "1.1.0",
+		},
+		{
+			name:    "pre-release",
+			policy:  &v1alpha1.VersionPolicy{},
+			current: "1.0.0",
+			version: "1.1.0-rc.1",
+			wantErr: "1.1.0-rc.1 is a pre-release version",
+		},
+		{
+			name:    "allowed pre-release",
+			policy:  &v1alpha1.VersionPolicy{AllowPrerelease: true},
+			current: "1.0.0",
+			version: "v1.1.0-rc.1",
+		},
+		{
+			name:    "final release after its pre-release",
+			policy:  &v1alpha1.VersionPolicy{},
+			current: "1.1.0-rc.1",
+			version: "1.1.0",
+		},
+		{
+			name:    "pre-release downgrade",
+			policy:  &v1alpha1.VersionPolicy{AllowPrerelease: true},
+			current: "1.1.0",
+			version: "1.1.0-rc.1",
+			wantErr: "1.1.0-rc.1 is a downgrade from 1.1.0",
+		},
+		{
+			name:    "downgrade",
+			policy:  &v1alpha1.VersionPolicy{},
+			current: "1.1.0",
+			version: "1.0.0",
+			wantErr: "1.0.0 is a downgrade from 1.1.0",
+		},
+		{
+			name:    "allowed downgrade",
+			policy:  &v1alpha1.VersionPolicy{AllowDowngrade: true},
+			current: "1.1.0",
+			version: "1.0.0",
+		},
+		{
+			name:    "in constraint",
+			policy:  &v1alpha1.VersionPolicy{Constraint: ">=1.1 <2"},
+			current: "1.0.0",
+			version: "1.9.0",
+		},
+		{
+			name:    "outside of constraint",
+			policy:  &v1alpha1.VersionPolicy{Constraint: ">=1.1 <2"},
+			current: "1.0.0",
+			version: "2.0.0",
+			wantErr: `2.0.0 does not match the constraint ">=1.1 <2"`,
+		},
+		{
+			name:    "pre-release in constraint",
+			policy:  &v1alpha1.VersionPolicy{AllowPrerelease: true, Constraint: ">=1.1 <2"},
+			current: "1.0.0",
+			version: "1.5.0-rc.1",
+		},
+		{
+			name:    "invalid constraint",
+			policy:  &v1alpha1.VersionPolicy{Constraint: ">=one"},
+			current: "1.0.0",
+			version: "1.1.0",
+			wantErr: `parsing constraint ">=one"`,
+		},
+		{
+			name:    "invalid version",
+			policy:  &v1alpha1.VersionPolicy{},
+			current: "1.0.0",
+			version: "latest",
+			wantErr: "parsing version latest",
+		},
+		{
+			name:    "invalid installed version",
+			policy:  &v1alpha1.VersionPolicy{},
+			current: "unknown",
+			version: "1.1.0",
+			wantErr: "parsing installed version unknown",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := &application{currentVersion: tc.current}
+			app.spec.VersionPolicy = tc.policy
+
+			err := app.checkVersionPolicy(tc.version)
+
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRejectedUpdateIsReportedOnce(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		dryRun    bool
+		wantCodes []int
+	}{
+		{name: "update", wantCodes: []int{errorCodeVersionPolicy}},
+		{name: "dry run", dryRun: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := &fakeOmaha{version: "2.0.0-rc.1"}
+
+			app := newTestApplication(t, server)
+			app.spec.VersionPolicy = &v1alpha1.VersionPolicy{}
+			app.spec.DryRun = tc.dryRun
+
+			ctx := context.Background()
+
+			for i := 0; i < 3; i++ {
+				if err := app.reconcile(ctx); err != nil {
+					t.Fatalf("check %d: %v", i, err)
+				}
+			}
+
+			if got := server.errorCodes(); !equalInts(got, tc.wantCodes) {
+				t.Errorf("got error codes %v, want %v", got, tc.wantCodes)
+			}
+
+			if app.pendingVersion != "" {
+				t.Errorf("rejected update is pending: %s", app.pendingVersion)
+			}
+
+			// Another rejected version is reported again.
+			server.version = "0.9.0"
+
+			if err := app.reconcile(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			want := tc.wantCodes
+			if !tc.dryRun {
+				want = append(want, errorCodeVersionPolicy)
+			}
+
+			if got := server.errorCodes(); !equalInts(got, want) {
+				t.Errorf("got error codes %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
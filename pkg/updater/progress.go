@@ -0,0 +1,572 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kinvolk/nebraska/updater"
+
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+// updateRun is an update that was applied and is verified or rolled back.
+type updateRun struct {
+	version string
+
+	// snap holds the Flux objects from before the update. It is nil for
+	// updates resumed after a restart, which can't be rolled back.
+	snap *snapshot
+
+	// release is the Kustomization or HelmRelease being verified: the one of
+	// the update, or the restored one while rolling back.
+	release releaseObject
+
+	// source is the source of the release as written, so that an artifact of
+	// its previous spec is not mistaken for the one of the update. It is nil
+	// for updates resumed after a restart, whose cache has seen the source.
+	source client.Object
+
+	// deadline is the time by which the release has to be ready, and
+	// deadlineReason why the update failed once it passed.
+	deadline       time.Time
+	deadlineReason string
+
+	// updateErr is the error the update failed with while rolling back.
+	updateErr error
+
+	// phaseStart is the time the verification started.
+	phaseStart time.Time
+
+	// changed and recheck wake up the application to verify the release
+	// again, on a change of a watched object and while waiting for the
+	// workloads.
+	changed <-chan struct{}
+	recheck <-chan time.Time
+}
+
+// updateTransitions are the phases each phase can move to. An update starts
+// without a phase or from the outcome of the previous update. Fetching and
+// applying updates are aborted after a restart.
+var updateTransitions = map[v1alpha1.UpdatePhase][]v1alpha1.UpdatePhase{
+	"":                              {v1alpha1.UpdatePhaseFetching},
+	v1alpha1.UpdatePhaseFetching:    {v1alpha1.UpdatePhaseApplying, v1alpha1.UpdatePhaseFailed},
+	v1alpha1.UpdatePhaseApplying:    {v1alpha1.UpdatePhaseVerifying, v1alpha1.UpdatePhaseRollingBack, v1alpha1.UpdatePhaseFailed},
+	v1alpha1.UpdatePhaseVerifying:   {v1alpha1.UpdatePhaseComplete, v1alpha1.UpdatePhaseRollingBack, v1alpha1.UpdatePhaseFailed},
+	v1alpha1.UpdatePhaseRollingBack: {v1alpha1.UpdatePhaseRolledBack, v1alpha1.UpdatePhaseFailed},
+	v1alpha1.UpdatePhaseComplete:    {v1alpha1.UpdatePhaseFetching},
+	v1alpha1.UpdatePhaseFailed:      {v1alpha1.UpdatePhaseFetching},
+	v1alpha1.UpdatePhaseRolledBack:  {v1alpha1.UpdatePhaseFetching},
+}
+
+// canTransition returns whether an update can move from one phase to the
+// other. Staying in a phase updates its message.
+func canTransition(from, to v1alpha1.UpdatePhase) bool {
+	if from == to {
+		return true
+	}
+
+	for _, phase := range updateTransitions[from] {
+		if phase == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transition moves the update of the application to the given phase. The
+// phase is persisted right away, so that an update is not forgotten when the
+// agent restarts. The outcome of an update is kept until the next one starts.
+// Invalid transitions are logged and ignored.
+func (app *application) transition(ctx context.Context, phase v1alpha1.UpdatePhase, version, message string) {
+	var from v1alpha1.UpdatePhase
+
+	if p := app.progress; p != nil {
+		if p.Phase == phase && p.Version == version && p.Message == message {
+			return
+		}
+
+		from = p.Phase
+	}
+
+	if !canTransition(from, phase) {
+		app.log.Errorf("ignoring invalid transition of the update to %s from %q to %s", version, from, phase)
+
+		return
+	}
+
+	app.progress = &v1alpha1.UpdateProgress{
+		Phase:              phase,
+		Version:            version,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+	}
+
+	if run := app.running; run != nil && (phase == v1alpha1.UpdatePhaseVerifying || phase == v1alpha1.UpdatePhaseRollingBack) {
+		app.progress.Release = releaseReference(run.release)
+		app.progress.Deadline = &metav1.Time{Time: run.deadline}
+	}
+
+	// The release of a completed update is the installed one, even when the
+	// releases of earlier versions could not be deleted.
+	if phase == v1alpha1.UpdatePhaseComplete && app.release != nil {
+		app.progress.Release = releaseReference(app.release)
+	}
+
+	app.log.Debugf("update phase %s", phase)
+
+	if err := app.persistProgress(ctx); err != nil {
+		app.log.Errorf("persisting update progress: %v", err)
+	}
+}
+
+// persistProgress stores the progress of the update and the undelivered
+// events in the status.
+func (app *application) persistProgress(ctx context.Context) error {
+	var obj v1alpha1.NebraskaApplication
+	if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+		return fmt.Errorf("getting NebraskaApplication: %w", err)
+	}
+
+	patch := client.MergeFrom(obj.DeepCopy())
+
+	obj.Status.Update = app.progress
+	obj.Status.PendingEvents = app.events
+
+	if err := app.cfg.client.Status().Patch(ctx, &obj, patch); err != nil {
+		return fmt.Errorf("patching NebraskaApplication status: %w", err)
+	}
+
+	return nil
+}
+
+// startUpdate fetches and applies the update, and starts verifying it. The
+// manifest is only fetched when m is nil.
+func (app *application) startUpdate(ctx context.Context, info *updater.UpdateInfo, m *v1alpha1.UpdateManifest, win *window) error {
+	version := info.Version
+
+	app.transition(ctx, v1alpha1.UpdatePhaseFetching, version, "")
+
+	app.report(ctx, eventDownloadStarted)
+
+	app.recordEvent(corev1.EventTypeNormal, eventReasonUpdateFound, version, "update found")
+
+	phaseStart := time.Now()
+	err := app.getUpdateConfig(ctx, info, m)
+
+	app.observePhase(phaseFetch, phaseStart)
+
+	if err != nil {
+		app.reportError(ctx, errorCodeOf(err))
+
+		app.recordEvent(corev1.EventTypeWarning, eventReasonUpdateFailed, version, "getting update manifest: %v", err)
+
+		err = fmt.Errorf("getting the update config provided in Nebraska update: %w", err)
+
+		app.transition(ctx, v1alpha1.UpdatePhaseFailed, version, err.Error())
+
+		return err
+	}
+
+	app.recordEvent(corev1.EventTypeNormal, eventReasonManifestFetched, version, "fetched update manifest, deploying %s %s/%s",
+		kindOf(app.release), app.release.GetNamespace(), app.release.GetName())
+
+	// Persist the phase before changing anything, so that a restart does not
+	// leave a half applied update behind unnoticed.
+	app.transition(ctx, v1alpha1.UpdatePhaseApplying, version, "")
+
+	// Remember the current Flux configs, so that they can be restored if the
+	// update fails.
+	phaseStart = time.Now()
+
+	snap, err := app.takeSnapshot(ctx)
+	if err != nil {
+		app.reportError(ctx, errorCodeApplyFailed)
+
+		app.recordEvent(corev1.EventTypeWarning, eventReasonUpdateFailed, version, "taking snapshot of Flux objects: %v", err)
+
+		err = fmt.Errorf("taking snapshot of flux CRs: %w", err)
+
+		app.transition(ctx, v1alpha1.UpdatePhaseFailed, version, err.Error())
+
+		return err
+	}
+
+	app.running = &updateRun{
+		version: version,
+		snap:    snap,
+		release: app.release,
+		source:  app.source,
+	}
+
+	err = app.updateFluxCRs(ctx)
+
+	app.observePhase(phaseApply, phaseStart)
+
+	if err != nil {
+		return app.startRollback(ctx, fmt.Errorf("updating flux CRs: %w", err))
+	}
+
+	app.recordEvent(corev1.EventTypeNormal, eventReasonFluxObjectsApplied, version, "applied %s and %s",
+		kindOf(app.source), kindOf(app.release))
+
+	app.report(ctx, eventDownloadFinished)
+	app.report(ctx, eventInstallationStarted)
+
+	now := time.Now()
+
+	app.running.phaseStart = now
+	app.running.deadline, app.running.deadlineReason = app.verifyDeadline(win, app.release, now)
+
+	app.transition(ctx, v1alpha1.UpdatePhaseVerifying, version, "")
+
+	return app.verify(ctx)
+}
+
+// verify checks whether the release of the running update is ready, and
+// completes or rolls back the update when it is ready or failed.
+func (app *application) verify(ctx context.Context) error {
+	run := app.running
+	if run == nil {
+		return nil
+	}
+
+	kind := kindOf(run.release)
+
+	// Get the notification before reading the cache, so no change is missed.
+	run.changed = app.cfg.changes.next(app.key, run.release, run.source)
+	run.recheck = nil
+
+	ready, unhealthy, err := app.checkReadiness(ctx, run.release, run.source)
+
+	if err == nil && !ready && !time.Now().Before(run.deadline) {
+		if len(unhealthy) > 0 {
+			err = fmt.Errorf("%s, not ready: %s", run.deadlineReason, strings.Join(unhealthy, "; "))
+		} else {
+			err = errors.New(run.deadlineReason)
+		}
+
+		err = withErrorCode(errorCodeReadinessTimeout, err)
+	}
+
+	if err != nil {
+		if app.progress.Phase == v1alpha1.UpdatePhaseRollingBack {
+			return app.finishRollback(ctx, fmt.Errorf("waiting for the restored %s: %w", kind, err))
+		}
+
+		app.observePhase(phaseReadiness, run.phaseStart)
+
+		return app.startRollback(ctx, fmt.Errorf("waiting for the %s to be ready: %w", kind, err))
+	}
+
+	if !ready {
+		if len(unhealthy) > 0 {
+			app.log.Debugf("waiting for %s", strings.Join(unhealthy, ", "))
+
+			run.recheck = time.After(workloadCheckInterval)
+		}
+
+		return nil
+	}
+
+	app.log.Infof("%s %s is ready", kind, run.release.GetName())
+
+	if app.progress.Phase == v1alpha1.UpdatePhaseRollingBack {
+		return app.finishRollback(ctx, nil)
+	}
+
+	app.observePhase(phaseReadiness, run.phaseStart)
+
+	return app.completeUpdate(ctx)
+}
+
+// completeUpdate records the version of the update that became ready and
+// reports it to Nebraska.
+func (app *application) completeUpdate(ctx context.Context) error {
+	run := app.running
+	app.running = nil
+	app.release = run.release
+
+	app.recordEvent(corev1.EventTypeNormal, eventReasonUpdateReady, run.version, "%s is ready", kindOf(run.release))
+
+	// Persist the new version, so that it survives agent restarts.
+	if err := app.recordInstalledVersion(ctx, run.version); err != nil {
+		app.log.Errorf("recording installed version: %v", err)
+	}
+
+	// A renamed or moved release leaves the release of the previous version
+	// behind.
+	if err := app.deletePreviousReleases(ctx, run.release); err != nil {
+		app.log.Errorf("deleting previous releases: %v", err)
+	}
+
+	app.currentVersion = run.version
+	app.setVersionMetric(run.version)
+
+	app.report(ctx, eventInstallationFinished)
+	app.report(ctx, eventUpdateComplete)
+
+	app.nbsClient.SetInstanceVersion(run.version)
+
+	app.transition(ctx, v1alpha1.UpdatePhaseComplete, run.version, "")
+
+	return nil
+}
+
+// startRollback restores the snapshot after the running update failed with
+// updateErr, and starts verifying the restored release.
+func (app *application) startRollback(ctx context.Context, updateErr error) error {
+	run := app.running
+	run.updateErr = updateErr
+
+	app.recordEvent(corev1.EventTypeWarning, eventReasonUpdateFailed, run.version, "%v", updateErr)
+
+	if run.snap == nil {
+		app.running = nil
+
+		app.reportError(ctx, errorCodeOf(updateErr))
+
+		if err := app.setFailedVersion(ctx, run.version); err != nil {
+			app.log.Error(err)
+		}
+
+		err := fmt.Errorf("%v, not rolled back as the update was resumed after a restart", updateErr)
+
+		app.transition(ctx, v1alpha1.UpdatePhaseFailed, run.version, err.Error())
+
+		return err
+	}
+
+	restored, err := app.restoreSnapshot(ctx, run.snap)
+	if err != nil {
+		return app.finishRollback(ctx, err)
+	}
+
+	// There is no previous version to wait for.
+	if restored == nil {
+		app.running = nil
+
+		app.reportError(ctx, errorCodeOf(updateErr))
+
+		if err := app.setFailedVersion(ctx, run.version); err != nil {
+			app.log.Error(err)
+		}
+
+		err := fmt.Errorf("%v, not rolled back as there is no previous version", updateErr)
+
+		app.transition(ctx, v1alpha1.UpdatePhaseFailed, run.version, err.Error())
+
+		return err
+	}
+
+	now := time.Now()
+	timeout := app.readinessTimeout(restored)
+
+	run.release = restored
+	run.source = run.snap.source
+	run.deadline = now.Add(timeout)
+	run.deadlineReason = fmt.Sprintf("timed out after %s", timeout)
+
+	app.transition(ctx, v1alpha1.UpdatePhaseRollingBack, run.version, updateErr.Error())
+
+	if err := app.verify(ctx); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("rolling back to version %s: %w", app.currentVersion, updateErr)
+}
+
+// finishRollback reports the outcome of the rollback of the running update to
+// Nebraska, err is the error the rollback failed with.
+func (app *application) finishRollback(ctx context.Context, err error) error {
+	run := app.running
+	app.running = nil
+
+	// Applying the version again would fail the same way.
+	if err := app.setFailedVersion(ctx, run.version); err != nil {
+		app.log.Error(err)
+	}
+
+	if err != nil {
+		app.observeRollback(rollbackResultFailed)
+
+		app.recordEvent(corev1.EventTypeWarning, eventReasonRollbackFailed, run.version, "rolling back: %v", err)
+
+		app.reportError(ctx, errorCodeRollbackFailed)
+
+		err = fmt.Errorf("%v, rolling back failed: %w", run.updateErr, err)
+
+		app.transition(ctx, v1alpha1.UpdatePhaseFailed, run.version, err.Error())
+
+		return err
+	}
+
+	app.log.Infof("rolled back to version %s", app.currentVersion)
+
+	app.observeRollback(rollbackResultSucceeded)
+
+	app.recordEvent(corev1.EventTypeWarning, eventReasonRolledBack, run.version, "rolled back to version %s", app.currentVersion)
+
+	// Report that the update was rolled back, and why when known.
+	app.reportError(ctx, rolledBackErrorCode(errorCodeOf(run.updateErr)))
+
+	err = fmt.Errorf("rolled back to version %s: %w", app.currentVersion, run.updateErr)
+
+	app.transition(ctx, v1alpha1.UpdatePhaseRolledBack, run.version, err.Error())
+
+	return err
+}
+
+// setFailedVersion records the version of an update that failed or was rolled
+// back after its Flux objects were applied, or clears it when empty.
+func (app *application) setFailedVersion(ctx context.Context, version string) error {
+	if app.failedVersion == version {
+		return nil
+	}
+
+	var obj v1alpha1.NebraskaApplication
+	if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+		return fmt.Errorf("getting NebraskaApplication: %w", err)
+	}
+
+	patch := client.MergeFrom(obj.DeepCopy())
+
+	obj.Status.FailedVersion = version
+
+	if err := app.cfg.client.Status().Patch(ctx, &obj, patch); err != nil {
+		return fmt.Errorf("recording failed version: %w", err)
+	}
+
+	app.failedVersion = version
+
+	return nil
+}
+
+// skipFailedVersion returns whether the update to the given version is skipped
+// as it failed before. The failed version is forgotten once Nebraska offers
+// another version, or retried once an operator cleared status.failedVersion.
+func (app *application) skipFailedVersion(ctx context.Context, version string) (bool, error) {
+	if app.failedVersion == "" {
+		return false, nil
+	}
+
+	if version != app.failedVersion {
+		return false, app.setFailedVersion(ctx, "")
+	}
+
+	var obj v1alpha1.NebraskaApplication
+	if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+		return false, fmt.Errorf("getting NebraskaApplication: %w", err)
+	}
+
+	if obj.Status.FailedVersion == version {
+		app.log.Debugf("skipping update to %s, it failed before", version)
+
+		return true, nil
+	}
+
+	app.log.Infof("retrying update to %s, the failed version was cleared", version)
+
+	app.failedVersion = obj.Status.FailedVersion
+
+	return false, nil
+}
+
+// resume continues the update recorded in the status before the agent
+// restarted. Updates that were being verified or rolled back are verified
+// again, updates interrupted while fetching or applying are aborted and
+// retried on the next check.
+func (app *application) resume(ctx context.Context, p *v1alpha1.UpdateProgress) error {
+	if p == nil {
+		return nil
+	}
+
+	app.progress = p.DeepCopy()
+
+	switch p.Phase {
+	case v1alpha1.UpdatePhaseFetching, v1alpha1.UpdatePhaseApplying:
+		message := fmt.Sprintf("aborted, the agent restarted while %s the update", strings.ToLower(string(p.Phase)))
+
+		app.log.Warnf("update to %s %s", p.Version, message)
+
+		app.reportError(ctx, errorCodeInterrupted)
+
+		app.recordEvent(corev1.EventTypeWarning, eventReasonUpdateFailed, p.Version, "%s", message)
+
+		app.transition(ctx, v1alpha1.UpdatePhaseFailed, p.Version, message)
+	case v1alpha1.UpdatePhaseVerifying, v1alpha1.UpdatePhaseRollingBack:
+		release, err := releaseFromReference(p.Release)
+		if err != nil {
+			return err
+		}
+
+		run := &updateRun{
+			version:        p.Version,
+			release:        release,
+			deadline:       time.Now().Add(app.readinessTimeout(release)),
+			deadlineReason: "timed out",
+			phaseStart:     time.Now(),
+		}
+
+		if p.Deadline != nil {
+			run.deadline = p.Deadline.Time
+		}
+
+		if p.Phase == v1alpha1.UpdatePhaseRollingBack {
+			run.updateErr = errors.New(p.Message)
+		} else {
+			app.release = release
+		}
+
+		app.running = run
+
+		app.log.Infof("resuming the update to %s, %s", p.Version, strings.ToLower(string(p.Phase)))
+	}
+
+	return nil
+}
+
+// releaseReference returns the reference persisted for the release.
+func releaseReference(release releaseObject) *v1alpha1.ReleaseReference {
+	return &v1alpha1.ReleaseReference{
+		Kind:       kindOf(release),
+		Namespace:  release.GetNamespace(),
+		Name:       release.GetName(),
+		Generation: release.GetGeneration(),
+	}
+}
+
+// releaseFromReference returns an empty release object with the identity and
+// generation of the reference.
+func releaseFromReference(ref *v1alpha1.ReleaseReference) (releaseObject, error) {
+	if ref == nil {
+		return nil, fmt.Errorf("no release recorded")
+	}
+
+	var release releaseObject
+
+	switch ref.Kind {
+	case kustomizeapi.KustomizationKind:
+		release = &kustomizeapi.Kustomization{}
+	case helmapi.HelmReleaseKind:
+		release = &helmapi.HelmRelease{}
+	default:
+		return nil, fmt.Errorf("unknown release kind %q", ref.Kind)
+	}
+
+	release.SetNamespace(ref.Namespace)
+	release.SetName(ref.Name)
+	release.SetGeneration(ref.Generation)
+
+	return release, nil
+}
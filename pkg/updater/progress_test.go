@@ -0,0 +1,475 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+	"github.com/fluxcd/pkg/apis/meta"
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/kinvolk/go-omaha/omaha"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+// updateStarted returns whether the server was told that an update started
+// downloading.
+func (f *fakeOmaha) updateStarted() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, event := range f.events {
+		if event.Type == omaha.EventTypeUpdateDownloadStarted {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *fakeOmaha) reset(version string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.version = version
+	f.events = nil
+	f.versions = nil
+}
+
+func statusFailedVersion(t *testing.T, app *application) string {
+	t.Helper()
+
+	var obj v1alpha1.NebraskaApplication
+	if err := app.cfg.client.Get(context.Background(), app.key, &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	return obj.Status.FailedVersion
+}
+
+func TestRolledBackVersionIsSkipped(t *testing.T) {
+	ctx := context.Background()
+	server := &fakeOmaha{version: "2.0.0"}
+
+	app := newTestApplication(t, server)
+	app.nbsClient.SetInstanceVersion(app.currentVersion)
+
+	app.running = &updateRun{
+		version:   "2.0.0",
+		release:   &kustomizeapi.Kustomization{ObjectMeta: metav1.ObjectMeta{Namespace: "my-app", Name: "my-app"}},
+		updateErr: errors.New("timed out"),
+	}
+	app.progress = &v1alpha1.UpdateProgress{Phase: v1alpha1.UpdatePhaseVerifying, Version: "2.0.0"}
+	app.transition(ctx, v1alpha1.UpdatePhaseRollingBack, "2.0.0", "timed out")
+
+	if err := app.finishRollback(ctx, nil); err == nil {
+		t.Fatal("no error for a rolled back update")
+	}
+
+	if got := statusFailedVersion(t, app); got != "2.0.0" {
+		t.Fatalf("got failed version %q, want 2.0.0", got)
+	}
+
+	if got, want := server.errorCodes(), []int{errorCodeRolledBack}; !equalInts(got, want) {
+		t.Errorf("got error codes %v, want %v", got, want)
+	}
+
+	// Nebraska keeps offering the version, it is not applied again.
+	for i := 0; i < 3; i++ {
+		server.reset("2.0.0")
+
+		if err := app.reconcile(ctx); err != nil {
+			t.Fatalf("check %d: %v", i, err)
+		}
+
+		if server.updateStarted() || app.progress.Phase != v1alpha1.UpdatePhaseRolledBack {
+			t.Fatalf("check %d: failed version applied again, phase %s", i, app.progress.Phase)
+		}
+	}
+
+	// An operator clears the failed version to retry it.
+	var obj v1alpha1.NebraskaApplication
+	if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := client.MergeFrom(obj.DeepCopy())
+	obj.Status.FailedVersion = ""
+
+	if err := app.cfg.client.Status().Patch(ctx, &obj, patch); err != nil {
+		t.Fatal(err)
+	}
+
+	server.reset("2.0.0")
+
+	// The manifest can't be fetched from the fake server, which fails the
+	// update before anything is applied.
+	_ = app.reconcile(ctx)
+
+	if !server.updateStarted() || app.failedVersion != "" {
+		t.Errorf("cleared failed version not retried, failed version %q", app.failedVersion)
+	}
+}
+
+func TestFailedVersionIsForgotten(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		version string
+	}{
+		{name: "another version", version: "2.1.0"},
+		{name: "no update"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			server := &fakeOmaha{}
+
+			app := newTestApplication(t, server)
+
+			if err := app.setFailedVersion(ctx, "2.0.0"); err != nil {
+				t.Fatal(err)
+			}
+
+			server.reset(tc.version)
+
+			_ = app.reconcile(ctx)
+
+			if app.failedVersion != "" || statusFailedVersion(t, app) != "" {
+				t.Errorf("failed version kept: %q", app.failedVersion)
+			}
+
+			if started := server.updateStarted(); started != (tc.version != "") {
+				t.Errorf("got update started %t, want %t", started, tc.version != "")
+			}
+		})
+	}
+}
+
+func TestCheckKeepsUpdateOutcome(t *testing.T) {
+	ctx := context.Background()
+
+	for _, phase := range []v1alpha1.UpdatePhase{
+		v1alpha1.UpdatePhaseComplete,
+		v1alpha1.UpdatePhaseFailed,
+		v1alpha1.UpdatePhaseRolledBack,
+	} {
+		t.Run(string(phase), func(t *testing.T) {
+			app := newTestApplication(t, &fakeOmaha{})
+			app.cfg.health = newHealthChecker(3, time.Minute)
+
+			app.progress = &v1alpha1.UpdateProgress{Phase: phase, Version: "2.0.0", Message: "outcome"}
+
+			app.step(ctx, true)
+
+			var obj v1alpha1.NebraskaApplication
+			if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+				t.Fatal(err)
+			}
+
+			if p := obj.Status.Update; p == nil || p.Phase != phase || p.Version != "2.0.0" || p.Message != "outcome" {
+				t.Errorf("got update %+v, want the %s outcome", p, phase)
+			}
+
+			if obj.Status.LastCheckTime == nil {
+				t.Error("check not recorded")
+			}
+		})
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	for _, tc := range []struct {
+		from, to v1alpha1.UpdatePhase
+		want     bool
+	}{
+		{from: "", to: v1alpha1.UpdatePhaseFetching, want: true},
+		{from: v1alpha1.UpdatePhaseFetching, to: v1alpha1.UpdatePhaseApplying, want: true},
+		{from: v1alpha1.UpdatePhaseFetching, to: v1alpha1.UpdatePhaseFailed, want: true},
+		{from: v1alpha1.UpdatePhaseApplying, to: v1alpha1.UpdatePhaseVerifying, want: true},
+		{from: v1alpha1.UpdatePhaseApplying, to: v1alpha1.UpdatePhaseRollingBack, want: true},
+		{from: v1alpha1.UpdatePhaseApplying, to: v1alpha1.UpdatePhaseFailed, want: true},
+		{from: v1alpha1.UpdatePhaseVerifying, to: v1alpha1.UpdatePhaseComplete, want: true},
+		{from: v1alpha1.UpdatePhaseVerifying, to: v1alpha1.UpdatePhaseRollingBack, want: true},
+		{from: v1alpha1.UpdatePhaseVerifying, to: v1alpha1.UpdatePhaseFailed, want: true},
+		{from: v1alpha1.UpdatePhaseRollingBack, to: v1alpha1.UpdatePhaseRolledBack, want: true},
+		{from: v1alpha1.UpdatePhaseRollingBack, to: v1alpha1.UpdatePhaseFailed, want: true},
+		{from: v1alpha1.UpdatePhaseRollingBack, to: v1alpha1.UpdatePhaseRollingBack, want: true},
+		{from: v1alpha1.UpdatePhaseComplete, to: v1alpha1.UpdatePhaseFetching, want: true},
+		{from: v1alpha1.UpdatePhaseFailed, to: v1alpha1.UpdatePhaseFetching, want: true},
+		{from: v1alpha1.UpdatePhaseRolledBack, to: v1alpha1.UpdatePhaseFetching, want: true},
+		{from: "", to: v1alpha1.UpdatePhaseVerifying},
+		{from: v1alpha1.UpdatePhaseFetching, to: v1alpha1.UpdatePhaseVerifying},
+		{from: v1alpha1.UpdatePhaseFetching, to: v1alpha1.UpdatePhaseRollingBack},
+		{from: v1alpha1.UpdatePhaseVerifying, to: v1alpha1.UpdatePhaseRolledBack},
+		{from: v1alpha1.UpdatePhaseRollingBack, to: v1alpha1.UpdatePhaseComplete},
+		{from: v1alpha1.UpdatePhaseComplete, to: v1alpha1.UpdatePhaseVerifying},
+		{from: v1alpha1.UpdatePhaseFailed, to: v1alpha1.UpdatePhaseRolledBack},
+		{from: v1alpha1.UpdatePhaseRolledBack, to: v1alpha1.UpdatePhaseComplete},
+	} {
+		if got := canTransition(tc.from, tc.to); got != tc.want {
+			t.Errorf("%q to %s: got %t, want %t", tc.from, tc.to, got, tc.want)
+		}
+	}
+}
+
+func TestInvalidTransitionIsIgnored(t *testing.T) {
+	ctx := context.Background()
+
+	app := newTestApplication(t, &fakeOmaha{})
+	app.progress = &v1alpha1.UpdateProgress{Phase: v1alpha1.UpdatePhaseComplete, Version: "2.0.0"}
+
+	app.transition(ctx, v1alpha1.UpdatePhaseVerifying, "2.0.0", "")
+
+	if app.progress.Phase != v1alpha1.UpdatePhaseComplete {
+		t.Errorf("got phase %s, want the invalid transition ignored", app.progress.Phase)
+	}
+
+	var obj v1alpha1.NebraskaApplication
+	if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if obj.Status.Update != nil {
+		t.Errorf("invalid transition persisted: %+v", obj.Status.Update)
+	}
+}
+
+func TestResume(t *testing.T) {
+	const (
+		oldRevision = "v1.0.0/1111111111111111111111111111111111111111"
+		newRevision = "v2.0.0/2222222222222222222222222222222222222222"
+	)
+
+	past := metav1.NewTime(time.Now().Add(-time.Minute))
+	future := metav1.NewTime(time.Now().Add(time.Hour))
+
+	release := &v1alpha1.ReleaseReference{
+		Kind:       kustomizeapi.KustomizationKind,
+		Namespace:  "my-app",
+		Name:       "my-app",
+		Generation: 2,
+	}
+
+	// The Kustomization as Flux left it, ready with the given revision.
+	kustomization := func(tag, revision string) []client.Object {
+		k := kustomizationWith(2, 2, condition(meta.ReadyCondition, metav1.ConditionTrue, meta.SucceededReason))
+		k.Spec.SourceRef = kustomizeapi.CrossNamespaceSourceReference{Kind: sourceapi.GitRepositoryKind, Name: "my-app"}
+		k.Status.LastAttemptedRevision = revision
+		k.Status.LastAppliedRevision = revision
+
+		return []client.Object{k, gitRepositoryWith(&sourceapi.GitRepositoryRef{Tag: tag}, 1, 1, revision)}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		progress *v1alpha1.UpdateProgress
+		objs     []client.Object
+
+		wantErr       string
+		wantRunning   bool
+		wantPhase     v1alpha1.UpdatePhase
+		wantCodes     []int
+		wantVersion   string
+		wantFailed    string
+		wantInMessage string
+	}{
+		{
+			name:        "no update",
+			wantVersion: "1.0.0",
+		},
+		{
+			name:          "fetching",
+			progress:      &v1alpha1.UpdateProgress{Phase: v1alpha1.UpdatePhaseFetching, Version: "2.0.0"},
+			wantPhase:     v1alpha1.UpdatePhaseFailed,
+			wantCodes:     []int{errorCodeInterrupted},
+			wantVersion:   "1.0.0",
+			wantInMessage: "restarted while fetching",
+		},
+		{
+			name:          "applying",
+			progress:      &v1alpha1.UpdateProgress{Phase: v1alpha1.UpdatePhaseApplying, Version: "2.0.0"},
+			wantPhase:     v1alpha1.UpdatePhaseFailed,
+			wantCodes:     []int{errorCodeInterrupted},
+			wantVersion:   "1.0.0",
+			wantInMessage: "restarted while applying",
+		},
+		{
+			name: "verifying, ready",
+			progress: &v1alpha1.UpdateProgress{
+				Phase:    v1alpha1.UpdatePhaseVerifying,
+				Version:  "2.0.0",
+				Release:  release,
+				Deadline: &future,
+			},
+			objs:        kustomization("v2.0.0", newRevision),
+			wantRunning: true,
+			wantPhase:   v1alpha1.UpdatePhaseComplete,
+			wantVersion: "2.0.0",
+		},
+		{
+			name: "verifying, not ready",
+			progress: &v1alpha1.UpdateProgress{
+				Phase:    v1alpha1.UpdatePhaseVerifying,
+				Version:  "2.0.0",
+				Release:  release,
+				Deadline: &future,
+			},
+			objs:        kustomization("v2.0.0", oldRevision),
+			wantRunning: true,
+			wantPhase:   v1alpha1.UpdatePhaseVerifying,
+			wantVersion: "1.0.0",
+		},
+		{
+			name: "verifying, deadline passed",
+			progress: &v1alpha1.UpdateProgress{
+				Phase:    v1alpha1.UpdatePhaseVerifying,
+				Version:  "2.0.0",
+				Release:  release,
+				Deadline: &past,
+			},
+			objs:          kustomization("v2.0.0", oldRevision),
+			wantRunning:   true,
+			wantPhase:     v1alpha1.UpdatePhaseFailed,
+			wantCodes:     []int{errorCodeReadinessTimeout},
+			wantVersion:   "1.0.0",
+			wantFailed:    "2.0.0",
+			wantInMessage: "not rolled back as the update was resumed after a restart",
+		},
+		{
+			name: "verifying without release",
+			progress: &v1alpha1.UpdateProgress{
+				Phase:   v1alpha1.UpdatePhaseVerifying,
+				Version: "2.0.0",
+			},
+			wantErr: "no release recorded",
+		},
+		{
+			name: "rolling back, ready",
+			progress: &v1alpha1.UpdateProgress{
+				Phase:    v1alpha1.UpdatePhaseRollingBack,
+				Version:  "2.0.0",
+				Release:  release,
+				Deadline: &future,
+				Message:  "timed out",
+			},
+			objs:          kustomization("v1.0.0", oldRevision),
+			wantRunning:   true,
+			wantPhase:     v1alpha1.UpdatePhaseRolledBack,
+			wantCodes:     []int{errorCodeRolledBack},
+			wantVersion:   "1.0.0",
+			wantFailed:    "2.0.0",
+			wantInMessage: "rolled back to version 1.0.0: timed out",
+		},
+		{
+			name: "rolling back, deadline passed",
+			progress: &v1alpha1.UpdateProgress{
+				Phase:    v1alpha1.UpdatePhaseRollingBack,
+				Version:  "2.0.0",
+				Release:  release,
+				Deadline: &past,
+				Message:  "timed out",
+			},
+			objs:          kustomization("v1.0.0", newRevision),
+			wantRunning:   true,
+			wantPhase:     v1alpha1.UpdatePhaseFailed,
+			wantCodes:     []int{errorCodeRollbackFailed},
+			wantVersion:   "1.0.0",
+			wantFailed:    "2.0.0",
+			wantInMessage: "rolling back failed",
+		},
+		{
+			name:        "complete",
+			progress:    &v1alpha1.UpdateProgress{Phase: v1alpha1.UpdatePhaseComplete, Version: "1.0.0"},
+			wantPhase:   v1alpha1.UpdatePhaseComplete,
+			wantVersion: "1.0.0",
+		},
+		{
+			name:        "rolled back",
+			progress:    &v1alpha1.UpdateProgress{Phase: v1alpha1.UpdatePhaseRolledBack, Version: "2.0.0"},
+			wantPhase:   v1alpha1.UpdatePhaseRolledBack,
+			wantVersion: "1.0.0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			server := &fakeOmaha{}
+
+			app := newTestApplication(t, server, tc.objs...)
+			app.cfg.changes = newChangeNotifier()
+
+			err := app.resume(ctx, tc.progress)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if running := app.running != nil; running != tc.wantRunning {
+				t.Fatalf("got running %t, want %t", running, tc.wantRunning)
+			}
+
+			if app.running != nil {
+				if app.running.version != "2.0.0" || app.running.release.GetName() != "my-app" || app.running.snap != nil {
+					t.Errorf("got run %+v", app.running)
+				}
+
+				if !app.running.deadline.Equal(tc.progress.Deadline.Time) {
+					t.Errorf("got deadline %s, want %s", app.running.deadline, tc.progress.Deadline)
+				}
+
+				// Verifying goes on with the resumed run.
+				_ = app.verify(ctx)
+			}
+
+			if tc.wantPhase == "" {
+				if app.progress != nil {
+					t.Errorf("got phase %s, want none", app.progress.Phase)
+				}
+
+				return
+			}
+
+			if app.progress == nil || app.progress.Phase != tc.wantPhase {
+				t.Fatalf("got progress %+v, want phase %s", app.progress, tc.wantPhase)
+			}
+
+			if !strings.Contains(app.progress.Message, tc.wantInMessage) {
+				t.Errorf("got message %q, want %q in it", app.progress.Message, tc.wantInMessage)
+			}
+
+			if got := server.errorCodes(); !equalInts(got, tc.wantCodes) {
+				t.Errorf("got error codes %v, want %v", got, tc.wantCodes)
+			}
+
+			if app.currentVersion != tc.wantVersion {
+				t.Errorf("got version %s, want %s", app.currentVersion, tc.wantVersion)
+			}
+
+			if app.failedVersion != tc.wantFailed {
+				t.Errorf("got failed version %q, want %q", app.failedVersion, tc.wantFailed)
+			}
+
+			var obj v1alpha1.NebraskaApplication
+			if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+				t.Fatal(err)
+			}
+
+			// Every transition is persisted.
+			if p := obj.Status.Update; tc.progress.Phase != tc.wantPhase && (p == nil || p.Phase != tc.wantPhase) {
+				t.Errorf("got persisted update %+v, want phase %s", p, tc.wantPhase)
+			}
+		})
+	}
+}
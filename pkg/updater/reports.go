@@ -0,0 +1,185 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kinvolk/go-omaha/omaha"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+const (
+	// maxPendingEvents bounds the events kept while Nebraska is unreachable,
+	// the oldest ones are dropped first.
+	maxPendingEvents = 100
+
+	// Undelivered events are retried with an exponential backoff.
+	minEventRetryDelay = 5 * time.Second
+	maxEventRetryDelay = 5 * time.Minute
+)
+
+// Progress events reported to Nebraska, the same as the ones sent by the
+// ReportProgress function of the Nebraska updater library.
+var (
+	eventDownloadStarted = omaha.EventRequest{
+		Type:   omaha.EventTypeUpdateDownloadStarted,
+		Result: omaha.EventResultSuccess,
+	}
+	eventDownloadFinished = omaha.EventRequest{
+		Type:   omaha.EventTypeUpdateDownloadFinished,
+		Result: omaha.EventResultSuccess,
+	}
+	eventInstallationStarted = omaha.EventRequest{
+		Type:   omaha.EventTypeInstallStarted,
+		Result: omaha.EventResultSuccess,
+	}
+	// The library reports a finished installation as started as well.
+	eventInstallationFinished = omaha.EventRequest{
+		Type:   omaha.EventTypeInstallStarted,
+		Result: omaha.EventResultSuccess,
+	}
+	eventUpdateComplete = omaha.EventRequest{
+		Type:   omaha.EventTypeUpdateComplete,
+		Result: omaha.EventResultSuccess,
+	}
+)
+
+// reportError reports an error event with the given code to Nebraska, see
+// errorcodes.go.
+func (app *application) reportError(ctx context.Context, code int) {
+	app.report(ctx, omaha.EventRequest{
+		Type:      omaha.EventTypeUpdateComplete,
+		Result:    omaha.EventResultError,
+		ErrorCode: code,
+	})
+}
+
+// report queues the event for Nebraska and delivers the queue. Events that
+// can't be delivered are persisted in the status and retried.
+func (app *application) report(ctx context.Context, event omaha.EventRequest) {
+	app.events = append(app.events, v1alpha1.OmahaEvent{
+		Type:      int(event.Type),
+		Result:    int(event.Result),
+		ErrorCode: event.ErrorCode,
+		Version:   app.nbsClient.InstanceVersion(),
+		Time:      metav1.Now(),
+	})
+
+	if dropped := len(app.events) - maxPendingEvents; dropped > 0 {
+		app.log.Warnf("dropping %d undelivered Omaha events", dropped)
+
+		app.events = app.events[dropped:]
+	}
+
+	// While retrying, new events wait for their turn, so that a Nebraska
+	// outage does not slow down every report.
+	if app.eventRetry == nil {
+		app.deliverEvents(ctx)
+	}
+
+	app.setPendingEventsMetric()
+
+	if len(app.events) > 0 {
+		if err := app.persistProgress(ctx); err != nil {
+			app.log.Errorf("persisting undelivered Omaha events: %v", err)
+		}
+	}
+}
+
+// retryEvents delivers the queued events once the backoff passed.
+func (app *application) retryEvents(ctx context.Context) {
+	app.eventRetry = nil
+
+	pending := len(app.events)
+
+	app.deliverEvents(ctx)
+	app.setPendingEventsMetric()
+
+	if len(app.events) == pending {
+		return
+	}
+
+	if err := app.persistProgress(ctx); err != nil {
+		app.log.Errorf("persisting undelivered Omaha events: %v", err)
+	}
+}
+
+// deliverEvents sends the queued events in order. On the first failure the
+// remaining events are kept and retried after a backoff.
+func (app *application) deliverEvents(ctx context.Context) {
+	for len(app.events) > 0 {
+		err := app.sendEvent(ctx, app.events[0])
+		if err != nil {
+			var rejected *eventRejectedError
+			if !errors.As(err, &rejected) {
+				app.scheduleEventRetry(err)
+
+				return
+			}
+
+			// Nebraska won't accept the event on a retry either.
+			app.log.Errorf("dropping Omaha event: %v", err)
+		}
+
+		app.events = app.events[1:]
+	}
+
+	app.events = nil
+	app.eventRetryDelay = 0
+}
+
+// scheduleEventRetry schedules the next delivery after a failed one.
+func (app *application) scheduleEventRetry(err error) {
+	if app.eventRetryDelay == 0 {
+		app.eventRetryDelay = minEventRetryDelay
+	} else if app.eventRetryDelay *= 2; app.eventRetryDelay > maxEventRetryDelay {
+		app.eventRetryDelay = maxEventRetryDelay
+	}
+
+	app.log.Warnf("%d Omaha events not delivered, retrying in %s: %v", len(app.events), app.eventRetryDelay, err)
+
+	app.eventRetry = time.After(app.eventRetryDelay)
+}
+
+// eventRejectedError is returned when Nebraska rejected an event.
+type eventRejectedError struct {
+	status omaha.AppStatus
+}
+
+func (e *eventRejectedError) Error() string {
+	return fmt.Sprintf("event rejected with status %q", e.status)
+}
+
+// sendEvent sends the event with the version that was installed when it
+// happened.
+func (app *application) sendEvent(ctx context.Context, event v1alpha1.OmahaEvent) error {
+	current := app.nbsClient.InstanceVersion()
+	defer app.nbsClient.SetInstanceVersion(current)
+
+	app.nbsClient.SetInstanceVersion(event.Version)
+
+	resp, err := app.nbsClient.SendOmahaEvent(ctx, &omaha.EventRequest{
+		Type:      omaha.EventType(event.Type),
+		Result:    omaha.EventResult(event.Result),
+		ErrorCode: event.ErrorCode,
+	})
+	if err != nil {
+		return fmt.Errorf("sending Omaha event: %w", err)
+	}
+
+	appResp := resp.GetApp(app.spec.AppID)
+	if appResp == nil {
+		return &eventRejectedError{status: "missing app"}
+	}
+
+	if appResp.Status != omaha.AppOK {
+		return &eventRejectedError{status: appResp.Status}
+	}
+
+	return nil
+}
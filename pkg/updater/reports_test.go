@@ -0,0 +1,309 @@
+package updater
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kinvolk/go-omaha/omaha"
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+// ServeHTTP serves the fake Nebraska server over HTTP, for the Nebraska
+// clients created by the application itself.
+func (f *fakeOmaha) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := omaha.ParseRequest(r.Header.Get("Content-Type"), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	resp, err := f.Handle(r.Context(), r.URL.String(), req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+
+	if err := xml.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// receivedErrorCodes returns the error codes of the events received, in order.
+func (f *fakeOmaha) receivedErrorCodes() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	codes := make([]int, 0, len(f.events))
+
+	for _, event := range f.events {
+		codes = append(codes, event.ErrorCode)
+	}
+
+	return codes
+}
+
+func pendingErrorCodes(events []v1alpha1.OmahaEvent) []int {
+	codes := make([]int, 0, len(events))
+
+	for _, event := range events {
+		codes = append(codes, event.ErrorCode)
+	}
+
+	return codes
+}
+
+func errorEvent(code int, version string) v1alpha1.OmahaEvent {
+	return v1alpha1.OmahaEvent{
+		Type:      int(omaha.EventTypeUpdateComplete),
+		Result:    int(omaha.EventResultError),
+		ErrorCode: code,
+		Version:   version,
+		Time:      metav1.Now(),
+	}
+}
+
+func TestDeliverEventsInOrder(t *testing.T) {
+	server := &fakeOmaha{}
+	app := newTestApplication(t, server)
+
+	app.events = []v1alpha1.OmahaEvent{
+		errorEvent(1, "1.0.0"),
+		errorEvent(2, "1.1.0"),
+		errorEvent(3, "1.2.0"),
+	}
+	app.eventRetryDelay = time.Minute
+
+	app.deliverEvents(context.Background())
+
+	if got, want := server.receivedErrorCodes(), []int{1, 2, 3}; !equalInts(got, want) {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+
+	// Each event is sent with the version that was installed when it happened.
+	want := []string{"1.0.0", "1.1.0", "1.2.0"}
+	for i := range want {
+		if server.versions[i] != want[i] {
+			t.Errorf("event %d: got version %s, want %s", i, server.versions[i], want[i])
+		}
+	}
+
+	if app.nbsClient.InstanceVersion() != "1.0.0" {
+		t.Errorf("instance version not restored: %s", app.nbsClient.InstanceVersion())
+	}
+
+	if len(app.events) != 0 || app.eventRetry != nil || app.eventRetryDelay != 0 {
+		t.Errorf("delivery not finished: %d events, retry %v, delay %s", len(app.events), app.eventRetry, app.eventRetryDelay)
+	}
+}
+
+func TestDeliverEventsKeepsEventsOnFailure(t *testing.T) {
+	server := &fakeOmaha{err: errors.New("unavailable")}
+	app := newTestApplication(t, server)
+
+	app.events = []v1alpha1.OmahaEvent{errorEvent(1, "1.0.0"), errorEvent(2, "1.0.0")}
+
+	app.deliverEvents(context.Background())
+
+	if got, want := pendingErrorCodes(app.events), []int{1, 2}; !equalInts(got, want) {
+		t.Errorf("got pending events %v, want %v", got, want)
+	}
+
+	if app.eventRetry == nil || app.eventRetryDelay != minEventRetryDelay {
+		t.Errorf("got retry %v after %s, want a retry after %s", app.eventRetry, app.eventRetryDelay, minEventRetryDelay)
+	}
+}
+
+func TestDeliverEventsDropsRejectedEvents(t *testing.T) {
+	server := &fakeOmaha{status: omaha.AppStatus("error-unknownApplication")}
+	app := newTestApplication(t, server)
+
+	app.events = []v1alpha1.OmahaEvent{errorEvent(1, "1.0.0"), errorEvent(2, "1.0.0")}
+
+	app.deliverEvents(context.Background())
+
+	// Both events are tried once, as retrying won't change the answer.
+	if got, want := server.receivedErrorCodes(), []int{1, 2}; !equalInts(got, want) {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+
+	if len(app.events) != 0 || app.eventRetry != nil {
+		t.Errorf("rejected events kept: %d events, retry %v", len(app.events), app.eventRetry)
+	}
+}
+
+func TestScheduleEventRetry(t *testing.T) {
+	app := newTestApplication(t, &fakeOmaha{})
+
+	want := []time.Duration{
+		5 * time.Second,
+		10 * time.Second,
+		20 * time.Second,
+		40 * time.Second,
+		80 * time.Second,
+		160 * time.Second,
+		maxEventRetryDelay,
+		maxEventRetryDelay,
+	}
+
+	for i, delay := range want {
+		app.scheduleEventRetry(errors.New("unavailable"))
+
+		if app.eventRetryDelay != delay {
+			t.Errorf("retry %d: got delay %s, want %s", i, app.eventRetryDelay, delay)
+		}
+
+		if app.eventRetry == nil {
+			t.Errorf("retry %d: not scheduled", i)
+		}
+	}
+
+	// A delivery resets the backoff.
+	app.deliverEvents(context.Background())
+
+	if app.eventRetryDelay != 0 {
+		t.Errorf("got delay %s after a delivery, want none", app.eventRetryDelay)
+	}
+}
+
+func TestReportDropsOldestEvents(t *testing.T) {
+	server := &fakeOmaha{err: errors.New("unavailable")}
+	app := newTestApplication(t, server)
+
+	ctx := context.Background()
+
+	for code := 1; code <= maxPendingEvents+5; code++ {
+		app.reportError(ctx, code)
+	}
+
+	if len(app.events) != maxPendingEvents {
+		t.Fatalf("got %d pending events, want %d", len(app.events), maxPendingEvents)
+	}
+
+	if app.events[0].ErrorCode != 6 {
+		t.Errorf("got oldest pending event %d, want 6", app.events[0].ErrorCode)
+	}
+
+	var obj v1alpha1.NebraskaApplication
+	if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if !equalInts(pendingErrorCodes(obj.Status.PendingEvents), pendingErrorCodes(app.events)) {
+		t.Errorf("pending events not persisted, got %v", pendingErrorCodes(obj.Status.PendingEvents))
+	}
+
+	// While retrying, new events only queue up, so only the first report
+	// tried to deliver.
+	server.mu.Lock()
+	server.err = nil
+	server.mu.Unlock()
+
+	app.retryEvents(ctx)
+
+	got := server.receivedErrorCodes()
+	for i := range got {
+		if got[i] != i+6 {
+			t.Fatalf("got events %v, want 6 to %d in order", got, maxPendingEvents+5)
+		}
+	}
+
+	if len(got) != maxPendingEvents {
+		t.Errorf("got %d events, want %d", len(got), maxPendingEvents)
+	}
+
+	if err := app.cfg.client.Get(ctx, app.key, &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(app.events) != 0 || len(obj.Status.PendingEvents) != 0 {
+		t.Errorf("got %d pending events, %d persisted, want none", len(app.events), len(obj.Status.PendingEvents))
+	}
+}
+
+func TestPendingEventsAfterRestart(t *testing.T) {
+	server := &fakeOmaha{err: errors.New("unavailable")}
+
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	obj := &v1alpha1.NebraskaApplication{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nua", Name: "my-app", Generation: 1},
+		Spec:       v1alpha1.NebraskaApplicationSpec{AppID: testAppID},
+	}
+
+	cfg := &Config{
+		NebraskaServer: httpServer.URL,
+		clusterID:      "test",
+		client:         fake.NewClientBuilder().WithScheme(scheme).WithObjects(obj).Build(),
+		recorder:       record.NewFakeRecorder(100),
+	}
+
+	ctx := context.Background()
+
+	start := func() *application {
+		app := newApplication(cfg, obj)
+		app.log = log.WithField("test", t.Name())
+
+		t.Cleanup(app.deleteMetrics)
+
+		if err := app.setup(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		return app
+	}
+
+	app := start()
+	app.reportError(ctx, 1)
+	app.reportError(ctx, 2)
+
+	if got := pendingErrorCodes(app.events); !equalInts(got, []int{1, 2}) {
+		t.Fatalf("got pending events %v, want [1 2]", got)
+	}
+
+	// The events are still pending after a restart while Nebraska is down.
+	app = start()
+
+	if got := pendingErrorCodes(app.events); !equalInts(got, []int{1, 2}) {
+		t.Fatalf("got pending events %v after a restart, want [1 2]", got)
+	}
+
+	if app.eventRetry == nil {
+		t.Error("no retry scheduled after a restart")
+	}
+
+	// And delivered in order once it is back.
+	server.mu.Lock()
+	server.err = nil
+	server.mu.Unlock()
+
+	app = start()
+
+	if got := server.receivedErrorCodes(); !equalInts(got, []int{1, 2}) {
+		t.Errorf("got events %v, want [1 2]", got)
+	}
+
+	var got v1alpha1.NebraskaApplication
+	if err := cfg.client.Get(ctx, app.key, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(app.events) != 0 || len(got.Status.PendingEvents) != 0 {
+		t.Errorf("got %d pending events, %d persisted, want none", len(app.events), len(got.Status.PendingEvents))
+	}
+}
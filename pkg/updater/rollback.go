@@ -0,0 +1,191 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// snapshot holds the Flux objects of the application as they were before an
+// update was applied. A nil field means that the object did not exist.
+type snapshot struct {
+	source  client.Object
+	release releaseObject
+}
+
+// takeSnapshot records the current state of the Flux objects that are about to
+// be updated. The source is the one the existing release deploys, which may be
+// of another kind than the source of the update.
+func (app *application) takeSnapshot(ctx context.Context) (*snapshot, error) {
+	var snap snapshot
+
+	release, err := app.cfg.getCurrent(ctx, app.release)
+	if err != nil {
+		return nil, err
+	}
+
+	// An update that renames the release or moves it to another namespace
+	// replaces the release that installed the current version.
+	if release == nil {
+		installed, err := app.installedRelease(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if installed != nil {
+			release = installed
+		}
+	}
+
+	source := app.source
+
+	if release != nil {
+		snap.release = restorable(release).(releaseObject)
+
+		if source, err = sourceOf(snap.release); err != nil {
+			return nil, fmt.Errorf("getting source of %s: %w", kindOf(release), err)
+		}
+	}
+
+	got, err := app.cfg.getCurrent(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	if got != nil {
+		snap.source = restorable(got)
+	}
+
+	return &snap, nil
+}
+
+// sourceOf returns the source referenced by the release, with only its kind,
+// name and namespace set.
+func sourceOf(release releaseObject) (client.Object, error) {
+	var kind, name, namespace string
+
+	switch r := release.(type) {
+	case *kustomizeapi.Kustomization:
+		kind, name, namespace = r.Spec.SourceRef.Kind, r.Spec.SourceRef.Name, r.Spec.SourceRef.Namespace
+	case *helmapi.HelmRelease:
+		ref := r.Spec.Chart.Spec.SourceRef
+		kind, name, namespace = ref.Kind, ref.Name, ref.Namespace
+	default:
+		return nil, fmt.Errorf("unsupported release %T", release)
+	}
+
+	source, err := newSource(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	if namespace == "" {
+		namespace = release.GetNamespace()
+	}
+
+	source.SetName(name)
+	source.SetNamespace(namespace)
+
+	return source, nil
+}
+
+// restorable strips the fields managed by the API server, so that the object
+// can be written back.
+func restorable(obj client.Object) client.Object {
+	obj.SetResourceVersion("")
+	obj.SetUID("")
+	obj.SetGeneration(0)
+	obj.SetManagedFields(nil)
+
+	return obj
+}
+
+// restoreSnapshot restores the Flux objects recorded in the snapshot and
+// returns the restored release, which has to become ready again. Without a
+// previous release, nil is returned: the release of the update is suspended
+// and the source of the update is kept for it.
+func (app *application) restoreSnapshot(ctx context.Context, snap *snapshot) (releaseObject, error) {
+	app.log.Warnf("rolling back to version %s", app.currentVersion)
+
+	if snap.source != nil {
+		if err := app.cfg.createOrUpdate(ctx, snap.source); err != nil {
+			return nil, fmt.Errorf("restoring %s: %w", kindOf(snap.source), err)
+		}
+	}
+
+	if snap.release == nil {
+		suspended, err := app.suspendRelease(ctx, "there is no previous version to roll back to")
+		if err != nil || suspended {
+			return nil, err
+		}
+	} else {
+		if err := app.cfg.createOrUpdate(ctx, snap.release); err != nil {
+			return nil, fmt.Errorf("restoring %s: %w", kindOf(snap.release), err)
+		}
+
+		// The renamed or moved release of the update would deploy the
+		// workloads next to the restored one.
+		if refOf(snap.release) != refOf(app.release) {
+			reason := fmt.Sprintf("version %s is restored with %s %s/%s", app.currentVersion,
+				kindOf(snap.release), snap.release.GetNamespace(), snap.release.GetName())
+
+			suspended, err := app.suspendRelease(ctx, reason)
+			if err != nil {
+				return nil, err
+			}
+
+			if suspended {
+				return snap.release, nil
+			}
+		}
+	}
+
+	// The source of the update is only deleted once no release deploys it.
+	if snap.source == nil || refOf(snap.source) != refOf(app.source) {
+		if err := app.cfg.delete(ctx, app.source); err != nil {
+			return nil, err
+		}
+	}
+
+	return snap.release, nil
+}
+
+// suspendRelease suspends the release of a failed update that is not restored
+// by the rollback, because it is a first installation or renamed the release,
+// and returns false when it was not created. Deleting the release instead would
+// let Flux prune the workloads it already deployed, so it is left for an
+// operator to fix or delete.
+func (app *application) suspendRelease(ctx context.Context, reason string) (bool, error) {
+	kind := kindOf(app.release)
+	name := app.release.GetName()
+
+	got, err := app.cfg.getCurrent(ctx, app.release)
+	if err != nil || got == nil {
+		return false, err
+	}
+
+	patch := client.MergeFrom(got.DeepCopyObject().(client.Object))
+
+	switch r := got.(type) {
+	case *kustomizeapi.Kustomization:
+		r.Spec.Suspend = true
+	case *helmapi.HelmRelease:
+		r.Spec.Suspend = true
+	}
+
+	if err := app.cfg.client.Patch(ctx, got, patch); err != nil {
+		return false, fmt.Errorf("suspending %s %s: %w", kind, name, err)
+	}
+
+	app.log.Warnf("suspended %s %s instead of deleting it, as %s and Flux would prune its workloads", kind, name, reason)
+
+	app.recordEvent(corev1.EventTypeWarning, eventReasonReleaseSuspended, app.running.version,
+		"suspended %s %s, as %s and deleting it would prune its workloads. Fix and resume it with the next update, or delete it", kind, name, reason)
+
+	return true, nil
+}
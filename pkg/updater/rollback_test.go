@@ -0,0 +1,317 @@
+package updater
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+func TestRollbackRestoresSourceOfRelease(t *testing.T) {
+	ctx := context.Background()
+	objectMeta := metav1.ObjectMeta{Namespace: "my-app", Name: "my-app"}
+
+	gitRepo := &sourceapi.GitRepository{
+		ObjectMeta: objectMeta,
+		Spec:       sourceapi.GitRepositorySpec{URL: "https://github.com/example/my-app"},
+	}
+	kustomization := &kustomizeapi.Kustomization{
+		ObjectMeta: objectMeta,
+		Spec: kustomizeapi.KustomizationSpec{
+			Path:      "./v1",
+			SourceRef: kustomizeapi.CrossNamespaceSourceReference{Kind: sourceapi.GitRepositoryKind, Name: "my-app"},
+		},
+	}
+
+	app := &application{
+		cfg: &Config{client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(gitRepo, kustomization).Build()},
+		log: log.WithField("test", t.Name()),
+	}
+
+	// The update switches the application from Git to OCI.
+	app.source = app.generateOCIRepository(&v1alpha1.OCISource{URL: "oci://ghcr.io/example/my-app", Tag: "v2"}, "my-app", "my-app")
+	app.release = &kustomizeapi.Kustomization{
+		ObjectMeta: objectMeta,
+		Spec: kustomizeapi.KustomizationSpec{
+			Path:      "./v2",
+			SourceRef: kustomizeapi.CrossNamespaceSourceReference{Kind: ociRepositoryKind, Name: "my-app"},
+		},
+	}
+
+	snap, err := app.takeSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if snap.source == nil || kindOf(snap.source) != sourceapi.GitRepositoryKind {
+		t.Fatalf("got source snapshot %v, want the GitRepository", snap.source)
+	}
+
+	if err := app.cfg.createOrUpdate(ctx, app.source); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.cfg.createOrUpdate(ctx, app.release); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := app.restoreSnapshot(ctx, snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored == nil {
+		t.Fatal("release was not restored")
+	}
+
+	var gotKustomization kustomizeapi.Kustomization
+	if err := app.cfg.client.Get(ctx, client.ObjectKeyFromObject(kustomization), &gotKustomization); err != nil {
+		t.Fatal(err)
+	}
+
+	if ref := gotKustomization.Spec.SourceRef; ref.Kind != sourceapi.GitRepositoryKind || gotKustomization.Spec.Path != "./v1" {
+		t.Errorf("Kustomization not restored: source %s, path %s", ref.Kind, gotKustomization.Spec.Path)
+	}
+
+	if got, err := app.cfg.getCurrent(ctx, gitRepo); err != nil || got == nil {
+		t.Errorf("GitRepository not restored: %v", err)
+	}
+
+	if got, err := app.cfg.getCurrent(ctx, app.source); err != nil || got != nil {
+		t.Errorf("OCIRepository of the update not deleted: %v", err)
+	}
+}
+
+func TestSourceOf(t *testing.T) {
+	kustomization := &kustomizeapi.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "my-app", Name: "my-app"},
+		Spec: kustomizeapi.KustomizationSpec{
+			SourceRef: kustomizeapi.CrossNamespaceSourceReference{Kind: sourceapi.BucketKind, Name: "bucket"},
+		},
+	}
+
+	source, err := sourceOf(kustomization)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := refOf(source), (objectRef{kind: sourceapi.BucketKind, namespace: "my-app", name: "bucket"}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	kustomization.Spec.SourceRef.Kind = "ConfigMap"
+
+	if _, err := sourceOf(kustomization); err == nil {
+		t.Error("no error for an unsupported source kind")
+	}
+}
+
+func TestRollbackSuspendsFirstInstall(t *testing.T) {
+	ctx := context.Background()
+	objectMeta := metav1.ObjectMeta{Namespace: "my-app", Name: "my-app"}
+
+	recorder := record.NewFakeRecorder(10)
+
+	app := &application{
+		cfg: &Config{
+			client:   fake.NewClientBuilder().WithScheme(scheme).Build(),
+			recorder: recorder,
+		},
+		log:     log.WithField("test", t.Name()),
+		running: &updateRun{version: "1.0.0"},
+	}
+
+	app.source = &sourceapi.GitRepository{ObjectMeta: objectMeta}
+	app.release = &kustomizeapi.Kustomization{
+		ObjectMeta: objectMeta,
+		Spec: kustomizeapi.KustomizationSpec{
+			Prune:     true,
+			SourceRef: kustomizeapi.CrossNamespaceSourceReference{Kind: sourceapi.GitRepositoryKind, Name: "my-app"},
+		},
+	}
+
+	snap, err := app.takeSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.cfg.createOrUpdate(ctx, app.source); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.cfg.createOrUpdate(ctx, app.release); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := app.restoreSnapshot(ctx, snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored != nil {
+		t.Fatalf("got restored release %v, want none", restored)
+	}
+
+	var got kustomizeapi.Kustomization
+	if err := app.cfg.client.Get(ctx, client.ObjectKeyFromObject(app.release), &got); err != nil {
+		t.Fatalf("Kustomization was deleted: %v", err)
+	}
+
+	if !got.Spec.Suspend {
+		t.Error("Kustomization was not suspended")
+	}
+
+	// The suspended Kustomization still deploys the source.
+	if source, err := app.cfg.getCurrent(ctx, app.source); err != nil || source == nil {
+		t.Errorf("GitRepository was deleted: %v", err)
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, eventReasonReleaseSuspended) {
+			t.Errorf("got event %q, want %s", event, eventReasonReleaseSuspended)
+		}
+	default:
+		t.Error("no event recorded")
+	}
+}
+
+func TestRollbackFirstInstallWithoutRelease(t *testing.T) {
+	ctx := context.Background()
+	objectMeta := metav1.ObjectMeta{Namespace: "my-app", Name: "my-app"}
+
+	app := &application{
+		cfg: &Config{client: fake.NewClientBuilder().WithScheme(scheme).Build()},
+		log: log.WithField("test", t.Name()),
+	}
+
+	app.source = &sourceapi.GitRepository{ObjectMeta: objectMeta}
+	app.release = &kustomizeapi.Kustomization{ObjectMeta: objectMeta}
+
+	// Applying failed after the source was created.
+	if err := app.cfg.createOrUpdate(ctx, app.source); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.restoreSnapshot(ctx, &snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if source, err := app.cfg.getCurrent(ctx, app.source); err != nil || source != nil {
+		t.Errorf("GitRepository was not deleted: %v", err)
+	}
+}
+
+func TestRollbackRenamedRelease(t *testing.T) {
+	ctx := context.Background()
+
+	key := types.NamespacedName{Namespace: "nua", Name: "my-app"}
+	labels := (&application{key: key}).managedLabels()
+
+	// Version 1.0.0 was installed as old/old.
+	oldMeta := metav1.ObjectMeta{Namespace: "old", Name: "old", Labels: labels}
+	oldRepo := &sourceapi.GitRepository{ObjectMeta: oldMeta}
+	oldKustomization := &kustomizeapi.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "old",
+			Name:        "old",
+			Labels:      labels,
+			Annotations: map[string]string{versionAnnotation: "1.0.0"},
+		},
+		Spec: kustomizeapi.KustomizationSpec{
+			Path:      "./v1",
+			SourceRef: kustomizeapi.CrossNamespaceSourceReference{Kind: sourceapi.GitRepositoryKind, Name: "old"},
+		},
+	}
+
+	recorder := record.NewFakeRecorder(10)
+
+	app := &application{
+		key: key,
+		cfg: &Config{
+			client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(oldRepo, oldKustomization).Build(),
+			recorder: recorder,
+		},
+		log:            log.WithField("test", t.Name()),
+		currentVersion: "1.0.0",
+		running:        &updateRun{version: "2.0.0"},
+	}
+
+	// Version 2.0.0 deploys my-app/my-app instead.
+	newMeta := metav1.ObjectMeta{Namespace: "my-app", Name: "my-app", Labels: labels}
+	app.source = &sourceapi.GitRepository{ObjectMeta: newMeta}
+	app.release = &kustomizeapi.Kustomization{
+		ObjectMeta: newMeta,
+		Spec: kustomizeapi.KustomizationSpec{
+			Path:      "./v2",
+			SourceRef: kustomizeapi.CrossNamespaceSourceReference{Kind: sourceapi.GitRepositoryKind, Name: "my-app"},
+		},
+	}
+
+	snap, err := app.takeSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if snap.release == nil || refOf(snap.release) != refOf(oldKustomization) {
+		t.Fatalf("got release snapshot %v, want the Kustomization of the installed version", snap.release)
+	}
+
+	if snap.source == nil || refOf(snap.source) != refOf(oldRepo) {
+		t.Fatalf("got source snapshot %v, want the GitRepository of the installed version", snap.source)
+	}
+
+	if err := app.cfg.createOrUpdate(ctx, app.source); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.cfg.createOrUpdate(ctx, app.release); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := app.restoreSnapshot(ctx, snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored == nil || refOf(restored) != refOf(oldKustomization) {
+		t.Fatalf("got restored release %v, want the Kustomization of the installed version", restored)
+	}
+
+	var got kustomizeapi.Kustomization
+	if err := app.cfg.client.Get(ctx, client.ObjectKeyFromObject(app.release), &got); err != nil {
+		t.Fatalf("Kustomization of the update was deleted: %v", err)
+	}
+
+	if !got.Spec.Suspend {
+		t.Error("Kustomization of the update was not suspended")
+	}
+
+	if err := app.cfg.client.Get(ctx, client.ObjectKeyFromObject(oldKustomization), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Spec.Suspend || got.Spec.Path != "./v1" {
+		t.Errorf("Kustomization of the installed version changed: suspended %t, path %s", got.Spec.Suspend, got.Spec.Path)
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "version 1.0.0 is restored with Kustomization old/old") {
+			t.Errorf("got event %q", event)
+		}
+	default:
+		t.Error("no event recorded")
+	}
+}
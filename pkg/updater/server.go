@@ -0,0 +1,33 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// serveHTTP serves the metrics and the health probes on the given address
+// until the context is cancelled.
+func (cfg *Config) serveHTTP(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.Handle("/healthz", probeHandler(cfg.health.live))
+	mux.Handle("/readyz", probeHandler(cfg.health.ready))
+
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+
+		_ = server.Close()
+	}()
+
+	log.Infof("serving metrics and health probes on %s", addr)
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("serving metrics and health probes: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+// OCIRepository is only served by source.toolkit.fluxcd.io/v1beta2, which is
+// newer than the vendored source-controller API, so it is handled as an
+// unstructured object.
+const ociRepositoryKind = "OCIRepository"
+
+var ociRepositoryGroupVersion = schema.GroupVersion{Group: sourceapi.GroupVersion.Group, Version: "v1beta2"}
+
+// newSource returns an empty source of the given kind, as referenced by a
+// Kustomization or HelmRelease.
+func newSource(kind string) (client.Object, error) {
+	switch kind {
+	case sourceapi.GitRepositoryKind:
+		return &sourceapi.GitRepository{}, nil
+	case sourceapi.BucketKind:
+		return &sourceapi.Bucket{}, nil
+	case sourceapi.HelmRepositoryKind:
+		return &sourceapi.HelmRepository{}, nil
+	case ociRepositoryKind:
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(ociRepositoryGroupVersion.WithKind(ociRepositoryKind))
+
+		return obj, nil
+	default:
+		return nil, fmt.Errorf("unsupported source kind %q", kind)
+	}
+}
+
+// generateSource converts the source of the update manifest into the Flux
+// source the Kustomization or HelmRelease applies.
+func (app *application) generateSource(source *v1alpha1.UpdateSource, name, namespace string) (client.Object, error) {
+	switch {
+	case source.Git != nil:
+		return app.generateGitRepository(source.Git, name, namespace), nil
+	case source.OCI != nil:
+		return app.generateOCIRepository(source.OCI, name, namespace), nil
+	case source.Bucket != nil:
+		return app.generateBucket(source.Bucket, name, namespace), nil
+	case source.HelmRepository != nil:
+		return app.generateHelmRepository(source.HelmRepository, name, namespace), nil
+	default:
+		return nil, fmt.Errorf("update manifest has no source")
+	}
+}
+
+// checkSourceServed returns an error when the API server does not serve the
+// kind of the source. OCIRepositories need Flux v0.31 or newer, older
+// Kustomizations don't accept them as source either.
+func (app *application) checkSourceServed() error {
+	served, err := app.cfg.isServed(app.source)
+	if err != nil {
+		return err
+	}
+
+	if !served {
+		return fmt.Errorf("%s is not served by the API server, the update needs a newer Flux", kindOf(app.source))
+	}
+
+	return nil
+}
+
+// generateGitRepository converts the Git source into a GitRepository.
+func (app *application) generateGitRepository(source *v1alpha1.GitSource, name, namespace string) client.Object {
+	/*
+	   apiVersion: source.toolkit.fluxcd.io/v1beta2
+	   kind: GitRepository
+	   metadata:
+	     name: my-app
+	     namespace: default
+	   spec:
+	     interval: 5m
+	     url: https://github.com/surajssd/test-flux
+	     ref:
+	       commit: 9ffef1969677057e21dfe99accbf22f343f96300
+	*/
+	repo := &sourceapi.GitRepository{
+		// The name, namespace and labels are always set by the agent.
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    app.managedLabels(),
+		},
+		Spec: *source.GitRepositorySpec.DeepCopy(),
+	}
+
+	if repo.Spec.Interval.Duration == 0 {
+		repo.Spec.Interval = fluxInstallInterval
+	}
+
+	return repo
+}
+
+// gitSecretKeys are the keys Flux requires in the Secret of a GitRepository,
+// by URL scheme.
+var gitSecretKeys = map[string][]string{
+	"http":  {"username", "password"},
+	"https": {"username", "password"},
+	"ssh":   {"identity", "known_hosts"},
+}
+
+// validateSourceSecret checks that the Secret referenced by the GitRepository
+// exists and has the keys Flux requires, so that no update is applied with a
+// source that can't be fetched.
+func (app *application) validateSourceSecret(ctx context.Context) error {
+	repo, ok := app.source.(*sourceapi.GitRepository)
+	if !ok || repo.Spec.SecretRef == nil {
+		return nil
+	}
+
+	key := types.NamespacedName{Namespace: repo.Namespace, Name: repo.Spec.SecretRef.Name}
+
+	var secret corev1.Secret
+	if err := app.cfg.client.Get(ctx, key, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("Secret %s of the GitRepository not found", key)
+		}
+
+		return fmt.Errorf("getting Secret %s: %w", key, err)
+	}
+
+	u, err := url.Parse(repo.Spec.URL)
+	if err != nil {
+		return fmt.Errorf("parsing URL: %w", err)
+	}
+
+	// HTTPS repositories can also be authenticated by a CA certificate only.
+	if _, ok := secret.Data["caFile"]; ok && u.Scheme == "https" {
+		return nil
+	}
+
+	for _, dataKey := range gitSecretKeys[u.Scheme] {
+		if _, ok := secret.Data[dataKey]; !ok {
+			return fmt.Errorf("Secret %s of the GitRepository has no %s key", key, dataKey)
+		}
+	}
+
+	return nil
+}
+
+// generateOCIRepository converts the OCI source into an OCIRepository.
+func (app *application) generateOCIRepository(source *v1alpha1.OCISource, name, namespace string) client.Object {
+	ref := map[string]interface{}{}
+
+	if source.Digest != "" {
+		ref["digest"] = source.Digest
+	} else {
+		ref["tag"] = source.Tag
+	}
+
+	/*
+	   apiVersion: source.toolkit.fluxcd.io/v1beta2
+	   kind: OCIRepository
+	   metadata:
+	     name: my-app
+	     namespace: default
+	   spec:
+	     interval: 5m
+	     url: oci://ghcr.io/example/my-app-manifests
+	     ref:
+	       digest: sha256:2e8a3b...
+	*/
+	spec := map[string]interface{}{
+		"interval": fluxInstallInterval.Duration.String(),
+		"url":      source.URL,
+		"ref":      ref,
+	}
+
+	if source.Insecure {
+		spec["insecure"] = true
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": spec,
+	}}
+	obj.SetGroupVersionKind(ociRepositoryGroupVersion.WithKind(ociRepositoryKind))
+	obj.SetName(name)
+	obj.SetNamespace(namespace)
+	obj.SetLabels(app.managedLabels())
+
+	return obj
+}
+
+// generateBucket converts the bucket source into a Bucket of an S3 compatible
+// endpoint.
+func (app *application) generateBucket(source *v1alpha1.BucketSource, name, namespace string) client.Object {
+	/*
+	   apiVersion: source.toolkit.fluxcd.io/v1beta1
+	   kind: Bucket
+	   metadata:
+	     name: my-app
+	     namespace: default
+	   spec:
+	     interval: 5m
+	     provider: generic
+	     bucketName: my-bucket
+	     endpoint: minio.example.com:9000
+	     ignore: |
+	       /*
+	       !/my-app/v1.2.3/
+	*/
+	bucket := &sourceapi.Bucket{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    app.managedLabels(),
+		},
+		Spec: sourceapi.BucketSpec{
+			Provider:   sourceapi.GenericBucketProvider,
+			BucketName: source.BucketName,
+			Endpoint:   source.Endpoint,
+			Insecure:   source.Insecure,
+			Interval:   fluxInstallInterval,
+		},
+	}
+
+	// The v1beta1 Bucket has no prefix, so everything outside of it is
+	// ignored instead.
+	if prefix := strings.Trim(source.Prefix, "/"); prefix != "" {
+		ignore := fmt.Sprintf("/*\n!/%s/\n", prefix)
+		bucket.Spec.Ignore = &ignore
+	}
+
+	return bucket
+}
+
+// generateHelmRepository converts the Helm repository source into a
+// HelmRepository.
+func (app *application) generateHelmRepository(source *v1alpha1.HelmRepositorySource, name, namespace string) client.Object {
+	/*
+	   apiVersion: source.toolkit.fluxcd.io/v1beta1
+	   kind: HelmRepository
+	   metadata:
+	     name: my-app
+	     namespace: default
+	   spec:
+	     interval: 5m
+	     url: https://charts.example.com/my-app
+	*/
+	return &sourceapi.HelmRepository{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    app.managedLabels(),
+		},
+		Spec: sourceapi.HelmRepositorySpec{
+			URL:      source.URL,
+			Interval: fluxInstallInterval,
+		},
+	}
+}
@@ -0,0 +1,216 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+var (
+	// nameLabel and namespaceLabel identify the NebraskaApplication that
+	// manages a Flux object.
+	nameLabel      = v1alpha1.GroupVersion.Group + "/name"
+	namespaceLabel = v1alpha1.GroupVersion.Group + "/namespace"
+
+	// versionAnnotation holds the application version that was successfully
+	// installed by the Kustomization or HelmRelease it is set on.
+	versionAnnotation = v1alpha1.GroupVersion.Group + "/version"
+)
+
+// managedLabels returns the labels set on every Flux object created for the
+// application.
+func (app *application) managedLabels() map[string]string {
+	return map[string]string{
+		nameLabel:      app.key.Name,
+		namespaceLabel: app.key.Namespace,
+	}
+}
+
+// listReleases returns the Kustomizations and HelmReleases managed by the
+// application.
+func (app *application) listReleases(ctx context.Context) ([]releaseObject, error) {
+	var kustomizations kustomizeapi.KustomizationList
+	if err := app.cfg.client.List(ctx, &kustomizations, client.MatchingLabels(app.managedLabels())); err != nil {
+		return nil, fmt.Errorf("listing Kustomizations: %w", err)
+	}
+
+	// HelmReleases are not served without the helm-controller.
+	var helmReleases helmapi.HelmReleaseList
+	if err := app.cfg.client.List(ctx, &helmReleases, client.MatchingLabels(app.managedLabels())); err != nil && !apimeta.IsNoMatchError(err) {
+		return nil, fmt.Errorf("listing HelmReleases: %w", err)
+	}
+
+	var releases []releaseObject
+
+	for i := range kustomizations.Items {
+		releases = append(releases, &kustomizations.Items[i])
+	}
+
+	for i := range helmReleases.Items {
+		releases = append(releases, &helmReleases.Items[i])
+	}
+
+	return releases, nil
+}
+
+// discoverInstalledVersion reads back the version recorded on the
+// Kustomization or HelmRelease managed by the application. It returns the
+// default version when the application was never installed. When the releases
+// disagree, the release of the last completed update recorded in the status is
+// the installed one, as the others were left behind when it was renamed.
+func (app *application) discoverInstalledVersion(ctx context.Context, last *v1alpha1.UpdateProgress) (string, error) {
+	releases, err := app.listReleases(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// Releases the agent never found ready have no version yet.
+	var (
+		versions   = map[string]bool{}
+		version    string
+		candidates []string
+	)
+
+	for _, release := range releases {
+		v := release.GetAnnotations()[versionAnnotation]
+		if v == "" {
+			continue
+		}
+
+		versions[v] = true
+		version = v
+		candidates = append(candidates, fmt.Sprintf("%s %s/%s at %s", kindOf(release), release.GetNamespace(), release.GetName(), v))
+	}
+
+	switch len(versions) {
+	case 0:
+		return defaultVersion, nil
+	case 1:
+		app.log.Debugf("found version %s on %s", version, strings.Join(candidates, ", "))
+
+		return version, nil
+	}
+
+	sort.Strings(candidates)
+
+	if last != nil && last.Phase == v1alpha1.UpdatePhaseComplete && last.Release != nil {
+		for _, release := range releases {
+			v := release.GetAnnotations()[versionAnnotation]
+
+			if v != "" && refOf(release) == (objectRef{kind: last.Release.Kind, namespace: last.Release.Namespace, name: last.Release.Name}) {
+				app.log.Warnf("found version %s on %s %s/%s of the last update, ignoring the others: %s",
+					v, last.Release.Kind, last.Release.Namespace, last.Release.Name, strings.Join(candidates, ", "))
+
+				return v, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("the Flux objects of the application disagree on the installed version: %s", strings.Join(candidates, ", "))
+}
+
+// installedRelease returns the release that installed the current version
+// under another name or namespace than the release of the update, or nil when
+// there is none.
+func (app *application) installedRelease(ctx context.Context) (releaseObject, error) {
+	releases, err := app.listReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, release := range releases {
+		if refOf(release) != refOf(app.release) && release.GetAnnotations()[versionAnnotation] == app.currentVersion {
+			return release, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// deletePreviousReleases deletes the releases of earlier versions that were
+// left behind by an update that renamed the release or moved it to another
+// namespace, together with their sources. Releases that were never ready are
+// left alone, as they are suspended for an operator to look at.
+func (app *application) deletePreviousReleases(ctx context.Context, release releaseObject) error {
+	releases, err := app.listReleases(ctx)
+	if err != nil {
+		return err
+	}
+
+	var source client.Object
+
+	current, err := app.cfg.getCurrent(ctx, release)
+	if err != nil {
+		return err
+	}
+
+	if current != nil {
+		if source, err = sourceOf(current.(releaseObject)); err != nil {
+			return fmt.Errorf("getting source of %s: %w", kindOf(current), err)
+		}
+	}
+
+	for _, previous := range releases {
+		if refOf(previous) == refOf(release) || previous.GetAnnotations()[versionAnnotation] == "" {
+			continue
+		}
+
+		previousSource, err := sourceOf(previous)
+		if err != nil {
+			return fmt.Errorf("getting source of %s: %w", kindOf(previous), err)
+		}
+
+		if err := app.cfg.delete(ctx, previous); err != nil {
+			return err
+		}
+
+		if source == nil || refOf(previousSource) != refOf(source) {
+			if err := app.cfg.delete(ctx, previousSource); err != nil {
+				return err
+			}
+		}
+
+		app.log.Infof("deleted %s %s/%s of version %s", kindOf(previous), previous.GetNamespace(), previous.GetName(),
+			previous.GetAnnotations()[versionAnnotation])
+	}
+
+	return nil
+}
+
+// recordInstalledVersion stores the given version on the Kustomization or
+// HelmRelease of the application.
+func (app *application) recordInstalledVersion(ctx context.Context, version string) error {
+	release, err := app.cfg.getCurrent(ctx, app.release)
+	if err != nil {
+		return err
+	}
+
+	if release == nil {
+		return fmt.Errorf("%s %s not found", kindOf(app.release), app.release.GetName())
+	}
+
+	patch := client.MergeFrom(release.DeepCopyObject().(client.Object))
+
+	annotations := release.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	annotations[versionAnnotation] = version
+	release.SetAnnotations(annotations)
+
+	if err := app.cfg.client.Patch(ctx, release, patch); err != nil {
+		return fmt.Errorf("patching %s: %w", kindOf(release), err)
+	}
+
+	return nil
+}
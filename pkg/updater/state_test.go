@@ -0,0 +1,280 @@
+package updater
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+	sourceapi "github.com/fluxcd/source-controller/api/v1beta1"
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+func TestDiscoverInstalledVersion(t *testing.T) {
+	key := types.NamespacedName{Namespace: "nua", Name: "my-app"}
+	labels := (&application{key: key}).managedLabels()
+
+	objectMeta := func(name, version string) metav1.ObjectMeta {
+		meta := metav1.ObjectMeta{Namespace: "my-app", Name: name, Labels: labels}
+
+		if version != "" {
+			meta.Annotations = map[string]string{versionAnnotation: version}
+		}
+
+		return meta
+	}
+
+	for _, tc := range []struct {
+		name    string
+		objs    []client.Object
+		last    *v1alpha1.UpdateProgress
+		want    string
+		wantErr string
+	}{
+		{
+			name: "not installed",
+			want: defaultVersion,
+		},
+		{
+			name: "Kustomization",
+			objs: []client.Object{&kustomizeapi.Kustomization{ObjectMeta: objectMeta("my-app", "1.2.0")}},
+			want: "1.2.0",
+		},
+		{
+			name: "HelmRelease",
+			objs: []client.Object{&helmapi.HelmRelease{ObjectMeta: objectMeta("my-app", "1.2.0")}},
+			want: "1.2.0",
+		},
+		{
+			name: "release without version",
+			objs: []client.Object{&kustomizeapi.Kustomization{ObjectMeta: objectMeta("my-app", "")}},
+			want: defaultVersion,
+		},
+		{
+			name: "releases agreeing",
+			objs: []client.Object{
+				&kustomizeapi.Kustomization{ObjectMeta: objectMeta("my-app", "1.2.0")},
+				&helmapi.HelmRelease{ObjectMeta: objectMeta("my-app", "1.2.0")},
+				&kustomizeapi.Kustomization{ObjectMeta: objectMeta("suspended", "")},
+			},
+			want: "1.2.0",
+		},
+		{
+			name: "releases disagreeing",
+			objs: []client.Object{
+				&kustomizeapi.Kustomization{ObjectMeta: objectMeta("my-app", "1.2.0")},
+				&kustomizeapi.Kustomization{ObjectMeta: objectMeta("old", "1.1.0")},
+			},
+			wantErr: "disagree on the installed version: Kustomization my-app/my-app at 1.2.0, Kustomization my-app/old at 1.1.0",
+		},
+		{
+			name: "release renamed by the last update",
+			objs: []client.Object{
+				&kustomizeapi.Kustomization{ObjectMeta: objectMeta("my-app", "1.2.0")},
+				&kustomizeapi.Kustomization{ObjectMeta: objectMeta("old", "1.1.0")},
+			},
+			last: &v1alpha1.UpdateProgress{
+				Phase:   v1alpha1.UpdatePhaseComplete,
+				Version: "1.2.0",
+				Release: &v1alpha1.ReleaseReference{Kind: kustomizeapi.KustomizationKind, Namespace: "my-app", Name: "my-app"},
+			},
+			want: "1.2.0",
+		},
+		{
+			name: "release renamed by a failed update",
+			objs: []client.Object{
+				&kustomizeapi.Kustomization{ObjectMeta: objectMeta("my-app", "1.2.0")},
+				&kustomizeapi.Kustomization{ObjectMeta: objectMeta("old", "1.1.0")},
+			},
+			last: &v1alpha1.UpdateProgress{
+				Phase:   v1alpha1.UpdatePhaseFailed,
+				Version: "1.3.0",
+				Release: &v1alpha1.ReleaseReference{Kind: kustomizeapi.KustomizationKind, Namespace: "my-app", Name: "my-app"},
+			},
+			wantErr: "disagree on the installed version",
+		},
+		{
+			name: "release of another application",
+			objs: []client.Object{
+				&kustomizeapi.Kustomization{ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "my-app",
+					Name:        "other",
+					Labels:      map[string]string{nameLabel: "other", namespaceLabel: "nua"},
+					Annotations: map[string]string{versionAnnotation: "2.0.0"},
+				}},
+			},
+			want: defaultVersion,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := &application{
+				key: key,
+				cfg: &Config{client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(tc.objs...).Build()},
+				log: log.WithField("test", t.Name()),
+			}
+
+			got, err := app.discoverInstalledVersion(context.Background(), tc.last)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCreateOrUpdateKeepsMetadata(t *testing.T) {
+	ctx := context.Background()
+
+	existing := &sourceapi.GitRepository{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "my-app",
+			Name:        "my-app",
+			Labels:      map[string]string{"team": "payments", nameLabel: "old"},
+			Annotations: map[string]string{"reconcile.fluxcd.io/requestedAt": "now", versionAnnotation: "1.0.0"},
+			Finalizers:  []string{"finalizers.fluxcd.io"},
+		},
+		Spec: sourceapi.GitRepositorySpec{URL: "https://github.com/example/old"},
+	}
+
+	cfg := &Config{client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(existing).Build()}
+
+	obj := &sourceapi.GitRepository{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "my-app",
+			Name:        "my-app",
+			Labels:      map[string]string{nameLabel: "my-app"},
+			Annotations: map[string]string{versionAnnotation: "1.1.0"},
+		},
+		Spec: sourceapi.GitRepositorySpec{URL: "https://github.com/example/new"},
+	}
+
+	if err := cfg.createOrUpdate(ctx, obj); err != nil {
+		t.Fatal(err)
+	}
+
+	var got sourceapi.GitRepository
+	if err := cfg.client.Get(ctx, client.ObjectKeyFromObject(obj), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Spec.URL != "https://github.com/example/new" {
+		t.Errorf("spec not updated: %s", got.Spec.URL)
+	}
+
+	wantLabels := map[string]string{"team": "payments", nameLabel: "my-app"}
+	for k, v := range wantLabels {
+		if got.Labels[k] != v {
+			t.Errorf("label %s: got %q, want %q", k, got.Labels[k], v)
+		}
+	}
+
+	wantAnnotations := map[string]string{"reconcile.fluxcd.io/requestedAt": "now", versionAnnotation: "1.1.0"}
+	for k, v := range wantAnnotations {
+		if got.Annotations[k] != v {
+			t.Errorf("annotation %s: got %q, want %q", k, got.Annotations[k], v)
+		}
+	}
+
+	if len(got.Finalizers) != 1 {
+		t.Errorf("got finalizers %v, want the existing ones", got.Finalizers)
+	}
+}
+
+func TestDeletePreviousReleases(t *testing.T) {
+	ctx := context.Background()
+
+	key := types.NamespacedName{Namespace: "nua", Name: "my-app"}
+	labels := (&application{key: key}).managedLabels()
+
+	release := func(namespace, name, source, version string) *kustomizeapi.Kustomization {
+		k := &kustomizeapi.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+			Spec: kustomizeapi.KustomizationSpec{
+				SourceRef: kustomizeapi.CrossNamespaceSourceReference{Kind: sourceapi.GitRepositoryKind, Name: source},
+			},
+		}
+
+		if version != "" {
+			k.Annotations = map[string]string{versionAnnotation: version}
+		}
+
+		return k
+	}
+
+	repository := func(namespace, name string) *sourceapi.GitRepository {
+		return &sourceapi.GitRepository{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels}}
+	}
+
+	current := release("my-app", "my-app", "my-app", "2.0.0")
+
+	objs := []client.Object{
+		current,
+		repository("my-app", "my-app"),
+		// Renamed, in the same namespace and from the same source.
+		release("my-app", "renamed", "my-app", "1.1.0"),
+		// Moved from another namespace.
+		release("old", "my-app", "my-app", "1.0.0"),
+		repository("old", "my-app"),
+		// Never ready, so suspended.
+		release("my-app", "suspended", "suspended", ""),
+		repository("my-app", "suspended"),
+	}
+
+	app := &application{
+		key: key,
+		cfg: &Config{client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()},
+		log: log.WithField("test", t.Name()),
+	}
+
+	if err := app.deletePreviousReleases(ctx, current); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		obj  client.Object
+		want bool
+	}{
+		{obj: current, want: true},
+		{obj: repository("my-app", "my-app"), want: true},
+		{obj: release("my-app", "renamed", "", "")},
+		{obj: release("old", "my-app", "", "")},
+		{obj: repository("old", "my-app")},
+		{obj: release("my-app", "suspended", "", ""), want: true},
+		{obj: repository("my-app", "suspended"), want: true},
+	} {
+		got, err := app.cfg.getCurrent(ctx, tc.obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (got != nil) != tc.want {
+			t.Errorf("%s %s/%s: got exists %t, want %t", kindOf(tc.obj), tc.obj.GetNamespace(), tc.obj.GetName(), got != nil, tc.want)
+		}
+	}
+
+	// Only the current release is left to discover the version on.
+	version, err := app.discoverInstalledVersion(ctx, nil)
+	if err != nil || version != "2.0.0" {
+		t.Errorf("got version %s, %v, want 2.0.0", version, err)
+	}
+}
@@ -0,0 +1,196 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"sort"
+
+	"github.com/kinvolk/go-omaha/omaha"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// signatureSuffix is appended to the URL of the update manifest to get the URL
+// of its detached signature.
+const signatureSuffix = ".sig"
+
+// verificationError is returned when an update does not match the hash sent by
+// Nebraska or is not signed by a trusted key. Such updates are never applied.
+type verificationError struct {
+	err error
+}
+
+func (e *verificationError) Error() string {
+	return fmt.Sprintf("verifying update: %v", e.err)
+}
+
+func (e *verificationError) Unwrap() error {
+	return e.err
+}
+
+// verifyPackage checks the downloaded update manifest against the size and
+// SHA-256 hash of the Omaha package.
+func verifyPackage(pkg *omaha.Package, data []byte) error {
+	if pkg == nil || pkg.SHA256 == "" {
+		return &verificationError{fmt.Errorf("the Nebraska package has no SHA-256 hash")}
+	}
+
+	if pkg.Size != 0 && pkg.Size != uint64(len(data)) {
+		return &verificationError{fmt.Errorf("expected %d bytes, got %d", pkg.Size, len(data))}
+	}
+
+	expected, err := decodeHash(pkg.SHA256)
+	if err != nil {
+		return &verificationError{fmt.Errorf("decoding SHA-256 hash of the Nebraska package: %w", err)}
+	}
+
+	got := sha256.Sum256(data)
+	if !bytes.Equal(expected, got[:]) {
+		return &verificationError{fmt.Errorf("expected SHA-256 %x, got %x", expected, got)}
+	}
+
+	return nil
+}
+
+// decodeHash decodes a SHA-256 hash given either hex or base64 encoded.
+func decodeHash(value string) ([]byte, error) {
+	if len(value) == hex.EncodedLen(sha256.Size) {
+		return hex.DecodeString(value)
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("expected %d bytes, got %d", sha256.Size, len(hash))
+	}
+
+	return hash, nil
+}
+
+// verifySignature checks the detached signature of the update manifest against
+// the public keys configured in the NebraskaApplication, if any.
+func (app *application) verifySignature(ctx context.Context, manifestURL string, data []byte) error {
+	if app.spec.Verification == nil {
+		return nil
+	}
+
+	// Without the keys no update can be verified, so this is reported as a
+	// failed verification as well.
+	keys, err := app.getPublicKeys(ctx)
+	if err != nil {
+		return withErrorCode(errorCodeVerificationFailed, fmt.Errorf("getting public keys: %w", err))
+	}
+
+	encodedSig, err := download(ctx, manifestURL+signatureSuffix)
+	if err != nil {
+		return &verificationError{fmt.Errorf("fetching signature: %w", err)}
+	}
+
+	sig := decodeSignature(encodedSig)
+
+	for _, key := range keys {
+		if verifyWithKey(key, data, sig) {
+			return nil
+		}
+	}
+
+	return &verificationError{fmt.Errorf("update manifest is not signed by any of the public keys in Secret %s", app.spec.Verification.SecretRef.Name)}
+}
+
+// getPublicKeys returns the public keys of the Secret referenced by the
+// NebraskaApplication.
+func (app *application) getPublicKeys(ctx context.Context) ([]crypto.PublicKey, error) {
+	name := app.spec.Verification.SecretRef.Name
+
+	var secret corev1.Secret
+	if err := app.cfg.client.Get(ctx, types.NamespacedName{Namespace: app.key.Namespace, Name: name}, &secret); err != nil {
+		return nil, fmt.Errorf("getting Secret %s: %w", name, err)
+	}
+
+	// Sort the data keys so that errors are reported consistently.
+	dataKeys := make([]string, 0, len(secret.Data))
+	for dataKey := range secret.Data {
+		dataKeys = append(dataKeys, dataKey)
+	}
+
+	sort.Strings(dataKeys)
+
+	keys := make([]crypto.PublicKey, 0, len(dataKeys))
+
+	for _, dataKey := range dataKeys {
+		key, err := parsePublicKey(secret.Data[dataKey])
+		if err != nil {
+			return nil, fmt.Errorf("parsing public key %s of Secret %s: %w", dataKey, name, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Secret %s has no public keys", name)
+	}
+
+	return keys, nil
+}
+
+// parsePublicKey parses a PEM encoded ed25519 or ECDSA public key, as written
+// by e.g. openssl or cosign.
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// decodeSignature returns the raw signature, which may be given base64
+// encoded. Raw signatures are returned as is, as they may start or end with
+// bytes that look like white space.
+func decodeSignature(data []byte) []byte {
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return data
+	}
+
+	return sig
+}
+
+// verifyWithKey returns true when sig is a valid signature of data. ECDSA
+// signatures are ASN.1 encoded signatures of the SHA-256 hash of the data, as
+// created by cosign sign-blob.
+func verifyWithKey(key crypto.PublicKey, data, sig []byte) bool {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, data, sig)
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(data)
+
+		return ecdsa.VerifyASN1(k, hash[:], sig)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,383 @@
+package updater
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/kinvolk/go-omaha/omaha"
+	log "github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kinvolk/nebraska-update-agent/api/v1alpha1"
+)
+
+// encodePublicKey returns the PEM encoded public key, as written by openssl.
+func encodePublicKey(t *testing.T, key crypto.PublicKey) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func newEd25519Key(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pub, priv
+}
+
+func newECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// signECDSA signs the SHA-256 hash of the data, as cosign sign-blob does.
+func signECDSA(t *testing.T, key *ecdsa.PrivateKey, data []byte) []byte {
+	t.Helper()
+
+	hash := sha256.Sum256(data)
+
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sig
+}
+
+func TestVerifyPackage(t *testing.T) {
+	data := []byte(testManifest)
+	hash := sha256.Sum256(data)
+	otherHash := sha256.Sum256([]byte(testHelmManifest))
+
+	for _, tc := range []struct {
+		name    string
+		pkg     *omaha.Package
+		wantErr string
+	}{
+		{
+			name: "hex hash",
+			pkg:  testPackage(data),
+		},
+		{
+			name: "base64 hash without size",
+			pkg:  &omaha.Package{SHA256: base64.StdEncoding.EncodeToString(hash[:])},
+		},
+		{
+			name:    "no package",
+			wantErr: "the Nebraska package has no SHA-256 hash",
+		},
+		{
+			name:    "no hash",
+			pkg:     &omaha.Package{Size: uint64(len(data))},
+			wantErr: "the Nebraska package has no SHA-256 hash",
+		},
+		{
+			name:    "SHA-256 mismatch",
+			pkg:     &omaha.Package{SHA256: base64.StdEncoding.EncodeToString(otherHash[:]), Size: uint64(len(data))},
+			wantErr: "expected SHA-256",
+		},
+		{
+			name:    "size mismatch",
+			pkg:     &omaha.Package{SHA256: testPackage(data).SHA256, Size: uint64(len(data)) + 1},
+			wantErr: "bytes, got",
+		},
+		{
+			name:    "invalid hash",
+			pkg:     &omaha.Package{SHA256: "not a hash"},
+			wantErr: "decoding SHA-256 hash",
+		},
+		{
+			name:    "truncated hash",
+			pkg:     &omaha.Package{SHA256: base64.StdEncoding.EncodeToString(hash[:16])},
+			wantErr: "decoding SHA-256 hash",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifyPackage(tc.pkg, data)
+
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+
+			var verifyErr *verificationError
+			if !errors.As(err, &verifyErr) {
+				t.Errorf("got %T, want a verificationError", err)
+			}
+		})
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	edPub, _ := newEd25519Key(t)
+	ecKey := newECDSAKey(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{
+			name: "ed25519",
+			data: encodePublicKey(t, edPub),
+		},
+		{
+			name: "ECDSA",
+			data: encodePublicKey(t, &ecKey.PublicKey),
+		},
+		{
+			name:    "RSA",
+			data:    encodePublicKey(t, &rsaKey.PublicKey),
+			wantErr: "unsupported public key type",
+		},
+		{
+			name:    "no PEM",
+			data:    []byte(base64.StdEncoding.EncodeToString(edPub)),
+			wantErr: "no PEM data found",
+		},
+		{
+			name:    "bad PEM contents",
+			data:    pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("not a key")}),
+			wantErr: "parsing public key",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parsePublicKey(tc.data)
+
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeSignature(t *testing.T) {
+	raw := []byte{0xde, 0xad, 0xbe, 0xef}
+	rawWithSpace := []byte{'\n', 0xde, 0xad, ' '}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{name: "raw", data: raw, want: raw},
+		{name: "raw starting and ending with white space", data: rawWithSpace, want: rawWithSpace},
+		{name: "base64", data: []byte(base64.StdEncoding.EncodeToString(raw)), want: raw},
+		{name: "base64 with newline", data: []byte(base64.StdEncoding.EncodeToString(raw) + "\n"), want: raw},
+	} {
+		if got := decodeSignature(tc.data); string(got) != string(tc.want) {
+			t.Errorf("%s: got %x, want %x", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	data := []byte(testManifest)
+	tampered := []byte(strings.Replace(testManifest, "prune: true", "prune: false", 1))
+
+	edPub, edPriv := newEd25519Key(t)
+	_, untrustedPriv := newEd25519Key(t)
+	ecKey := newECDSAKey(t)
+
+	keys := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nua", Name: "keys"},
+		Data: map[string][]byte{
+			"ed25519.pub": encodePublicKey(t, edPub),
+			"cosign.pub":  encodePublicKey(t, &ecKey.PublicKey),
+		},
+	}
+	badKeys := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nua", Name: "bad-keys"},
+		Data:       map[string][]byte{"key.pub": []byte("not a key")},
+	}
+	noKeys := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "nua", Name: "no-keys"}}
+
+	cfg := &Config{client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(keys, badKeys, noKeys).Build()}
+
+	for _, tc := range []struct {
+		name       string
+		data       []byte
+		sig        []byte
+		secret     string
+		wantErr    string
+		wantVerify bool
+	}{
+		{
+			name:   "ed25519",
+			data:   data,
+			sig:    []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(edPriv, data))),
+			secret: "keys",
+		},
+		{
+			name:   "raw ed25519",
+			data:   data,
+			sig:    ed25519.Sign(edPriv, data),
+			secret: "keys",
+		},
+		{
+			name:   "ECDSA",
+			data:   data,
+			sig:    []byte(base64.StdEncoding.EncodeToString(signECDSA(t, ecKey, data))),
+			secret: "keys",
+		},
+		{
+			name:       "tampered manifest with ed25519 signature",
+			data:       tampered,
+			sig:        []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(edPriv, data))),
+			secret:     "keys",
+			wantErr:    "not signed by any of the public keys in Secret keys",
+			wantVerify: true,
+		},
+		{
+			name:       "tampered manifest with ECDSA signature",
+			data:       tampered,
+			sig:        []byte(base64.StdEncoding.EncodeToString(signECDSA(t, ecKey, data))),
+			secret:     "keys",
+			wantErr:    "not signed by any of the public keys in Secret keys",
+			wantVerify: true,
+		},
+		{
+			name:       "untrusted key",
+			data:       data,
+			sig:        []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(untrustedPriv, data))),
+			secret:     "keys",
+			wantErr:    "not signed by any of the public keys in Secret keys",
+			wantVerify: true,
+		},
+		{
+			name:       "no signature",
+			data:       data,
+			secret:     "keys",
+			wantErr:    "fetching signature",
+			wantVerify: true,
+		},
+		{
+			name:    "bad key",
+			data:    data,
+			sig:     ed25519.Sign(edPriv, data),
+			secret:  "bad-keys",
+			wantErr: "parsing public key key.pub of Secret bad-keys: no PEM data found",
+		},
+		{
+			name:    "no keys",
+			data:    data,
+			sig:     ed25519.Sign(edPriv, data),
+			secret:  "no-keys",
+			wantErr: "Secret no-keys has no public keys",
+		},
+		{
+			name:    "no Secret",
+			data:    data,
+			sig:     ed25519.Sign(edPriv, data),
+			secret:  "missing",
+			wantErr: "getting Secret missing",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.sig == nil || r.URL.Path != "/manifest.yaml"+signatureSuffix {
+					http.NotFound(w, r)
+
+					return
+				}
+
+				_, _ = w.Write(tc.sig)
+			}))
+			defer server.Close()
+
+			app := &application{
+				key: types.NamespacedName{Namespace: "nua", Name: "my-app"},
+				cfg: cfg,
+				log: log.WithField("test", t.Name()),
+			}
+			app.spec.Verification = &v1alpha1.Verification{SecretRef: meta.LocalObjectReference{Name: tc.secret}}
+
+			err := app.verifySignature(context.Background(), server.URL+"/manifest.yaml", tc.data)
+
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+
+			var verifyErr *verificationError
+			if got := errors.As(err, &verifyErr); got != tc.wantVerify {
+				t.Errorf("verification error: got %t, want %t", got, tc.wantVerify)
+			}
+
+			// Errors reading the keys are reported as failed verifications.
+			if code := errorCodeOf(err); code != errorCodeVerificationFailed {
+				t.Errorf("got error code %d, want %d", code, errorCodeVerificationFailed)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureDisabled(t *testing.T) {
+	app := &application{}
+
+	// Nothing is downloaded without verification.
+	if err := app.verifySignature(context.Background(), "http://127.0.0.1:0/manifest.yaml", nil); err != nil {
+		t.Fatal(err)
+	}
+}
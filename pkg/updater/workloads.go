@@ -0,0 +1,227 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	helmapi "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// workloadCheckInterval is how often the workloads are checked while waiting
+// for them to become healthy, as they are not watched.
+const workloadCheckInterval = 10 * time.Second
+
+// workloadHealth returns why the object is not healthy, or an empty string
+// when it is.
+type workloadHealth func(obj client.Object) string
+
+// workloadKind is a kind of object applied by a Kustomization whose health is
+// checked.
+type workloadKind struct {
+	newObject func() client.Object
+	health    workloadHealth
+}
+
+// workloadKinds are the kinds that are checked, all other objects applied by a
+// Kustomization are healthy once applied.
+var workloadKinds = map[schema.GroupKind]workloadKind{
+	{Group: appsv1.GroupName, Kind: "Deployment"}: {
+		newObject: func() client.Object { return &appsv1.Deployment{} },
+		health:    deploymentHealth,
+	},
+	{Group: appsv1.GroupName, Kind: "StatefulSet"}: {
+		newObject: func() client.Object { return &appsv1.StatefulSet{} },
+		health:    statefulSetHealth,
+	},
+	{Group: appsv1.GroupName, Kind: "DaemonSet"}: {
+		newObject: func() client.Object { return &appsv1.DaemonSet{} },
+		health:    daemonSetHealth,
+	},
+	{Group: batchv1.GroupName, Kind: "Job"}: {
+		newObject: func() client.Object { return &batchv1.Job{} },
+		health:    jobHealth,
+	},
+	{Group: helmapi.GroupVersion.Group, Kind: helmapi.HelmReleaseKind}: {
+		newObject: func() client.Object { return &helmapi.HelmRelease{} },
+		health:    helmReleaseHealth,
+	},
+}
+
+// unhealthyWorkloads returns the objects applied by the Kustomization that are
+// not healthy yet, each with the reason.
+func (cfg *Config) unhealthyWorkloads(ctx context.Context, k *kustomizeapi.Kustomization) ([]string, error) {
+	if k.Status.Inventory == nil {
+		return nil, nil
+	}
+
+	var unhealthy []string
+
+	for _, entry := range k.Status.Inventory.Entries {
+		namespace, name, gk, err := parseInventoryID(entry.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		wk, ok := workloadKinds[gk]
+		if !ok {
+			continue
+		}
+
+		obj := wk.newObject()
+		desc := fmt.Sprintf("%s %s", gk.Kind, client.ObjectKey{Namespace: namespace, Name: name})
+
+		if err := cfg.client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, obj); err != nil {
+			if errors.IsNotFound(err) {
+				unhealthy = append(unhealthy, desc+": not found")
+
+				continue
+			}
+
+			return nil, fmt.Errorf("getting %s: %w", desc, err)
+		}
+
+		if reason := wk.health(obj); reason != "" {
+			unhealthy = append(unhealthy, desc+": "+reason)
+		}
+	}
+
+	return unhealthy, nil
+}
+
+// parseInventoryID splits the ID of a Kustomization inventory entry, in the
+// format <namespace>_<name>_<group>_<kind>. The namespace of cluster-scoped
+// objects and the core group are empty. Object names can't contain
+// underscores.
+func parseInventoryID(id string) (string, string, schema.GroupKind, error) {
+	parts := strings.Split(id, "_")
+	if len(parts) != 4 || parts[1] == "" || parts[3] == "" { //nolint:gomnd
+		return "", "", schema.GroupKind{}, fmt.Errorf("invalid inventory entry %q", id)
+	}
+
+	return parts[0], parts[1], schema.GroupKind{Group: parts[2], Kind: parts[3]}, nil
+}
+
+func deploymentHealth(obj client.Object) string {
+	d := obj.(*appsv1.Deployment)
+
+	if d.Generation != d.Status.ObservedGeneration {
+		return "rollout not observed yet"
+	}
+
+	for _, c := range d.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Status == corev1.ConditionFalse {
+			return fmt.Sprintf("rollout failed: %s", c.Message)
+		}
+	}
+
+	replicas := replicasOrDefault(d.Spec.Replicas)
+
+	switch {
+	case d.Status.UpdatedReplicas < replicas:
+		return fmt.Sprintf("%d of %d replicas updated", d.Status.UpdatedReplicas, replicas)
+	case d.Status.Replicas > d.Status.UpdatedReplicas:
+		return fmt.Sprintf("%d old replicas pending termination", d.Status.Replicas-d.Status.UpdatedReplicas)
+	case d.Status.AvailableReplicas < replicas:
+		return fmt.Sprintf("%d of %d replicas available", d.Status.AvailableReplicas, replicas)
+	}
+
+	return ""
+}
+
+func statefulSetHealth(obj client.Object) string {
+	s := obj.(*appsv1.StatefulSet)
+
+	if s.Generation != s.Status.ObservedGeneration {
+		return "rollout not observed yet"
+	}
+
+	replicas := replicasOrDefault(s.Spec.Replicas)
+
+	if s.Status.ReadyReplicas < replicas {
+		return fmt.Sprintf("%d of %d replicas ready", s.Status.ReadyReplicas, replicas)
+	}
+
+	if s.Spec.UpdateStrategy.Type != appsv1.RollingUpdateStatefulSetStrategyType {
+		return ""
+	}
+
+	// Replicas below the partition are not updated on purpose.
+	if ru := s.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.Partition != nil && *ru.Partition > 0 {
+		if updated := replicas - *ru.Partition; s.Status.UpdatedReplicas < updated {
+			return fmt.Sprintf("%d of %d replicas updated", s.Status.UpdatedReplicas, updated)
+		}
+
+		return ""
+	}
+
+	if s.Status.UpdateRevision != s.Status.CurrentRevision {
+		return fmt.Sprintf("%d of %d replicas updated", s.Status.UpdatedReplicas, replicas)
+	}
+
+	return ""
+}
+
+func daemonSetHealth(obj client.Object) string {
+	d := obj.(*appsv1.DaemonSet)
+
+	if d.Generation != d.Status.ObservedGeneration {
+		return "rollout not observed yet"
+	}
+
+	desired := d.Status.DesiredNumberScheduled
+
+	switch {
+	case d.Status.UpdatedNumberScheduled < desired:
+		return fmt.Sprintf("%d of %d pods updated", d.Status.UpdatedNumberScheduled, desired)
+	case d.Status.NumberAvailable < desired:
+		return fmt.Sprintf("%d of %d pods available", d.Status.NumberAvailable, desired)
+	}
+
+	return ""
+}
+
+func jobHealth(obj client.Object) string {
+	j := obj.(*batchv1.Job)
+
+	for _, c := range j.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+
+		switch c.Type {
+		case batchv1.JobComplete:
+			return ""
+		case batchv1.JobFailed:
+			return fmt.Sprintf("failed: %s", c.Message)
+		}
+	}
+
+	return "not completed"
+}
+
+func helmReleaseHealth(obj client.Object) string {
+	if isReady(obj.(*helmapi.HelmRelease)) {
+		return ""
+	}
+
+	return "not ready"
+}
+
+// replicasOrDefault returns the desired replicas, which default to one.
+func replicasOrDefault(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+
+	return *replicas
+}
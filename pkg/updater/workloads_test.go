@@ -0,0 +1,386 @@
+package updater
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	kustomizeapi "github.com/fluxcd/kustomize-controller/api/v1beta2"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestParseInventoryID(t *testing.T) {
+	for _, tc := range []struct {
+		id            string
+		wantNamespace string
+		wantName      string
+		wantGK        schema.GroupKind
+		wantErr       bool
+	}{
+		{
+			id:            "my-app_my-app_apps_Deployment",
+			wantNamespace: "my-app",
+			wantName:      "my-app",
+			wantGK:        schema.GroupKind{Group: "apps", Kind: "Deployment"},
+		},
+		{
+			id:            "my-app_config__ConfigMap",
+			wantNamespace: "my-app",
+			wantName:      "config",
+			wantGK:        schema.GroupKind{Kind: "ConfigMap"},
+		},
+		{
+			id:       "_my-app__Namespace",
+			wantName: "my-app",
+			wantGK:   schema.GroupKind{Kind: "Namespace"},
+		},
+		{
+			id:       "_my-role_rbac.authorization.k8s.io_ClusterRole",
+			wantName: "my-role",
+			wantGK:   schema.GroupKind{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole"},
+		},
+		{
+			id:            "my-app_my.app-1_batch_Job",
+			wantNamespace: "my-app",
+			wantName:      "my.app-1",
+			wantGK:        schema.GroupKind{Group: "batch", Kind: "Job"},
+		},
+		{id: "", wantErr: true},
+		{id: "my-app_my-app_Deployment", wantErr: true},
+		{id: "my-app_my-app_apps_Deployment_extra", wantErr: true},
+		{id: "my-app__apps_Deployment", wantErr: true},
+		{id: "my-app_my-app_apps_", wantErr: true},
+	} {
+		namespace, name, gk, err := parseInventoryID(tc.id)
+
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: no error", tc.id)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.id, err)
+
+			continue
+		}
+
+		if namespace != tc.wantNamespace || name != tc.wantName || gk != tc.wantGK {
+			t.Errorf("%q: got %q, %q, %v, want %q, %q, %v", tc.id, namespace, name, gk, tc.wantNamespace, tc.wantName, tc.wantGK)
+		}
+	}
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func TestWorkloadHealth(t *testing.T) {
+	objectMeta := metav1.ObjectMeta{Namespace: "my-app", Name: "my-app", Generation: 2}
+
+	for _, tc := range []struct {
+		name   string
+		obj    client.Object
+		health workloadHealth
+		want   string
+	}{
+		{
+			name: "Deployment ready",
+			obj: &appsv1.Deployment{
+				ObjectMeta: objectMeta,
+				Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(3)},
+				Status:     appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 3, AvailableReplicas: 3},
+			},
+			health: deploymentHealth,
+		},
+		{
+			name: "Deployment with default replicas",
+			obj: &appsv1.Deployment{
+				ObjectMeta: objectMeta,
+				Status:     appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1},
+			},
+			health: deploymentHealth,
+		},
+		{
+			name: "Deployment not observed",
+			obj: &appsv1.Deployment{
+				ObjectMeta: objectMeta,
+				Status:     appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1},
+			},
+			health: deploymentHealth,
+			want:   "rollout not observed yet",
+		},
+		{
+			name: "Deployment rollout failed",
+			obj: &appsv1.Deployment{
+				ObjectMeta: objectMeta,
+				Status: appsv1.DeploymentStatus{
+					ObservedGeneration: 2,
+					Conditions: []appsv1.DeploymentCondition{{
+						Type:    appsv1.DeploymentProgressing,
+						Status:  corev1.ConditionFalse,
+						Message: "ReplicaSet has timed out progressing",
+					}},
+				},
+			},
+			health: deploymentHealth,
+			want:   "rollout failed: ReplicaSet has timed out progressing",
+		},
+		{
+			name: "Deployment updating",
+			obj: &appsv1.Deployment{
+				ObjectMeta: objectMeta,
+				Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(3)},
+				Status:     appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 1, AvailableReplicas: 3},
+			},
+			health: deploymentHealth,
+			want:   "1 of 3 replicas updated",
+		},
+		{
+			name: "Deployment terminating old replicas",
+			obj: &appsv1.Deployment{
+				ObjectMeta: objectMeta,
+				Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(3)},
+				Status:     appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 4, UpdatedReplicas: 3, AvailableReplicas: 3},
+			},
+			health: deploymentHealth,
+			want:   "1 old replicas pending termination",
+		},
+		{
+			name: "Deployment not available",
+			obj: &appsv1.Deployment{
+				ObjectMeta: objectMeta,
+				Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(3)},
+				Status:     appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 3, AvailableReplicas: 2},
+			},
+			health: deploymentHealth,
+			want:   "2 of 3 replicas available",
+		},
+		{
+			name: "StatefulSet ready",
+			obj: &appsv1.StatefulSet{
+				ObjectMeta: objectMeta,
+				Spec: appsv1.StatefulSetSpec{
+					Replicas:       int32Ptr(2),
+					UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType},
+				},
+				Status: appsv1.StatefulSetStatus{ObservedGeneration: 2, ReadyReplicas: 2, UpdatedReplicas: 2, CurrentRevision: "r2", UpdateRevision: "r2"},
+			},
+			health: statefulSetHealth,
+		},
+		{
+			name: "StatefulSet not observed",
+			obj: &appsv1.StatefulSet{
+				ObjectMeta: objectMeta,
+				Status:     appsv1.StatefulSetStatus{ObservedGeneration: 1, ReadyReplicas: 1},
+			},
+			health: statefulSetHealth,
+			want:   "rollout not observed yet",
+		},
+		{
+			name: "StatefulSet not ready",
+			obj: &appsv1.StatefulSet{
+				ObjectMeta: objectMeta,
+				Spec:       appsv1.StatefulSetSpec{Replicas: int32Ptr(2)},
+				Status:     appsv1.StatefulSetStatus{ObservedGeneration: 2, ReadyReplicas: 1},
+			},
+			health: statefulSetHealth,
+			want:   "1 of 2 replicas ready",
+		},
+		{
+			name: "StatefulSet updating",
+			obj: &appsv1.StatefulSet{
+				ObjectMeta: objectMeta,
+				Spec: appsv1.StatefulSetSpec{
+					Replicas:       int32Ptr(2),
+					UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType},
+				},
+				Status: appsv1.StatefulSetStatus{ObservedGeneration: 2, ReadyReplicas: 2, UpdatedReplicas: 1, CurrentRevision: "r1", UpdateRevision: "r2"},
+			},
+			health: statefulSetHealth,
+			want:   "1 of 2 replicas updated",
+		},
+		{
+			name: "StatefulSet updated up to the partition",
+			obj: &appsv1.StatefulSet{
+				ObjectMeta: objectMeta,
+				Spec: appsv1.StatefulSetSpec{
+					Replicas: int32Ptr(3),
+					UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+						Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+						RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: int32Ptr(2)},
+					},
+				},
+				Status: appsv1.StatefulSetStatus{ObservedGeneration: 2, ReadyReplicas: 3, UpdatedReplicas: 1, CurrentRevision: "r1", UpdateRevision: "r2"},
+			},
+			health: statefulSetHealth,
+		},
+		{
+			name: "StatefulSet updating up to the partition",
+			obj: &appsv1.StatefulSet{
+				ObjectMeta: objectMeta,
+				Spec: appsv1.StatefulSetSpec{
+					Replicas: int32Ptr(3),
+					UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+						Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+						RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: int32Ptr(1)},
+					},
+				},
+				Status: appsv1.StatefulSetStatus{ObservedGeneration: 2, ReadyReplicas: 3, UpdatedReplicas: 1, CurrentRevision: "r1", UpdateRevision: "r2"},
+			},
+			health: statefulSetHealth,
+			want:   "1 of 2 replicas updated",
+		},
+		{
+			name: "StatefulSet updated on delete",
+			obj: &appsv1.StatefulSet{
+				ObjectMeta: objectMeta,
+				Spec: appsv1.StatefulSetSpec{
+					Replicas:       int32Ptr(2),
+					UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType},
+				},
+				Status: appsv1.StatefulSetStatus{ObservedGeneration: 2, ReadyReplicas: 2, CurrentRevision: "r1", UpdateRevision: "r2"},
+			},
+			health: statefulSetHealth,
+		},
+		{
+			name: "DaemonSet ready",
+			obj: &appsv1.DaemonSet{
+				ObjectMeta: objectMeta,
+				Status:     appsv1.DaemonSetStatus{ObservedGeneration: 2, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 3, NumberAvailable: 3},
+			},
+			health: daemonSetHealth,
+		},
+		{
+			name: "DaemonSet without nodes",
+			obj: &appsv1.DaemonSet{
+				ObjectMeta: objectMeta,
+				Status:     appsv1.DaemonSetStatus{ObservedGeneration: 2},
+			},
+			health: daemonSetHealth,
+		},
+		{
+			name: "DaemonSet not observed",
+			obj: &appsv1.DaemonSet{
+				ObjectMeta: objectMeta,
+				Status:     appsv1.DaemonSetStatus{ObservedGeneration: 1},
+			},
+			health: daemonSetHealth,
+			want:   "rollout not observed yet",
+		},
+		{
+			name: "DaemonSet updating",
+			obj: &appsv1.DaemonSet{
+				ObjectMeta: objectMeta,
+				Status:     appsv1.DaemonSetStatus{ObservedGeneration: 2, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 2, NumberAvailable: 3},
+			},
+			health: daemonSetHealth,
+			want:   "2 of 3 pods updated",
+		},
+		{
+			name: "DaemonSet not available",
+			obj: &appsv1.DaemonSet{
+				ObjectMeta: objectMeta,
+				Status:     appsv1.DaemonSetStatus{ObservedGeneration: 2, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 3, NumberAvailable: 1},
+			},
+			health: daemonSetHealth,
+			want:   "1 of 3 pods available",
+		},
+		{
+			name: "Job complete",
+			obj: &batchv1.Job{
+				ObjectMeta: objectMeta,
+				Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+					{Type: batchv1.JobComplete, Status: corev1.ConditionTrue},
+				}},
+			},
+			health: jobHealth,
+		},
+		{
+			name:   "Job running",
+			obj:    &batchv1.Job{ObjectMeta: objectMeta},
+			health: jobHealth,
+			want:   "not completed",
+		},
+		{
+			name: "Job failed",
+			obj: &batchv1.Job{
+				ObjectMeta: objectMeta,
+				Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+					{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Message: "Job has reached the specified backoff limit"},
+				}},
+			},
+			health: jobHealth,
+			want:   "failed: Job has reached the specified backoff limit",
+		},
+		{
+			name: "Job with false condition",
+			obj: &batchv1.Job{
+				ObjectMeta: objectMeta,
+				Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+					{Type: batchv1.JobFailed, Status: corev1.ConditionFalse},
+				}},
+			},
+			health: jobHealth,
+			want:   "not completed",
+		},
+	} {
+		if got := tc.health(tc.obj); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUnhealthyWorkloads(t *testing.T) {
+	ready := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "my-app", Name: "ready"},
+		Status:     appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1},
+	}
+	updating := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "my-app", Name: "updating"},
+		Status:     appsv1.DeploymentStatus{Replicas: 1, AvailableReplicas: 1},
+	}
+
+	cfg := &Config{client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(ready, updating).Build()}
+
+	k := &kustomizeapi.Kustomization{
+		Status: kustomizeapi.KustomizationStatus{
+			Inventory: &kustomizeapi.ResourceInventory{Entries: []kustomizeapi.ResourceRef{
+				{ID: "_my-app__Namespace", Version: "v1"},
+				{ID: "my-app_config__ConfigMap", Version: "v1"},
+				{ID: "my-app_ready_apps_Deployment", Version: "v1"},
+				{ID: "my-app_updating_apps_Deployment", Version: "v1"},
+				{ID: "my-app_migrate_batch_Job", Version: "v1"},
+			}},
+		},
+	}
+
+	got, err := cfg.unhealthyWorkloads(context.Background(), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"Deployment my-app/updating: 0 of 1 replicas updated",
+		"Job my-app/migrate: not found",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	k.Status.Inventory.Entries = append(k.Status.Inventory.Entries, kustomizeapi.ResourceRef{ID: "invalid"})
+
+	if _, err := cfg.unhealthyWorkloads(context.Background(), k); err == nil {
+		t.Error("no error for an invalid inventory entry")
+	}
+}